@@ -0,0 +1,48 @@
+// Command zap runs Gunfish which writes logs to zap.
+//
+// Gunfish does not depend on zap, so build it in your module which requires go.uber.org/zap:
+//
+//	go get go.uber.org/zap
+//	go run . -c /etc/gunfish/config.toml
+package main
+
+import (
+	"flag"
+	"log"
+
+	gunfish "github.com/kayac/Gunfish"
+	"github.com/kayac/Gunfish/config"
+	"github.com/kayac/Gunfish/logger"
+	"go.uber.org/zap"
+)
+
+func main() {
+	var confPath, environment string
+	flag.StringVar(&confPath, "c", "/etc/gunfish/config.toml", "specify config file.")
+	flag.StringVar(&environment, "E", "production", "APNS environment. (production, development, or test)")
+	flag.Parse()
+
+	zl, err := zap.NewProduction()
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer zl.Sync()
+	gunfish.SetLogger(logger.NewZap(zl.Sugar(), logger.InfoLevel))
+
+	c, err := config.LoadConfig(confPath)
+	if err != nil {
+		log.Fatal(err)
+	}
+	var env gunfish.Environment
+	switch environment {
+	case "production":
+		env = gunfish.Production
+	case "development":
+		env = gunfish.Development
+	case "test":
+		env = gunfish.Test
+	default:
+		log.Fatalf("Unknown environment: %s", environment)
+	}
+	gunfish.StartServer(c, env)
+}
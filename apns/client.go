@@ -10,6 +10,7 @@ import (
 	"net/url"
 	"time"
 
+	"github.com/kayac/Gunfish/clock"
 	"github.com/kayac/Gunfish/config"
 	"golang.org/x/net/http2"
 )
@@ -27,6 +28,9 @@ var ClientTransport = func(cert tls.Certificate) *http.Transport {
 	}
 }
 
+// Clock is the source of time to issue provider authentication tokens.
+var Clock clock.Clock = clock.Real
+
 type authToken struct {
 	jwt      string
 	issuedAt time.Time
@@ -49,7 +53,19 @@ func (ac *Client) Send(n Notification) ([]Result, error) {
 	if err != nil {
 		return nil, err
 	}
+	return ac.do(req, n.Token)
+}
 
+// SendRaw sends a notification whose payload is the encoded JSON as is. n.Payload is ignored.
+func (ac *Client) SendRaw(n Notification, payload []byte) ([]Result, error) {
+	req, err := ac.NewRawRequest(n.Token, &n.Header, payload)
+	if err != nil {
+		return nil, err
+	}
+	return ac.do(req, n.Token)
+}
+
+func (ac *Client) do(req *http.Request, token string) ([]Result, error) {
 	res, err := ac.client.Do(req)
 	if err != nil {
 		return nil, err
@@ -60,7 +76,7 @@ func (ac *Client) Send(n Notification) ([]Result, error) {
 		Result{
 			APNsID:     res.Header.Get("apns-id"),
 			StatusCode: res.StatusCode,
-			Token:      n.Token,
+			Token:      token,
 		},
 	}
 
@@ -77,14 +93,23 @@ func (ac *Client) Send(n Notification) ([]Result, error) {
 	return ret, nil
 }
 
+// HTTPClient returns the http.Client which sends requests to apns.
+func (ac *Client) HTTPClient() *http.Client {
+	return ac.client
+}
+
 // NewRequest creates request for apns
 func (ac *Client) NewRequest(token string, h *Header, payload Payload) (*http.Request, error) {
-	u, err := url.Parse(fmt.Sprintf("%s/3/device/%s", ac.Host, token))
+	data, err := payload.MarshalJSON()
 	if err != nil {
 		return nil, err
 	}
+	return ac.NewRawRequest(token, h, data)
+}
 
-	data, err := payload.MarshalJSON()
+// NewRawRequest creates request for apns with the encoded JSON payload.
+func (ac *Client) NewRawRequest(token string, h *Header, data []byte) (*http.Request, error) {
+	u, err := url.Parse(fmt.Sprintf("%s/3/device/%s", ac.Host, token))
 	if err != nil {
 		return nil, err
 	}
@@ -110,13 +135,16 @@ func (ac *Client) NewRequest(token string, h *Header, payload Payload) (*http.Re
 		if h.ApnsPushType != "" {
 			nreq.Header.Set("apns-push-type", h.ApnsPushType)
 		}
+		if h.ApnsCollapseID != "" {
+			nreq.Header.Set("apns-collapse-id", h.ApnsCollapseID)
+		}
 	}
 
 	// APNs provider token authenticaton
 	if ac.useAuthToken {
 		// If iat of jwt is more than 1 hour ago, returns 403 InvalidProviderToken.
 		// So, recreate jwt earlier than 1 hour.
-		if ac.authToken.issuedAt.Add(time.Hour - time.Minute).Before(time.Now()) {
+		if ac.authToken.issuedAt.Add(time.Hour - time.Minute).Before(Clock.Now()) {
 			if err := ac.issueToken(); err != nil {
 				return nil, err
 			}
@@ -136,7 +164,7 @@ func (ac *Client) issueToken() error {
 		> Update the authentication token no more than once every 20 minutes.
 
 	*/
-	tokenTime := ((time.Now().Unix() - 600) / 1800) * 1800
+	tokenTime := ProviderTokenTime(Clock.Now())
 
 	var err error
 	ac.authToken.jwt, err = CreateJWT(ac.key, ac.kid, ac.teamID, tokenTime)
@@ -147,6 +175,12 @@ func (ac *Client) issueToken() error {
 	return nil
 }
 
+// ProviderTokenTime returns the iat of a provider authentication token to be used at t.
+// It is a unixtime of nearest HH:00:00 or HH:30:00 from t-10 min.
+func ProviderTokenTime(t time.Time) int64 {
+	return ((t.Unix() - 600) / 1800) * 1800
+}
+
 func NewClient(conf config.SectionApns) (*Client, error) {
 	useAuthToken := conf.Kid != "" && conf.TeamID != ""
 	tr := &http.Transport{}
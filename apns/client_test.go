@@ -0,0 +1,121 @@
+package apns
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/kayac/Gunfish/clock"
+	"github.com/kayac/Gunfish/config"
+)
+
+func TestProviderTokenTime(t *testing.T) {
+	at := func(h, m, s int) time.Time {
+		return time.Date(2020, 1, 1, h, m, s, 0, time.UTC)
+	}
+	testCases := []struct {
+		now time.Time
+		iat time.Time
+	}{
+		{at(12, 0, 0), at(11, 30, 0)},
+		{at(12, 9, 59), at(11, 30, 0)},
+		{at(12, 10, 0), at(12, 0, 0)},
+		{at(12, 39, 59), at(12, 0, 0)},
+		{at(12, 40, 0), at(12, 30, 0)},
+		{at(13, 9, 59), at(12, 30, 0)},
+	}
+	for _, c := range testCases {
+		if iat := ProviderTokenTime(c.now); iat != c.iat.Unix() {
+			t.Errorf("%s: unexpected iat %s want %s", c.now, time.Unix(iat, 0).UTC(), c.iat)
+		}
+	}
+}
+
+func TestProviderTokenRollover(t *testing.T) {
+	start := time.Date(2020, 1, 1, 12, 10, 0, 0, time.UTC)
+	fake := clock.NewFake(start)
+	Clock = fake
+	defer func() { Clock = clock.Real }()
+
+	ac := newTokenClient(t)
+	testCases := []struct {
+		elapsed time.Duration
+		iat     time.Time
+	}{
+		{0, start.Add(-10 * time.Minute)},                                      // 12:10:00 -> 12:00
+		{time.Minute * 48, start.Add(-10 * time.Minute)},                       // 12:58:00 -> 12:00
+		{time.Minute*49 + time.Second, start.Add(20 * time.Minute)},            // 12:59:01 -> 12:30
+		{time.Minute * 79, start.Add(20 * time.Minute)},                        // 13:29:00 -> 12:30
+		{time.Minute*79 + time.Second*2, start.Add(50 * time.Minute)},          // 13:29:02 -> 13:00
+		{time.Hour*3 + time.Minute*5, start.Add(time.Hour*2 + time.Minute*50)}, // 15:15:00 -> 15:00
+	}
+	for _, c := range testCases {
+		fake.Set(start.Add(c.elapsed))
+		req, err := ac.NewRequest("xxx", nil, Payload{})
+		if err != nil {
+			t.Fatal(err)
+		}
+		iat := iatOf(t, req.Header.Get("Authorization"))
+		if iat != c.iat.Unix() {
+			t.Errorf("%s: unexpected iat %s want %s", fake.Now(), time.Unix(iat, 0).UTC(), c.iat)
+		}
+		if age := fake.Now().Sub(time.Unix(iat, 0)); age >= time.Hour {
+			t.Errorf("%s: token is too old: %s", fake.Now(), age)
+		}
+	}
+}
+
+func newTokenClient(t *testing.T) *Client {
+	dir, err := ioutil.TempDir("", "gunfish-apns")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	der, err := x509.MarshalPKCS8PrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyFile := filepath.Join(dir, "key.p8")
+	if err := ioutil.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: der}), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	ac, err := NewClient(config.SectionApns{Host: "https://localhost", KeyFile: keyFile, Kid: "KID", TeamID: "TEAMID"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return ac
+}
+
+func iatOf(t *testing.T, auth string) int64 {
+	parts := strings.Split(strings.TrimPrefix(auth, "bearer "), ".")
+	if len(parts) != 3 {
+		t.Fatalf("unexpected authorization: %s", auth)
+	}
+	b, err := base64.RawURLEncoding.DecodeString(parts[1])
+	if err != nil {
+		t.Fatal(err)
+	}
+	var claim struct {
+		Iat int64 `json:"iat"`
+	}
+	if err := json.Unmarshal(b, &claim); err != nil {
+		t.Fatal(err)
+	}
+	return claim.Iat
+}
@@ -20,6 +20,8 @@ const (
 )
 
 // StartAPNSMockServer starts HTTP/2 server for mock
+//
+// Deprecated: Use mock.NewAPNsMockServer, which supports scenario rules.
 func StartAPNSMockServer(cert, key string) {
 	// Create TLSlistener
 	s := http.Server{}
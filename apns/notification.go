@@ -2,6 +2,8 @@ package apns
 
 import (
 	"encoding/json"
+	"fmt"
+	"math"
 )
 
 // Request for a http2 client
@@ -18,6 +20,7 @@ type Header struct {
 	ApnsPriority   string `json:"apns-priority,omitempty"`
 	ApnsTopic      string `json:"apns-topic,omitempty"`
 	ApnsPushType   string `json:"apns-push-type,omitempty"`
+	ApnsCollapseID string `json:"apns-collapse-id,omitempty"`
 }
 
 // Payload is Notification Payload
@@ -63,37 +66,66 @@ func (p Payload) MarshalJSON() ([]byte, error) {
 }
 
 // UnmarshalJSON for Payload struct.
+// APS is nil when "aps" is missing or null.
 func (p *Payload) UnmarshalJSON(data []byte) error {
 	var payloadMap map[string]interface{}
-	p.APS = &APS{}
+	p.APS = nil
 	p.Optional = make(map[string]interface{})
 
 	if err := json.Unmarshal(data, &payloadMap); err != nil {
 		return err
 	}
 
-	apsMap := payloadMap["aps"].(map[string]interface{})
+	for k, v := range payloadMap {
+		if k != "aps" {
+			p.Optional[k] = v
+		}
+	}
+
+	if payloadMap["aps"] == nil {
+		return nil
+	}
+	apsMap, ok := payloadMap["aps"].(map[string]interface{})
+	if !ok {
+		return fmt.Errorf("aps must be an object: %v", payloadMap["aps"])
+	}
 
+	p.APS = &APS{}
 	for k, v := range apsMap {
+		var ok bool
 		switch k {
 		case "alert":
-			p.APS.Alert = v
+			// any alert is passed through, and null is no alert
+			p.APS.Alert, ok = v, true
 		case "badge":
-			p.APS.Badge = int(v.(float64))
+			p.APS.Badge, ok = toInt(v)
 		case "sound":
-			p.APS.Sound = v.(string)
+			p.APS.Sound, ok = v.(string)
 		case "category":
-			p.APS.Category = v.(string)
+			p.APS.Category, ok = v.(string)
 		case "content-available":
-			p.APS.ContentAvailable = int(v.(float64))
+			p.APS.ContentAvailable, ok = toInt(v)
+		case "thread-id":
+			p.APS.ThreadID, ok = v.(string)
+		case "mutable-content":
+			p.APS.MutableContent, ok = toInt(v)
+		case "target-content-id":
+			p.APS.TargetContentID, ok = v.(string)
+		default:
+			ok = true
 		}
-	}
-
-	for k, v := range payloadMap {
-		if k != "aps" {
-			p.Optional[k] = v
+		if !ok {
+			return fmt.Errorf("invalid type of aps.%s: %v", k, v)
 		}
 	}
 
 	return nil
 }
+
+func toInt(v interface{}) (int, bool) {
+	f, ok := v.(float64)
+	if !ok || f != math.Trunc(f) || math.Abs(f) > math.MaxInt32 {
+		return 0, false
+	}
+	return int(f), true
+}
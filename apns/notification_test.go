@@ -2,7 +2,9 @@ package apns
 
 import (
 	"encoding/json"
+	"reflect"
 	"testing"
+	"testing/quick"
 )
 
 var (
@@ -26,3 +28,136 @@ func TestUnmarshal(t *testing.T) {
 		t.Errorf("Expected %s, but got %s", jstr, pjson)
 	}
 }
+
+func TestPayloadRoundTrip(t *testing.T) {
+	f := func(alert string, badge int16, sound, category string, contentAvailable, mutableContent bool, threadID, targetContentID string, optional map[string]string) bool {
+		p := Payload{
+			APS: &APS{
+				Alert:           alert,
+				Badge:           int(badge),
+				Sound:           sound,
+				Category:        category,
+				ThreadID:        threadID,
+				TargetContentID: targetContentID,
+			},
+			Optional: make(map[string]interface{}),
+		}
+		if alert == "" {
+			p.APS.Alert = nil
+		}
+		if contentAvailable {
+			p.APS.ContentAvailable = 1
+		}
+		if mutableContent {
+			p.APS.MutableContent = 1
+		}
+		for k, v := range optional {
+			if k != "aps" {
+				p.Optional[k] = v
+			}
+		}
+
+		b, err := json.Marshal(p)
+		if err != nil {
+			t.Log(err)
+			return false
+		}
+		var decoded Payload
+		if err := json.Unmarshal(b, &decoded); err != nil {
+			t.Log(err)
+			return false
+		}
+		if !reflect.DeepEqual(p, decoded) {
+			t.Logf("mismatch decoded payload: %s", b)
+			return false
+		}
+		return true
+	}
+	if err := quick.Check(f, nil); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestPayloadRoundTripJSON(t *testing.T) {
+	for _, s := range []string{
+		`{"aps":{"alert":null,"badge":1}}`,
+		`{"aps":{"alert":1}}`,
+		`{"aps":{"alert":["a","b"]}}`,
+		`{"aps":{"alert":{"title":"t","body":"b"}},"foo":"bar"}`,
+	} {
+		var p Payload
+		if err := json.Unmarshal([]byte(s), &p); err != nil {
+			t.Errorf("%s: %s", s, err)
+			continue
+		}
+		b, err := json.Marshal(p)
+		if err != nil {
+			t.Errorf("%s: %s", s, err)
+			continue
+		}
+		var again Payload
+		if err := json.Unmarshal(b, &again); err != nil {
+			t.Errorf("%s: %s", b, err)
+			continue
+		}
+		if !reflect.DeepEqual(p, again) {
+			t.Errorf("%s: mismatch decoded payload: %s", s, b)
+		}
+	}
+
+	var p Payload
+	if err := json.Unmarshal([]byte(`{"aps":{"alert":null,"badge":1}}`), &p); err != nil {
+		t.Fatal(err)
+	}
+	if p.APS == nil || p.APS.Alert != nil || p.APS.Badge != 1 {
+		t.Errorf("null alert must be no alert: %#v", p.APS)
+	}
+}
+
+func TestUnmarshalInvalidPayload(t *testing.T) {
+	for _, s := range []string{
+		`[]`,
+		`{"aps":"xxx"}`,
+		`{"aps":{"badge":"1"}}`,
+		`{"aps":{"badge":1.5}}`,
+		`{"aps":{"sound":1}}`,
+		`{"aps":{"content-available":true}}`,
+	} {
+		var p Payload
+		if err := json.Unmarshal([]byte(s), &p); err == nil {
+			t.Errorf("%s: must be failed to unmarshal: %#v", s, p.APS)
+		}
+	}
+
+	var p Payload
+	if err := json.Unmarshal([]byte(`{"foo":"bar"}`), &p); err != nil {
+		t.Error(err)
+	}
+	if p.APS != nil {
+		t.Errorf("APS must be nil without aps: %#v", p.APS)
+	}
+}
+
+func FuzzPayloadUnmarshalJSON(f *testing.F) {
+	f.Add([]byte(jstr))
+	f.Add([]byte(`{"aps":{"alert":{"title":"t","body":"b","loc-args":["a"]},"mutable-content":1,"thread-id":"x"}}`))
+	f.Add([]byte(`{"aps":null}`))
+	f.Add([]byte(`{"aps":{"badge":"1"}}`))
+	f.Fuzz(func(t *testing.T, data []byte) {
+		var p Payload
+		if err := json.Unmarshal(data, &p); err != nil {
+			return
+		}
+		b, err := p.MarshalJSON()
+		if err != nil {
+			t.Fatal(err)
+		}
+		var again Payload
+		if err := json.Unmarshal(b, &again); err != nil {
+			t.Fatalf("failed to unmarshal %s: %s", b, err)
+		}
+		if !reflect.DeepEqual(p, again) {
+			t.Errorf("mismatch: %#v %#v", p, again)
+		}
+	})
+}
@@ -0,0 +1,206 @@
+// Package audit writes the delivery event log, an append-only stream of one record per notification outcome.
+// It is independent of the application logs and their level, and is enabled by the [audit] section of the configuration.
+package audit
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/kayac/Gunfish/config"
+)
+
+// Formats of the records
+const (
+	FormatJSON = "json"
+	FormatLTSV = "ltsv"
+)
+
+// Stdout is the output which writes records to the standard output.
+const Stdout = "stdout"
+
+// Reasons of notifications which Gunfish gives up before sending them. Their Status is 0.
+const (
+	ReasonDropped   = "Dropped"   // e.g. the retry queue is full, or the client of the provider is not present
+	ReasonCoalesced = "Coalesced" // replaced by a newer notification of the same collapse key
+)
+
+// Event is the outcome of a notification.
+type Event struct {
+	Time      time.Time
+	Provider  string
+	TokenHash string        // HashToken of the device token. Empty for topics of FCM v1.
+	ID        string        // apns-id of APNs, message_id of FCM or message name of FCM v1
+	Status    int           // HTTP status of the provider. 0 when the notification could not be sent.
+	Reason    string        // error reason of the provider, or the error of the connection
+	Tries     int           // number of attempts to send the notification
+	Latency   time.Duration // response time of the last attempt
+	Caller    map[string]string
+}
+
+// HashToken returns the hex encoded SHA-256 of token, which is written to records instead of the token.
+func HashToken(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
+
+type jsonEvent struct {
+	Time      string            `json:"time"`
+	Provider  string            `json:"provider"`
+	TokenHash string            `json:"token_hash"`
+	ID        string            `json:"id,omitempty"`
+	Status    int               `json:"status"`
+	Reason    string            `json:"reason,omitempty"`
+	Tries     int               `json:"tries"`
+	Latency   float64           `json:"latency"`
+	Caller    map[string]string `json:"caller,omitempty"`
+}
+
+// Log writes events as records. It is safe for concurrent use.
+type Log struct {
+	format  string
+	headers []string
+
+	mu  sync.Mutex
+	w   io.Writer
+	buf bytes.Buffer
+}
+
+// New creates Log which writes records to w in the format.
+// headers are the HTTP request headers written as the caller metadata.
+func New(w io.Writer, format string, headers []string) (*Log, error) {
+	switch format {
+	case "":
+		format = FormatJSON
+	case FormatJSON, FormatLTSV:
+	default:
+		return nil, fmt.Errorf("unknown format of audit log: %s", format)
+	}
+	hs := make([]string, 0, len(headers))
+	for _, h := range headers {
+		hs = append(hs, http.CanonicalHeaderKey(h))
+	}
+	return &Log{format: format, headers: hs, w: w}, nil
+}
+
+// Open creates Log which writes records to the output of conf.
+func Open(conf config.SectionAudit) (*Log, error) {
+	var w io.Writer
+	switch conf.Output {
+	case "", Stdout:
+		w = os.Stdout
+	default:
+		f, err := OpenFile(conf.Output, Rotation{
+			MaxSize:    conf.MaxSize * 1024 * 1024,
+			Interval:   conf.RotateInterval.Duration,
+			MaxBackups: conf.MaxBackups,
+			MaxAge:     conf.MaxAge.Duration,
+		})
+		if err != nil {
+			return nil, err
+		}
+		w = f
+	}
+	return New(w, conf.Format, conf.CallerHeaders)
+}
+
+// Caller returns the caller metadata of r, which are the remote address and the configured headers.
+func (l *Log) Caller(r *http.Request) map[string]string {
+	m := make(map[string]string, len(l.headers)+1)
+	if host, _, err := net.SplitHostPort(r.RemoteAddr); err == nil {
+		m["remote_addr"] = host
+	} else if r.RemoteAddr != "" {
+		m["remote_addr"] = r.RemoteAddr
+	}
+	for _, h := range l.headers {
+		if v := r.Header.Get(h); v != "" {
+			m[h] = v
+		}
+	}
+	return m
+}
+
+// Record writes e as a line.
+func (l *Log) Record(e Event) error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	l.buf.Reset()
+	switch l.format {
+	case FormatLTSV:
+		l.writeLTSV(e)
+	default:
+		if err := json.NewEncoder(&l.buf).Encode(jsonEvent{
+			Time:      e.Time.Format(time.RFC3339Nano),
+			Provider:  e.Provider,
+			TokenHash: e.TokenHash,
+			ID:        e.ID,
+			Status:    e.Status,
+			Reason:    e.Reason,
+			Tries:     e.Tries,
+			Latency:   e.Latency.Seconds(),
+			Caller:    e.Caller,
+		}); err != nil {
+			return err
+		}
+	}
+	_, err := l.w.Write(l.buf.Bytes())
+	return err
+}
+
+func (l *Log) writeLTSV(e Event) {
+	l.field("time", e.Time.Format(time.RFC3339Nano))
+	l.field("provider", e.Provider)
+	l.field("token_hash", e.TokenHash)
+	l.field("id", e.ID)
+	l.field("status", strconv.Itoa(e.Status))
+	l.field("reason", e.Reason)
+	l.field("tries", strconv.Itoa(e.Tries))
+	l.field("latency", strconv.FormatFloat(e.Latency.Seconds(), 'f', -1, 64))
+	keys := make([]string, 0, len(e.Caller))
+	for k := range e.Caller {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	for _, k := range keys {
+		l.field("caller."+k, e.Caller[k])
+	}
+	l.buf.WriteByte('\n')
+}
+
+func (l *Log) field(label, value string) {
+	if l.buf.Len() > 0 {
+		l.buf.WriteByte('\t')
+	}
+	l.buf.WriteString(label)
+	l.buf.WriteByte(':')
+	switch {
+	case value == "":
+		l.buf.WriteByte('-')
+	case strings.ContainsAny(value, "\t\n\r\""):
+		l.buf.WriteString(strconv.Quote(value))
+	default:
+		l.buf.WriteString(value)
+	}
+}
+
+// Close closes the output unless it is the standard output.
+func (l *Log) Close() error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if c, ok := l.w.(io.Closer); ok && l.w != os.Stdout {
+		return c.Close()
+	}
+	return nil
+}
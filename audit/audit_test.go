@@ -0,0 +1,78 @@
+package audit
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+var testEvent = Event{
+	Time:      time.Date(2026, 10, 15, 12, 0, 0, 0, time.UTC),
+	Provider:  "apns",
+	TokenHash: HashToken("a1b2c3"),
+	ID:        "123e4567-e89b-12d3-a456-426655440000",
+	Status:    410,
+	Reason:    "Unregistered",
+	Tries:     2,
+	Latency:   150 * time.Millisecond,
+	Caller:    map[string]string{"remote_addr": "192.0.2.1", "X-Request-Id": "req\t1"},
+}
+
+func TestRecordJSON(t *testing.T) {
+	var b bytes.Buffer
+	l, err := New(&b, "", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := l.Record(testEvent); err != nil {
+		t.Fatal(err)
+	}
+	var got map[string]interface{}
+	if err := json.Unmarshal(b.Bytes(), &got); err != nil {
+		t.Fatal(err)
+	}
+	if got["time"] != "2026-10-15T12:00:00Z" || got["token_hash"] != testEvent.TokenHash || got["status"] != 410.0 ||
+		got["reason"] != "Unregistered" || got["tries"] != 2.0 || got["latency"] != 0.15 {
+		t.Errorf("unexpected record: %s", b.String())
+	}
+	if caller := got["caller"].(map[string]interface{}); caller["X-Request-Id"] != "req\t1" {
+		t.Errorf("unexpected caller: %v", caller)
+	}
+}
+
+func TestRecordLTSV(t *testing.T) {
+	var b bytes.Buffer
+	l, err := New(&b, FormatLTSV, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	e := testEvent
+	e.Reason = ""
+	if err := l.Record(e); err != nil {
+		t.Fatal(err)
+	}
+	want := "time:2026-10-15T12:00:00Z\tprovider:apns\ttoken_hash:" + e.TokenHash +
+		"\tid:123e4567-e89b-12d3-a456-426655440000\tstatus:410\treason:-\ttries:2\tlatency:0.15" +
+		"\tcaller.X-Request-Id:\"req\\t1\"\tcaller.remote_addr:192.0.2.1\n"
+	if b.String() != want {
+		t.Errorf("got %q want %q", b.String(), want)
+	}
+
+	if _, err := New(&b, "csv", nil); err == nil {
+		t.Error("unknown format must be an error")
+	}
+}
+
+func TestCaller(t *testing.T) {
+	l, _ := New(&bytes.Buffer{}, FormatJSON, []string{"x-request-id", "User-Agent"})
+	r := httptest.NewRequest("POST", "/push/apns", nil)
+	r.RemoteAddr = "192.0.2.1:12345"
+	r.Header.Set("X-Request-Id", "abc")
+
+	caller := l.Caller(r)
+	if len(caller) != 2 || caller["remote_addr"] != "192.0.2.1" || caller["X-Request-Id"] != "abc" {
+		t.Errorf("unexpected caller: %v", caller)
+	}
+}
@@ -0,0 +1,100 @@
+package audit_test
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	gunfish "github.com/kayac/Gunfish"
+	"github.com/kayac/Gunfish/apns"
+	"github.com/kayac/Gunfish/audit"
+	"github.com/kayac/Gunfish/config"
+	"github.com/kayac/Gunfish/fcm"
+	"github.com/kayac/Gunfish/gunfishtest"
+	"github.com/sirupsen/logrus"
+)
+
+type record struct {
+	Provider  string            `json:"provider"`
+	TokenHash string            `json:"token_hash"`
+	ID        string            `json:"id"`
+	Status    int               `json:"status"`
+	Tries     int               `json:"tries"`
+	Caller    map[string]string `json:"caller"`
+}
+
+func readRecords(path string) ([]record, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	var rs []record
+	s := bufio.NewScanner(f)
+	for s.Scan() {
+		var r record
+		if err := json.Unmarshal(s.Bytes(), &r); err != nil {
+			return nil, err
+		}
+		rs = append(rs, r)
+	}
+	return rs, s.Err()
+}
+
+func TestDeliveryEvents(t *testing.T) {
+	logrus.SetLevel(logrus.FatalLevel)
+	dir, err := ioutil.TempDir("", "audit")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "delivery.log")
+
+	s, err := gunfishtest.NewServer(gunfishtest.Options{
+		Config: func(c *config.Config) {
+			c.Audit = config.SectionAudit{Enabled: true, Output: path}
+		},
+		Timeout: time.Second * 10,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+
+	var ds []gunfish.PostedData
+	for i := 0; i < 3; i++ {
+		ds = append(ds, gunfish.PostedData{Token: fmt.Sprintf("apns-%02d", i), Payload: apns.Payload{APS: &apns.APS{Alert: "audit"}}})
+	}
+	if err := s.PushAPNs(ds...); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.PushFCM(fcm.Payload{RegistrationIDs: []string{"fcm-00", "fcm-01"}}); err != nil {
+		t.Fatal(err)
+	}
+
+	var rs []record
+	for deadline := time.Now().Add(time.Second * 5); len(rs) < 5 && time.Now().Before(deadline); {
+		time.Sleep(time.Millisecond * 10)
+		if rs, err = readRecords(path); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if len(rs) != 5 {
+		t.Fatalf("unexpected records: %v", rs)
+	}
+	hashes := map[string]string{}
+	for _, r := range rs {
+		if r.Status != 200 || r.ID == "" || r.Tries != 1 || r.Caller["remote_addr"] != "127.0.0.1" {
+			t.Errorf("unexpected record: %+v", r)
+		}
+		hashes[r.TokenHash] = r.Provider
+	}
+	if hashes[audit.HashToken("apns-02")] != apns.Provider || hashes[audit.HashToken("fcm-01")] != fcm.Provider {
+		t.Errorf("unexpected token hashes: %v", hashes)
+	}
+}
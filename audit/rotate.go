@@ -0,0 +1,164 @@
+package audit
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// backupTimeFormat is the suffix of rotated files, which sorts them in order of time.
+const backupTimeFormat = "20060102T150405.000"
+
+// Rotation is the policy of rotating a file. Zero values disable each limit.
+type Rotation struct {
+	MaxSize    int64         // bytes of a file which triggers rotation
+	Interval   time.Duration // period of rotation, aligned to multiples of the interval since the zero time in UTC
+	MaxBackups int           // number of rotated files to keep
+	MaxAge     time.Duration // age of rotated files to keep
+}
+
+// File is an append-only file rotated by size and time.
+// Rotated files are renamed to the path with a suffix of the time of rotation.
+type File struct {
+	path     string
+	rotation Rotation
+	now      func() time.Time
+
+	mu       sync.Mutex
+	f        *os.File
+	size     int64
+	rotateAt time.Time
+}
+
+// OpenFile opens the file at path to append, or creates it.
+func OpenFile(path string, r Rotation) (*File, error) {
+	f := &File{path: path, rotation: r, now: time.Now}
+	if err := f.open(); err != nil {
+		return nil, err
+	}
+	return f, nil
+}
+
+func (f *File) open() error {
+	fp, err := os.OpenFile(f.path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0644)
+	if err != nil {
+		return err
+	}
+	st, err := fp.Stat()
+	if err != nil {
+		fp.Close()
+		return err
+	}
+	f.f = fp
+	f.size = st.Size()
+	// an existing file is rotated at the end of the period when it was written
+	if f.rotation.Interval > 0 {
+		from := f.now()
+		if f.size > 0 {
+			from = st.ModTime()
+		}
+		f.rotateAt = from.Truncate(f.rotation.Interval).Add(f.rotation.Interval)
+	}
+	return nil
+}
+
+// Write appends p to the file, after rotating it when p exceeds the size or the period is over.
+func (f *File) Write(p []byte) (int, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if f.f == nil {
+		return 0, os.ErrClosed
+	}
+	now := f.now()
+	if f.size > 0 && (f.rotation.MaxSize > 0 && f.size+int64(len(p)) > f.rotation.MaxSize ||
+		f.rotation.Interval > 0 && !now.Before(f.rotateAt)) {
+		if err := f.rotate(now); err != nil {
+			return 0, err
+		}
+	}
+	n, err := f.f.Write(p)
+	f.size += int64(n)
+	return n, err
+}
+
+func (f *File) rotate(now time.Time) error {
+	if err := f.f.Close(); err != nil {
+		return err
+	}
+	f.f = nil
+	backup := f.path + "." + now.Format(backupTimeFormat)
+	for i := 1; ; i++ {
+		if _, err := os.Lstat(backup); os.IsNotExist(err) {
+			break
+		}
+		backup = fmt.Sprintf("%s.%s.%d", f.path, now.Format(backupTimeFormat), i)
+	}
+	if err := os.Rename(f.path, backup); err != nil {
+		return err
+	}
+	if err := f.open(); err != nil {
+		return err
+	}
+	return f.removeBackups(now)
+}
+
+// Backups returns the rotated files from the oldest.
+func (f *File) Backups() ([]string, error) {
+	names, err := filepath.Glob(f.path + ".*")
+	if err != nil {
+		return nil, err
+	}
+	backups := names[:0]
+	for _, name := range names {
+		suffix := strings.TrimPrefix(name, f.path+".")
+		if len(suffix) < len(backupTimeFormat) {
+			continue
+		}
+		if _, err := time.Parse(backupTimeFormat, suffix[:len(backupTimeFormat)]); err == nil {
+			backups = append(backups, name)
+		}
+	}
+	sort.Strings(backups)
+	return backups, nil
+}
+
+func (f *File) removeBackups(now time.Time) error {
+	if f.rotation.MaxBackups <= 0 && f.rotation.MaxAge <= 0 {
+		return nil
+	}
+	backups, err := f.Backups()
+	if err != nil {
+		return err
+	}
+	for i, name := range backups {
+		expired := f.rotation.MaxBackups > 0 && len(backups)-i > f.rotation.MaxBackups
+		if !expired && f.rotation.MaxAge > 0 {
+			if st, err := os.Stat(name); err == nil && now.Sub(st.ModTime()) > f.rotation.MaxAge {
+				expired = true
+			}
+		}
+		if expired {
+			if err := os.Remove(name); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// Close closes the file.
+func (f *File) Close() error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.f == nil {
+		return nil
+	}
+	err := f.f.Close()
+	f.f = nil
+	return err
+}
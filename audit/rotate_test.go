@@ -0,0 +1,93 @@
+package audit
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestFileRotation(t *testing.T) {
+	dir, err := ioutil.TempDir("", "audit")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	now := time.Date(2026, 10, 15, 12, 0, 0, 0, time.UTC)
+	path := filepath.Join(dir, "delivery.log")
+	f, err := OpenFile(path, Rotation{MaxSize: 10, Interval: time.Hour, MaxBackups: 2})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	f.now = func() time.Time { return now }
+	f.rotateAt = now.Add(time.Hour)
+
+	// rotated by size
+	for _, s := range []string{"aaaa\n", "bbbb\n", "cccc\n"} {
+		if _, err := f.Write([]byte(s)); err != nil {
+			t.Fatal(err)
+		}
+		now = now.Add(time.Second)
+	}
+	backups, err := f.Backups()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(backups) != 1 || filepath.Base(backups[0]) != "delivery.log.20261015T120002.000" {
+		t.Fatalf("unexpected backups: %v", backups)
+	}
+	if b, _ := ioutil.ReadFile(backups[0]); string(b) != "aaaa\nbbbb\n" {
+		t.Errorf("unexpected backup: %q", b)
+	}
+
+	// rotated by time, and the oldest backup is removed
+	for _, s := range []string{"dddd\n", "eeee\n"} {
+		now = now.Add(time.Hour)
+		if _, err := f.Write([]byte(s)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	backups, _ = f.Backups()
+	if len(backups) != 2 {
+		t.Fatalf("unexpected backups: %v", backups)
+	}
+	if b, _ := ioutil.ReadFile(backups[1]); string(b) != "dddd\n" {
+		t.Errorf("unexpected backup: %q", b)
+	}
+	if b, _ := ioutil.ReadFile(path); string(b) != "eeee\n" {
+		t.Errorf("unexpected current file: %q", b)
+	}
+}
+
+func TestFileMaxAge(t *testing.T) {
+	dir, err := ioutil.TempDir("", "audit")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	path := filepath.Join(dir, "delivery.log")
+	old := path + ".20260101T000000.000"
+	if err := ioutil.WriteFile(old, []byte("old\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	f, err := OpenFile(path, Rotation{MaxSize: 1, MaxAge: time.Hour})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	f.now = func() time.Time { return time.Now().Add(2 * time.Hour) }
+
+	f.Write([]byte("a\n"))
+	f.Write([]byte("b\n"))
+	if _, err := os.Stat(old); !os.IsNotExist(err) {
+		t.Errorf("expired backup is not removed: %v", err)
+	}
+	backups, _ := f.Backups()
+	if len(backups) != 0 {
+		t.Errorf("unexpected backups: %v", backups)
+	}
+}
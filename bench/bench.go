@@ -0,0 +1,442 @@
+// Package bench runs Gunfish against local mock servers and reports its performance.
+package bench
+
+import (
+	"bytes"
+	"crypto/tls"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"text/tabwriter"
+	"time"
+
+	gunfish "github.com/kayac/Gunfish"
+	"github.com/kayac/Gunfish/apns"
+	"github.com/kayac/Gunfish/config"
+	"github.com/kayac/Gunfish/mock"
+	"golang.org/x/net/http2"
+)
+
+// Providers
+const (
+	APNs = "apns"
+	FCM  = "fcm"
+)
+
+// timestampKey is the key of payload which holds the time of posting to Gunfish.
+const timestampKey = "bench_ts"
+
+// Options are options of a benchmark.
+type Options struct {
+	Provider       string
+	Notifications  int // total number of notifications
+	BatchSize      int // notifications per request to Gunfish
+	Concurrency    int // concurrent requests to Gunfish
+	WorkerNum      int
+	QueueSize      int
+	Latency        mock.Latency // response time of the mock server
+	ErrorRate      float64      // error rate of the mock server
+	Timeout        time.Duration
+	SampleInterval time.Duration // interval to sample queue sizes
+}
+
+// DefaultOptions returns default options of a benchmark.
+func DefaultOptions() Options {
+	return Options{
+		Provider:       APNs,
+		Notifications:  10000,
+		BatchSize:      100,
+		Concurrency:    4,
+		WorkerNum:      config.DefaultWorkerNum,
+		QueueSize:      config.DefaultQueueSize,
+		Latency:        mock.DefaultLatency,
+		Timeout:        time.Minute * 5,
+		SampleInterval: time.Millisecond * 100,
+	}
+}
+
+// Percentiles of latencies
+type Percentiles struct {
+	P50 time.Duration
+	P90 time.Duration
+	P99 time.Duration
+	Max time.Duration
+}
+
+// Report is the result of a benchmark.
+type Report struct {
+	Options         Options
+	Posted          int64 // notifications accepted by Gunfish
+	Rejected        int64 // requests rejected by Gunfish with 503
+	Delivered       int64 // notifications received by the mock server
+	Elapsed         time.Duration
+	Throughput      float64 // delivered notifications per second
+	PostLatency     Percentiles
+	DeliveryLatency Percentiles // from posting to Gunfish to receiving by the mock server
+	MaxQueueSize    int64
+	MaxWorkersQueue int64
+	MaxRetryQueue   int64
+	MaxCommandQueue int64
+	Stats           gunfish.Stats
+}
+
+// WriteTo writes the report as a text table.
+func (r *Report) WriteTo(w io.Writer) (int64, error) {
+	b := &bytes.Buffer{}
+	tw := tabwriter.NewWriter(b, 0, 8, 2, ' ', 0)
+	fmt.Fprintf(tw, "provider\t%s\n", r.Options.Provider)
+	fmt.Fprintf(tw, "notifications\t%d\n", r.Options.Notifications)
+	fmt.Fprintf(tw, "posted\t%d\n", r.Posted)
+	fmt.Fprintf(tw, "rejected requests (503)\t%d\n", r.Rejected)
+	fmt.Fprintf(tw, "delivered\t%d\n", r.Delivered)
+	fmt.Fprintf(tw, "sent_count\t%d\n", r.Stats.SentCount)
+	fmt.Fprintf(tw, "err_count\t%d\n", r.Stats.ErrCount)
+	fmt.Fprintf(tw, "retry_count\t%d\n", r.Stats.RetryCount)
+	fmt.Fprintf(tw, "elapsed\t%s\n", r.Elapsed)
+	fmt.Fprintf(tw, "throughput\t%.1f/s\n", r.Throughput)
+	fmt.Fprintf(tw, "post latency\tp50:%s p90:%s p99:%s max:%s\n", r.PostLatency.P50, r.PostLatency.P90, r.PostLatency.P99, r.PostLatency.Max)
+	fmt.Fprintf(tw, "delivery latency\tp50:%s p90:%s p99:%s max:%s\n", r.DeliveryLatency.P50, r.DeliveryLatency.P90, r.DeliveryLatency.P99, r.DeliveryLatency.Max)
+	fmt.Fprintf(tw, "max queue_size\t%d\n", r.MaxQueueSize)
+	fmt.Fprintf(tw, "max workers_queue_size\t%d\n", r.MaxWorkersQueue)
+	fmt.Fprintf(tw, "max retry_queue_size\t%d\n", r.MaxRetryQueue)
+	fmt.Fprintf(tw, "max cmdq_queue_size\t%d\n", r.MaxCommandQueue)
+	tw.Flush()
+	return b.WriteTo(w)
+}
+
+// latencies collects durations concurrently.
+type latencies struct {
+	mu sync.Mutex
+	ds []time.Duration
+}
+
+func (l *latencies) add(d time.Duration) {
+	l.mu.Lock()
+	l.ds = append(l.ds, d)
+	l.mu.Unlock()
+}
+
+func (l *latencies) percentiles() Percentiles {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if len(l.ds) == 0 {
+		return Percentiles{}
+	}
+	sort.Slice(l.ds, func(i, j int) bool { return l.ds[i] < l.ds[j] })
+	at := func(p float64) time.Duration {
+		return l.ds[int(float64(len(l.ds)-1)*p)]
+	}
+	return Percentiles{
+		P50: at(0.50),
+		P90: at(0.90),
+		P99: at(0.99),
+		Max: l.ds[len(l.ds)-1],
+	}
+}
+
+type benchmark struct {
+	opt       Options
+	gunfish   string // URL of Gunfish
+	delivered int64
+	lastAt    atomic.Value // time.Time of the last delivery
+	posted    int64
+	rejected  int64
+	post      latencies
+	delivery  latencies
+}
+
+// Run runs a benchmark with options.
+// It uses the global states of gunfish package, so benchmarks must not run in parallel.
+func Run(opt Options) (*Report, error) {
+	if opt.Provider != APNs && opt.Provider != FCM {
+		return nil, fmt.Errorf("unsupported provider: %s", opt.Provider)
+	}
+	if opt.BatchSize < 1 || opt.BatchSize > config.MaxRequestSize {
+		return nil, fmt.Errorf("batch size was out of available range: %d. (1-%d)", opt.BatchSize, config.MaxRequestSize)
+	}
+	if opt.Concurrency < 1 {
+		opt.Concurrency = 1
+	}
+
+	b := &benchmark{opt: opt}
+
+	dir, err := ioutil.TempDir("", "gunfish-bench")
+	if err != nil {
+		return nil, err
+	}
+	defer os.RemoveAll(dir)
+	certFile, keyFile, err := mock.WriteCertificate(dir)
+	if err != nil {
+		return nil, err
+	}
+
+	mopt := mock.Options{Latency: opt.Latency, ErrorRate: opt.ErrorRate}
+	apnsServer := httptest.NewUnstartedServer(b.recorder(mock.NewAPNsMockServer(mopt)))
+	if err := http2.ConfigureServer(apnsServer.Config, nil); err != nil {
+		return nil, err
+	}
+	apnsServer.TLS = apnsServer.Config.TLSConfig
+	apnsServer.StartTLS()
+	defer apnsServer.Close()
+	fcmServer := httptest.NewServer(b.recorder(mock.FCMMockServer(mopt)))
+	defer fcmServer.Close()
+
+	conf := config.Config{
+		Provider: config.SectionProvider{
+			WorkerNum:        opt.WorkerNum,
+			QueueSize:        opt.QueueSize,
+			RequestQueueSize: config.MaxRequestSize,
+		},
+		Apns: config.SectionApns{
+			Host:     apnsServer.URL,
+			CertFile: certFile,
+			KeyFile:  keyFile,
+			Enabled:  true,
+		},
+		FCM: config.SectionFCM{
+			APIKey:   "bench",
+			Endpoint: fcmServer.URL + "/fcm/send",
+			Enabled:  true,
+		},
+	}
+
+	// The mock server uses a self-signed certificate.
+	orig := apns.ClientTransport
+	apns.ClientTransport = func(cert tls.Certificate) *http.Transport {
+		tr := orig(cert)
+		tr.TLSClientConfig.InsecureSkipVerify = true
+		return tr
+	}
+	defer func() { apns.ClientTransport = orig }()
+
+	gunfish.InitSuccessResponseHandler(gunfish.DefaultResponseHandler{})
+	gunfish.InitErrorResponseHandler(gunfish.DefaultResponseHandler{})
+	sup, err := gunfish.StartSupervisor(&conf)
+	if err != nil {
+		return nil, err
+	}
+	prov := &gunfish.Provider{Sup: sup}
+	gs := httptest.NewServer(prov.ServeMux(conf))
+	defer gs.Close()
+	b.gunfish = gs.URL
+
+	before, err := b.stats()
+	if err != nil {
+		sup.Shutdown()
+		return nil, err
+	}
+
+	report := &Report{Options: opt}
+	start := time.Now()
+	b.lastAt.Store(start)
+
+	done := make(chan struct{})
+	sampled := make(chan struct{})
+	go func() {
+		defer close(sampled)
+		b.sample(report, done)
+	}()
+
+	b.load()
+	err = b.wait(start)
+	close(done)
+	<-sampled
+	sup.Shutdown()
+
+	after, serr := b.stats()
+	if serr != nil && err == nil {
+		err = serr
+	}
+	report.Stats = after
+	report.Stats.SentCount -= before.SentCount
+	report.Stats.ErrCount -= before.ErrCount
+	report.Stats.RetryCount -= before.RetryCount
+
+	report.Posted = atomic.LoadInt64(&b.posted)
+	report.Rejected = atomic.LoadInt64(&b.rejected)
+	report.Delivered = atomic.LoadInt64(&b.delivered)
+	report.Elapsed = b.lastAt.Load().(time.Time).Sub(start)
+	if report.Elapsed > 0 {
+		report.Throughput = float64(report.Delivered) / report.Elapsed.Seconds()
+	}
+	report.PostLatency = b.post.percentiles()
+	report.DeliveryLatency = b.delivery.percentiles()
+
+	return report, err
+}
+
+// recorder records deliveries to the mock server.
+func (b *benchmark) recorder(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		now := time.Now()
+		body, err := ioutil.ReadAll(r.Body)
+		if err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		r.Body = ioutil.NopCloser(bytes.NewReader(body))
+
+		var p struct {
+			BenchTS         int64    `json:"bench_ts"`
+			RegistrationIDs []string `json:"registration_ids"`
+			Data            struct {
+				BenchTS int64 `json:"bench_ts"`
+			} `json:"data"`
+		}
+		if err := json.Unmarshal(body, &p); err == nil {
+			n := int64(1)
+			ts := p.BenchTS
+			if p.RegistrationIDs != nil {
+				n = int64(len(p.RegistrationIDs))
+				ts = p.Data.BenchTS
+			}
+			if ts > 0 {
+				b.delivery.add(now.Sub(time.Unix(0, ts)))
+			}
+			atomic.AddInt64(&b.delivered, n)
+			b.lastAt.Store(now)
+		}
+
+		next.ServeHTTP(w, r)
+	})
+}
+
+// load posts notifications to Gunfish concurrently.
+func (b *benchmark) load() {
+	batches := make(chan int, b.opt.Concurrency)
+	var wg sync.WaitGroup
+	for i := 0; i < b.opt.Concurrency; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for n := range batches {
+				b.postBatch(n)
+			}
+		}()
+	}
+
+	for rest := b.opt.Notifications; rest > 0; rest -= b.opt.BatchSize {
+		n := b.opt.BatchSize
+		if rest < n {
+			n = rest
+		}
+		batches <- n
+	}
+	close(batches)
+	wg.Wait()
+}
+
+func (b *benchmark) postBatch(n int) {
+	for {
+		start := time.Now()
+		path, body := b.requestBody(n, start)
+		resp, err := http.Post(b.gunfish+path, gunfish.ApplicationJSON, bytes.NewReader(body))
+		if err != nil {
+			return
+		}
+		io.Copy(ioutil.Discard, resp.Body)
+		resp.Body.Close()
+		b.post.add(time.Now().Sub(start))
+
+		if resp.StatusCode == http.StatusServiceUnavailable {
+			// Gunfish's queue is full. Retries after a while not to wait Retry-After seconds.
+			atomic.AddInt64(&b.rejected, 1)
+			time.Sleep(time.Millisecond * 100)
+			continue
+		}
+		if resp.StatusCode == http.StatusOK {
+			atomic.AddInt64(&b.posted, int64(n))
+		}
+		return
+	}
+}
+
+func (b *benchmark) requestBody(n int, at time.Time) (string, []byte) {
+	ts := at.UnixNano()
+	switch b.opt.Provider {
+	case FCM:
+		ids := make([]string, n)
+		for i := range ids {
+			ids[i] = fmt.Sprintf("registration-id-%d", i)
+		}
+		body, _ := json.Marshal(map[string]interface{}{
+			"registration_ids": ids,
+			"data":             map[string]interface{}{timestampKey: ts},
+		})
+		return "/push/fcm", body
+	default:
+		ps := make([]map[string]interface{}, n)
+		for i := range ps {
+			ps[i] = map[string]interface{}{
+				"token": fmt.Sprintf("%064x", i),
+				"payload": map[string]interface{}{
+					"aps":        map[string]interface{}{"alert": "benchmark", "sound": "default"},
+					timestampKey: ts,
+				},
+			}
+		}
+		body, _ := json.Marshal(ps)
+		return "/push/apns", body
+	}
+}
+
+// wait waits until the mock server receives all posted notifications.
+func (b *benchmark) wait(start time.Time) error {
+	deadline := start.Add(b.opt.Timeout)
+	for atomic.LoadInt64(&b.delivered) < atomic.LoadInt64(&b.posted) {
+		if time.Now().After(deadline) {
+			return fmt.Errorf("timed out: delivered %d of %d notifications", atomic.LoadInt64(&b.delivered), atomic.LoadInt64(&b.posted))
+		}
+		time.Sleep(time.Millisecond * 10)
+	}
+	return nil
+}
+
+// sample samples queue sizes of Gunfish until done is closed.
+func (b *benchmark) sample(r *Report, done <-chan struct{}) {
+	interval := b.opt.SampleInterval
+	if interval <= 0 {
+		interval = time.Millisecond * 100
+	}
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	max := func(m *int64, v int64) {
+		if v > *m {
+			*m = v
+		}
+	}
+	for {
+		select {
+		case <-ticker.C:
+			st, err := b.stats()
+			if err != nil {
+				continue
+			}
+			max(&r.MaxQueueSize, st.QueueSize)
+			max(&r.MaxWorkersQueue, st.WorkersQueueSize)
+			max(&r.MaxRetryQueue, st.RetryQueueSize)
+			max(&r.MaxCommandQueue, st.CommandQueueSize)
+		case <-done:
+			return
+		}
+	}
+}
+
+func (b *benchmark) stats() (gunfish.Stats, error) {
+	var st gunfish.Stats
+	resp, err := http.Get(b.gunfish + "/stats/app")
+	if err != nil {
+		return st, err
+	}
+	defer resp.Body.Close()
+	err = json.NewDecoder(resp.Body).Decode(&st)
+	return st, err
+}
@@ -0,0 +1,78 @@
+package bench_test
+
+import (
+	"os"
+	"testing"
+	"time"
+
+	"github.com/kayac/Gunfish/bench"
+	"github.com/kayac/Gunfish/mock"
+	"github.com/sirupsen/logrus"
+)
+
+func TestMain(m *testing.M) {
+	logrus.SetLevel(logrus.WarnLevel)
+	os.Exit(m.Run())
+}
+
+func testOptions(provider string, n int) bench.Options {
+	opt := bench.DefaultOptions()
+	opt.Provider = provider
+	opt.Notifications = n
+	opt.Latency = mock.Latency{Mean: time.Millisecond, Distribution: mock.Fixed}
+	opt.Timeout = time.Second * 30
+	return opt
+}
+
+func TestRun(t *testing.T) {
+	for _, provider := range []string{bench.APNs, bench.FCM} {
+		report, err := bench.Run(testOptions(provider, 500))
+		if err != nil {
+			t.Fatalf("%s: %s", provider, err)
+		}
+		if report.Posted != 500 {
+			t.Errorf("%s: unexpected posted: %d", provider, report.Posted)
+		}
+		if report.Delivered < report.Posted {
+			t.Errorf("%s: delivered %d of %d notifications", provider, report.Delivered, report.Posted)
+		}
+		if report.Throughput <= 0 {
+			t.Errorf("%s: unexpected throughput: %f", provider, report.Throughput)
+		}
+		if report.DeliveryLatency.Max < report.DeliveryLatency.P50 {
+			t.Errorf("%s: unexpected delivery latency: %#v", provider, report.DeliveryLatency)
+		}
+	}
+}
+
+func TestRunInvalidOptions(t *testing.T) {
+	opt := testOptions("unknown", 1)
+	if _, err := bench.Run(opt); err == nil {
+		t.Error("expected error for unknown provider")
+	}
+
+	opt = testOptions(bench.APNs, 1)
+	opt.BatchSize = 0
+	if _, err := bench.Run(opt); err == nil {
+		t.Error("expected error for invalid batch size")
+	}
+}
+
+func benchmarkRun(b *testing.B, provider string) {
+	opt := testOptions(provider, b.N)
+	b.ResetTimer()
+	report, err := bench.Run(opt)
+	if err != nil {
+		b.Fatal(err)
+	}
+	b.ReportMetric(report.Throughput, "notifications/s")
+	b.ReportMetric(float64(report.DeliveryLatency.P99.Microseconds()), "p99-us")
+}
+
+func BenchmarkAPNs(b *testing.B) {
+	benchmarkRun(b, bench.APNs)
+}
+
+func BenchmarkFCM(b *testing.B) {
+	benchmarkRun(b, bench.FCM)
+}
@@ -0,0 +1,203 @@
+// Package chaos injects faults into provider clients and hooks of Gunfish for resilience testing.
+// It is enabled by the [chaos] section of the configuration, and must not be enabled in production.
+package chaos
+
+import (
+	"context"
+	"io"
+	"io/ioutil"
+	"math/rand"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/kayac/Gunfish/config"
+)
+
+// Fault is a kind of injected faults.
+type Fault int
+
+// Faults
+const (
+	Latency     Fault = iota + 1 // delays a request
+	Error                        // fails a request without sending it
+	Timeout                      // fails a request without sending it after Timeout
+	Drop                         // sends a request and fails it discarding the response
+	HookLatency                  // delays a hook command
+	HookError                    // fails a hook command without running it
+)
+
+func (f Fault) String() string {
+	switch f {
+	case Latency:
+		return "latency"
+	case Error:
+		return "error"
+	case Timeout:
+		return "timeout"
+	case Drop:
+		return "drop"
+	case HookLatency:
+		return "hook_latency"
+	case HookError:
+		return "hook_error"
+	}
+	return "unknown"
+}
+
+// InjectedError is an error returned by injected faults.
+type InjectedError struct {
+	Fault Fault
+}
+
+func (e *InjectedError) Error() string {
+	return "chaos: injected " + e.Fault.String()
+}
+
+// Timeout reports whether the error is a timeout, as net.Error.
+func (e *InjectedError) Timeout() bool {
+	return e.Fault == Timeout
+}
+
+// Temporary reports whether the error is temporary, as net.Error.
+func (e *InjectedError) Temporary() bool {
+	return true
+}
+
+// HookRunner runs a hook command with src as its STDIN, like gunfish.InvokePipe.
+type HookRunner func(hook string, src io.Reader) ([]byte, error)
+
+// Injector injects faults at the configured rates.
+type Injector struct {
+	conf config.SectionChaos
+
+	mu      sync.Mutex
+	rand    *rand.Rand
+	counts  map[Fault]int64
+	onFault func(Fault, *http.Request)
+}
+
+// NewInjector creates Injector. The current time is used as the seed when conf.Seed is 0.
+func NewInjector(conf config.SectionChaos) *Injector {
+	seed := conf.Seed
+	if seed == 0 {
+		seed = time.Now().UnixNano()
+	}
+	return &Injector{
+		conf:   conf,
+		rand:   rand.New(rand.NewSource(seed)),
+		counts: make(map[Fault]int64),
+	}
+}
+
+// OnFault sets f to be called whenever a fault is injected.
+// The request is nil for hook faults. For Drop, its body has been consumed already.
+func (inj *Injector) OnFault(f func(Fault, *http.Request)) {
+	inj.mu.Lock()
+	defer inj.mu.Unlock()
+	inj.onFault = f
+}
+
+// Counts returns the number of injected faults.
+func (inj *Injector) Counts() map[Fault]int64 {
+	inj.mu.Lock()
+	defer inj.mu.Unlock()
+	counts := make(map[Fault]int64, len(inj.counts))
+	for f, n := range inj.counts {
+		counts[f] = n
+	}
+	return counts
+}
+
+// hit reports whether a fault of the rate happens.
+func (inj *Injector) hit(rate float64) bool {
+	if rate <= 0 {
+		return false
+	}
+	inj.mu.Lock()
+	defer inj.mu.Unlock()
+	return inj.rand.Float64() < rate
+}
+
+func (inj *Injector) inject(f Fault, req *http.Request) {
+	inj.mu.Lock()
+	inj.counts[f]++
+	onFault := inj.onFault
+	inj.mu.Unlock()
+	if onFault != nil {
+		onFault(f, req)
+	}
+}
+
+// Transport wraps base to inject faults into requests. http.DefaultTransport is used when base is nil.
+func (inj *Injector) Transport(base http.RoundTripper) http.RoundTripper {
+	if base == nil {
+		base = http.DefaultTransport
+	}
+	return &transport{inj: inj, base: base}
+}
+
+type transport struct {
+	inj  *Injector
+	base http.RoundTripper
+}
+
+func (t *transport) RoundTrip(req *http.Request) (*http.Response, error) {
+	inj, conf := t.inj, t.inj.conf
+	if inj.hit(conf.LatencyRate) {
+		inj.inject(Latency, req)
+		if err := sleep(req.Context(), conf.Latency.Duration); err != nil {
+			return nil, err
+		}
+	}
+	if inj.hit(conf.ErrorRate) {
+		inj.inject(Error, req)
+		return nil, &InjectedError{Fault: Error}
+	}
+	if inj.hit(conf.TimeoutRate) {
+		inj.inject(Timeout, req)
+		if err := sleep(req.Context(), conf.Timeout.Duration); err != nil {
+			return nil, err
+		}
+		return nil, &InjectedError{Fault: Timeout}
+	}
+
+	resp, err := t.base.RoundTrip(req)
+	if err != nil {
+		return nil, err
+	}
+	if inj.hit(conf.DropRate) {
+		io.Copy(ioutil.Discard, resp.Body)
+		resp.Body.Close()
+		inj.inject(Drop, req)
+		return nil, &InjectedError{Fault: Drop}
+	}
+	return resp, nil
+}
+
+// Hook wraps run to inject faults into hook commands.
+func (inj *Injector) Hook(run HookRunner) HookRunner {
+	conf := inj.conf
+	return func(hook string, src io.Reader) ([]byte, error) {
+		if inj.hit(conf.HookLatencyRate) {
+			inj.inject(HookLatency, nil)
+			time.Sleep(conf.HookLatency.Duration)
+		}
+		if inj.hit(conf.HookErrorRate) {
+			inj.inject(HookError, nil)
+			return nil, &InjectedError{Fault: HookError}
+		}
+		return run(hook, src)
+	}
+}
+
+func sleep(ctx context.Context, d time.Duration) error {
+	t := time.NewTimer(d)
+	defer t.Stop()
+	select {
+	case <-t.C:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
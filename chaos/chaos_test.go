@@ -0,0 +1,106 @@
+package chaos_test
+
+import (
+	"bytes"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/kayac/Gunfish/chaos"
+	"github.com/kayac/Gunfish/config"
+)
+
+func TestTransport(t *testing.T) {
+	var received int64
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt64(&received, 1)
+	}))
+	defer ts.Close()
+
+	testCases := []struct {
+		conf     config.SectionChaos
+		fault    chaos.Fault
+		received int64
+		timeout  bool
+	}{
+		{config.SectionChaos{}, 0, 1, false},
+		{config.SectionChaos{LatencyRate: 1, Latency: config.Duration{Duration: time.Millisecond * 50}}, chaos.Latency, 1, false},
+		{config.SectionChaos{ErrorRate: 1}, chaos.Error, 0, false},
+		{config.SectionChaos{TimeoutRate: 1, Timeout: config.Duration{Duration: time.Millisecond * 50}}, chaos.Timeout, 0, true},
+		{config.SectionChaos{DropRate: 1}, chaos.Drop, 1, false},
+	}
+	for _, c := range testCases {
+		atomic.StoreInt64(&received, 0)
+		inj := chaos.NewInjector(c.conf)
+		var faults []chaos.Fault
+		inj.OnFault(func(f chaos.Fault, _ *http.Request) { faults = append(faults, f) })
+		client := &http.Client{Transport: inj.Transport(nil)}
+
+		start := time.Now()
+		resp, err := client.Get(ts.URL)
+		elapsed := time.Since(start)
+		if err == nil {
+			resp.Body.Close()
+		}
+
+		if n := atomic.LoadInt64(&received); n != c.received {
+			t.Errorf("%s: unexpected received count: %d want %d", c.fault, n, c.received)
+		}
+		switch c.fault {
+		case 0:
+			if err != nil || len(faults) != 0 {
+				t.Errorf("unexpected faults: %v %s", faults, err)
+			}
+			continue
+		case chaos.Latency:
+			if err != nil || elapsed < c.conf.Latency.Duration {
+				t.Errorf("%s: unexpected result in %s: %s", c.fault, elapsed, err)
+			}
+		default:
+			if err == nil {
+				t.Errorf("%s: must be failed", c.fault)
+			} else if e, ok := err.(interface{ Timeout() bool }); !ok || e.Timeout() != c.timeout {
+				t.Errorf("%s: unexpected error: %s", c.fault, err)
+			}
+		}
+		if len(faults) != 1 || faults[0] != c.fault || inj.Counts()[c.fault] != 1 {
+			t.Errorf("%s: unexpected faults: %v %v", c.fault, faults, inj.Counts())
+		}
+	}
+}
+
+func TestTransportTimeoutByClient(t *testing.T) {
+	inj := chaos.NewInjector(config.SectionChaos{TimeoutRate: 1, Timeout: config.Duration{Duration: time.Minute}})
+	client := &http.Client{Transport: inj.Transport(nil), Timeout: time.Millisecond * 50}
+	start := time.Now()
+	if _, err := client.Get("http://127.0.0.1:1/"); err == nil {
+		t.Error("must be timed out")
+	}
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Errorf("not canceled by the client timeout: %s", elapsed)
+	}
+}
+
+func TestHook(t *testing.T) {
+	var ran int
+	run := func(hook string, src io.Reader) ([]byte, error) {
+		ran++
+		return []byte(hook), nil
+	}
+
+	inj := chaos.NewInjector(config.SectionChaos{})
+	if out, err := inj.Hook(run)("cat", &bytes.Buffer{}); err != nil || string(out) != "cat" || ran != 1 {
+		t.Errorf("unexpected result: %s %s", out, err)
+	}
+
+	inj = chaos.NewInjector(config.SectionChaos{HookErrorRate: 1})
+	if _, err := inj.Hook(run)("cat", &bytes.Buffer{}); err == nil || ran != 1 {
+		t.Errorf("hook must be failed without running: %s", err)
+	}
+	if n := inj.Counts()[chaos.HookError]; n != 1 {
+		t.Errorf("unexpected count: %d", n)
+	}
+}
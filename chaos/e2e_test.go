@@ -0,0 +1,175 @@
+package chaos_test
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"path"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	gunfish "github.com/kayac/Gunfish"
+	"github.com/kayac/Gunfish/apns"
+	"github.com/kayac/Gunfish/chaos"
+	"github.com/kayac/Gunfish/config"
+	"github.com/kayac/Gunfish/fcm"
+	"github.com/kayac/Gunfish/gunfishtest"
+	"github.com/kayac/Gunfish/mock"
+	"github.com/sirupsen/logrus"
+)
+
+// dropRecorder records tokens of requests whose responses are dropped.
+// Gunfish cannot know whether a request with a dropped response was delivered,
+// so it resends the request and the provider receives it once more.
+type dropRecorder struct {
+	mu     sync.Mutex
+	tokens map[string]int
+}
+
+func (d *dropRecorder) onFault(f chaos.Fault, req *http.Request) {
+	if f != chaos.Drop {
+		return
+	}
+	var tokens []string
+	if strings.HasPrefix(req.URL.Path, "/3/device/") {
+		tokens = []string{path.Base(req.URL.Path)}
+	} else if req.GetBody != nil {
+		body, _ := req.GetBody()
+		var p fcm.Payload
+		json.NewDecoder(body).Decode(&p)
+		tokens = p.RegistrationIDs
+	}
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	for _, token := range tokens {
+		d.tokens[token]++
+	}
+}
+
+func (d *dropRecorder) count(token string) int {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	return d.tokens[token]
+}
+
+func TestNoNotificationIsLostOrSentTwice(t *testing.T) {
+	if testing.Short() {
+		t.Skip("skipping chaos test in short mode")
+	}
+	logrus.SetLevel(logrus.FatalLevel)
+
+	s, err := gunfishtest.NewServer(gunfishtest.Options{
+		APNs: mock.Options{
+			Scenario: mock.NewScenario(mock.Rule{
+				Match:  mock.Match{Token: "bad-*"},
+				Status: http.StatusBadRequest,
+				Reason: apns.BadDeviceToken.String(),
+			}),
+		},
+		Config: func(c *config.Config) {
+			c.Chaos = config.SectionChaos{
+				Enabled:         true,
+				Seed:            1,
+				Latency:         config.Duration{Duration: time.Millisecond * 20},
+				LatencyRate:     0.2,
+				ErrorRate:       0.1,
+				Timeout:         config.Duration{Duration: time.Millisecond * 50},
+				TimeoutRate:     0.05,
+				DropRate:        0.1,
+				HookLatency:     config.Duration{Duration: time.Millisecond * 10},
+				HookLatencyRate: 0.2,
+				HookErrorRate:   0.2,
+			}
+		},
+		Timeout: time.Second * 30,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+	drops := &dropRecorder{tokens: map[string]int{}}
+	s.Chaos().OnFault(drops.onFault)
+
+	const numAPNs, numBad, numFCM = 100, 20, 20
+	var apnsTokens, fcmTokens []string
+	var ds []gunfish.PostedData
+	for i := 0; i < numAPNs+numBad; i++ {
+		token := fmt.Sprintf("apns-%03d", i)
+		if i >= numAPNs {
+			token = fmt.Sprintf("bad-%03d", i)
+		}
+		apnsTokens = append(apnsTokens, token)
+		ds = append(ds, gunfish.PostedData{Token: token, Payload: apns.Payload{APS: &apns.APS{Alert: "chaos"}}})
+		if len(ds) == 10 {
+			if err := s.PushAPNs(ds...); err != nil {
+				t.Fatal(err)
+			}
+			ds = nil
+		}
+	}
+	for i := 0; i < numFCM; i++ {
+		token := fmt.Sprintf("fcm-%03d", i)
+		fcmTokens = append(fcmTokens, token)
+		if err := s.PushFCM(fcm.Payload{RegistrationIDs: []string{token}}); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if _, err := s.WaitResults(numAPNs + numBad); err != nil {
+		t.Fatal(err)
+	}
+	wantFCM := 0
+	for _, token := range fcmTokens {
+		wantFCM += 1 + drops.count(token)
+	}
+	if _, err := s.WaitFCMRequests(wantFCM); err != nil {
+		t.Fatal(err)
+	}
+	// waits for hooks of all errors, which are invoked or failed by chaos
+	var hooks [][]byte
+	for deadline := time.Now().Add(time.Second * 10); ; time.Sleep(time.Millisecond * 10) {
+		if hooks, err = s.HookInvocations(); err != nil {
+			t.Fatal(err)
+		}
+		if int64(len(hooks))+s.Chaos().Counts()[chaos.HookError] >= numBad || time.Now().After(deadline) {
+			break
+		}
+	}
+	// waits for extra results and requests which must not come
+	time.Sleep(gunfish.RetryWaitTime * 2)
+
+	counts := s.Chaos().Counts()
+	t.Logf("injected faults: %v", counts)
+	for _, f := range []chaos.Fault{chaos.Latency, chaos.Error, chaos.Timeout, chaos.Drop} {
+		if counts[f] == 0 {
+			t.Errorf("%s was not injected", f)
+		}
+	}
+
+	results := map[string]int{}
+	for _, r := range s.Results() {
+		results[r.RecipientIdentifier()]++
+	}
+	delivered := map[string]int{}
+	for _, r := range append(s.APNsRequests(), s.FCMRequests()...) {
+		delivered[r.Token]++
+	}
+	for _, token := range apnsTokens {
+		if n := results[token]; n != 1 {
+			t.Errorf("%s: handlers received %d results", token, n)
+		}
+	}
+	for _, token := range append(apnsTokens, fcmTokens...) {
+		if n, want := delivered[token], 1+drops.count(token); n != want {
+			t.Errorf("%s: provider received %d times, want %d (%d responses dropped)", token, n, want, drops.count(token))
+		}
+	}
+	if n := int64(len(hooks)) + counts[chaos.HookError]; n != numBad {
+		t.Errorf("unexpected hooks: %d invoked and %d failed by chaos, want %d in total", len(hooks), counts[chaos.HookError], numBad)
+	}
+	if len(results) != numAPNs+numBad {
+		t.Errorf("unexpected results: %d", len(results))
+	}
+}
@@ -0,0 +1,68 @@
+package clock_test
+
+import (
+	"testing"
+	"time"
+
+	"github.com/kayac/Gunfish/clock"
+)
+
+func TestFakeTicker(t *testing.T) {
+	start := time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)
+	f := clock.NewFake(start)
+	tk := f.NewTicker(time.Second)
+
+	f.Advance(time.Millisecond * 999)
+	select {
+	case <-tk.C():
+		t.Fatal("ticked before the period")
+	default:
+	}
+
+	f.Advance(time.Millisecond)
+	select {
+	case tm := <-tk.C():
+		if !tm.Equal(start.Add(time.Second)) {
+			t.Errorf("unexpected tick: %s", tm)
+		}
+	default:
+		t.Fatal("did not tick")
+	}
+
+	// ticks are dropped for slow receivers
+	f.Advance(time.Second * 3)
+	if tm := <-tk.C(); !tm.Equal(start.Add(time.Second * 2)) {
+		t.Errorf("unexpected tick: %s", tm)
+	}
+	select {
+	case tm := <-tk.C():
+		t.Errorf("unexpected tick: %s", tm)
+	default:
+	}
+
+	tk.Stop()
+	f.Advance(time.Second)
+	select {
+	case <-tk.C():
+		t.Error("stopped ticker ticked")
+	default:
+	}
+}
+
+func TestFakeSleep(t *testing.T) {
+	start := time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)
+	f := clock.NewFake(start)
+	f.Sleep(time.Minute)
+	f.Sleep(time.Second)
+	if now := f.Now(); !now.Equal(start.Add(time.Minute + time.Second)) {
+		t.Errorf("unexpected now: %s", now)
+	}
+	if s := f.Slept(); len(s) != 2 || s[0] != time.Minute || s[1] != time.Second {
+		t.Errorf("unexpected slept: %v", s)
+	}
+
+	f.Set(start)
+	if now := f.Now(); !now.Equal(start.Add(time.Minute + time.Second)) {
+		t.Errorf("clock went backward: %s", now)
+	}
+}
@@ -0,0 +1,126 @@
+package clock
+
+import (
+	"runtime"
+	"sync"
+	"time"
+)
+
+// Fake is a Clock whose time goes forward only by Advance, Set or Sleep.
+type Fake struct {
+	mu      sync.Mutex
+	now     time.Time
+	tickers []*fakeTicker
+	slept   []time.Duration
+}
+
+// NewFake creates Fake which starts at t.
+func NewFake(t time.Time) *Fake {
+	return &Fake{now: t}
+}
+
+// Now returns the current time of the clock.
+func (f *Fake) Now() time.Time {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.now
+}
+
+// Sleep advances the clock by d and yields the processor instead of blocking, and records d.
+func (f *Fake) Sleep(d time.Duration) {
+	f.mu.Lock()
+	f.slept = append(f.slept, d)
+	f.mu.Unlock()
+	f.Advance(d)
+	runtime.Gosched()
+}
+
+// Slept returns durations passed to Sleep.
+func (f *Fake) Slept() []time.Duration {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return append([]time.Duration(nil), f.slept...)
+}
+
+// NewTicker creates a Ticker which ticks when the clock is advanced over its period.
+func (f *Fake) NewTicker(d time.Duration) Ticker {
+	if d <= 0 {
+		panic("non-positive interval for NewTicker")
+	}
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	t := &fakeTicker{
+		c:      make(chan time.Time, 1),
+		period: d,
+		next:   f.now.Add(d),
+	}
+	f.tickers = append(f.tickers, t)
+	return t
+}
+
+// Advance advances the clock by d and fires tickers which are due.
+func (f *Fake) Advance(d time.Duration) {
+	f.mu.Lock()
+	f.set(f.now.Add(d))
+	f.mu.Unlock()
+}
+
+// Set sets the clock to t and fires tickers which are due.
+// The clock never goes backward.
+func (f *Fake) Set(t time.Time) {
+	f.mu.Lock()
+	if t.After(f.now) {
+		f.set(t)
+	}
+	f.mu.Unlock()
+}
+
+func (f *Fake) set(t time.Time) {
+	f.now = t
+	tickers := f.tickers[:0]
+	for _, tk := range f.tickers {
+		if tk.stopped() {
+			continue
+		}
+		tk.fire(t)
+		tickers = append(tickers, tk)
+	}
+	f.tickers = tickers
+}
+
+type fakeTicker struct {
+	mu     sync.Mutex
+	c      chan time.Time
+	period time.Duration
+	next   time.Time
+	stop   bool
+}
+
+func (t *fakeTicker) C() <-chan time.Time {
+	return t.c
+}
+
+func (t *fakeTicker) Stop() {
+	t.mu.Lock()
+	t.stop = true
+	t.mu.Unlock()
+}
+
+func (t *fakeTicker) stopped() bool {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return t.stop
+}
+
+// fire sends ticks due at now. Like time.Ticker, ticks are dropped for slow receivers.
+func (t *fakeTicker) fire(now time.Time) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	for !t.next.After(now) {
+		select {
+		case t.c <- t.next:
+		default:
+		}
+		t.next = t.next.Add(t.period)
+	}
+}
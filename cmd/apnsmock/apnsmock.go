@@ -1,22 +1,142 @@
 package main
 
 import (
+	"crypto/tls"
+	"crypto/x509"
 	"flag"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
 
 	"github.com/kayac/Gunfish/config"
-	"github.com/kayac/Gunfish/apns"
+	"github.com/kayac/Gunfish/mock"
+	"golang.org/x/net/http2"
 )
 
 func main() {
 	var (
-		confFile string
+		confFile    string
+		port        int
+		rulesFile   string
+		maxRequests int
+		verifyToken bool
+		clientCA    string
+		recordFile  string
+		upstream    string
+		upCertFile  string
+		upKeyFile   string
+		replayFile  string
+		timeScale   float64
+		verbose     bool
 	)
 	flag.StringVar(&confFile, "c", "./test/gunfish_test.toml", "config file")
+	flag.IntVar(&port, "port", 2195, "apns mock server port")
+	flag.StringVar(&rulesFile, "rules", "", "JSON file of scenario rules")
+	flag.IntVar(&maxRequests, "max-requests", 1000, "max number of recorded requests which /mock/requests returns (0 disables recording, negative is unlimited)")
+	flag.BoolVar(&verifyToken, "verify-token", false, "verifies provider authentication tokens by key_file, kid and team_id in the config file")
+	flag.StringVar(&clientCA, "client-ca", "", "CA certificate file to verify client certificates")
+	flag.StringVar(&recordFile, "record", "", "proxies requests to -upstream and appends the exchanges to the file")
+	flag.StringVar(&upstream, "upstream", "https://api.sandbox.push.apple.com", "APNs server to proxy requests in -record mode")
+	flag.StringVar(&upCertFile, "upstream-cert", "", "client certificate file for -upstream (token authentication is passed through when empty)")
+	flag.StringVar(&upKeyFile, "upstream-key", "", "client key file for -upstream")
+	flag.StringVar(&replayFile, "replay", "", "responds by the exchanges recorded in the file")
+	flag.Float64Var(&timeScale, "time-scale", 1, "scale of recorded response times in -replay mode (0 responds immediately)")
+	flag.BoolVar(&verbose, "verbose", false, "verbose flag")
 	flag.Parse()
 
 	config, err := config.LoadConfig(confFile)
 	if err != nil {
-		return
+		log.Fatal(err)
 	}
-	apns.StartAPNSMockServer(config.Apns.CertFile, config.Apns.KeyFile)
+
+	scenario := mock.NewScenario()
+	if rulesFile != "" {
+		if scenario, err = mock.LoadScenario(rulesFile); err != nil {
+			log.Fatal(err)
+		}
+	}
+	scenario.SetMaxRequests(maxRequests)
+
+	opts := mock.Options{
+		Verbose:  verbose,
+		Latency:  mock.DefaultLatency,
+		Scenario: scenario,
+	}
+	if verifyToken {
+		key, err := ioutil.ReadFile(config.Apns.KeyFile)
+		if err != nil {
+			log.Fatal(err)
+		}
+		if opts.ProviderToken, err = mock.NewProviderTokenVerifier(key, config.Apns.TeamID, config.Apns.Kid); err != nil {
+			log.Fatal(err)
+		}
+	}
+	if clientCA != "" {
+		ca, err := ioutil.ReadFile(clientCA)
+		if err != nil {
+			log.Fatal(err)
+		}
+		opts.ClientCAs = x509.NewCertPool()
+		if !opts.ClientCAs.AppendCertsFromPEM(ca) {
+			log.Fatalf("no certificates in %s", clientCA)
+		}
+	}
+
+	var handler http.Handler
+	switch {
+	case recordFile != "":
+		handler = newRecorder(recordFile, upstream, upCertFile, upKeyFile, verbose)
+	case replayFile != "":
+		handler = newReplayer(replayFile, timeScale, verbose)
+	default:
+		handler = mock.NewAPNsMockServer(opts)
+	}
+
+	srv := &http.Server{
+		Addr:      fmt.Sprintf(":%d", port),
+		Handler:   handler,
+		TLSConfig: &tls.Config{ClientAuth: tls.RequestClientCert},
+	}
+	log.Println("start apnsmock server")
+	if err := srv.ListenAndServeTLS(config.Apns.CertFile, config.Apns.KeyFile); err != nil {
+		log.Fatal(err)
+	}
+}
+
+func newRecorder(file, upstream, certFile, keyFile string, verbose bool) *mock.Recorder {
+	u, err := url.Parse(upstream)
+	if err != nil {
+		log.Fatal(err)
+	}
+	tr := &http2.Transport{TLSClientConfig: &tls.Config{}}
+	if certFile != "" {
+		cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+		if err != nil {
+			log.Fatal(err)
+		}
+		tr.TLSClientConfig.Certificates = []tls.Certificate{cert}
+	}
+	f, err := os.OpenFile(file, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0644)
+	if err != nil {
+		log.Fatal(err)
+	}
+	rec := mock.NewRecorder(u, tr, f)
+	rec.Verbose = verbose
+	log.Printf("recording exchanges with %s into %s", u, file)
+	return rec
+}
+
+func newReplayer(file string, timeScale float64, verbose bool) *mock.Replayer {
+	exs, err := mock.LoadExchanges(file)
+	if err != nil {
+		log.Fatal(err)
+	}
+	rp := mock.NewReplayer(exs)
+	rp.TimeScale = timeScale
+	rp.Verbose = verbose
+	log.Printf("replaying %d exchanges in %s", len(exs), file)
+	return rp
 }
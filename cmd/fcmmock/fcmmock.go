@@ -0,0 +1,99 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+
+	"github.com/kayac/Gunfish/mock"
+)
+
+func main() {
+	var (
+		port        int
+		rulesFile   string
+		maxRequests int
+		credentials string
+		projectID   string
+		recordFile  string
+		upstream    string
+		replayFile  string
+		timeScale   float64
+		verbose     bool
+	)
+	flag.IntVar(&port, "port", 8888, "fcm mock server port")
+	flag.StringVar(&rulesFile, "rules", "", "JSON file of scenario rules")
+	flag.IntVar(&maxRequests, "max-requests", 1000, "max number of recorded requests which /mock/requests returns (0 disables recording, negative is unlimited)")
+	flag.StringVar(&credentials, "write-credentials", "", "directory to write service_account.json whose token_uri is this server")
+	flag.StringVar(&projectID, "project-id", "gunfish-mock", "project id of the service account")
+	flag.StringVar(&recordFile, "record", "", "proxies requests to -upstream and appends the exchanges to the file")
+	flag.StringVar(&upstream, "upstream", "https://fcm.googleapis.com", "FCM server to proxy requests in -record mode")
+	flag.StringVar(&replayFile, "replay", "", "responds by the exchanges recorded in the file")
+	flag.Float64Var(&timeScale, "time-scale", 1, "scale of recorded response times in -replay mode (0 responds immediately)")
+	flag.BoolVar(&verbose, "verbose", false, "verbose flag")
+	flag.Parse()
+
+	scenario := mock.NewScenario()
+	if rulesFile != "" {
+		var err error
+		if scenario, err = mock.LoadScenario(rulesFile); err != nil {
+			log.Fatal(err)
+		}
+	}
+	scenario.SetMaxRequests(maxRequests)
+
+	if credentials != "" {
+		file, err := mock.WriteServiceAccount(credentials, fmt.Sprintf("http://localhost:%d/token", port), projectID)
+		if err != nil {
+			log.Fatal(err)
+		}
+		log.Printf("wrote %s", filepath.Clean(file))
+	}
+
+	opts := mock.Options{
+		Verbose:  verbose,
+		Latency:  mock.DefaultLatency,
+		Scenario: scenario,
+	}
+	mux := http.NewServeMux()
+	switch {
+	case recordFile != "":
+		u, err := url.Parse(upstream)
+		if err != nil {
+			log.Fatal(err)
+		}
+		f, err := os.OpenFile(recordFile, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0644)
+		if err != nil {
+			log.Fatal(err)
+		}
+		rec := mock.NewRecorder(u, nil, f)
+		rec.Verbose = verbose
+		mux.Handle("/fcm/", rec)
+		mux.Handle("/v1/", rec)
+		log.Printf("recording exchanges with %s into %s", u, recordFile)
+	case replayFile != "":
+		exs, err := mock.LoadExchanges(replayFile)
+		if err != nil {
+			log.Fatal(err)
+		}
+		rp := mock.NewReplayer(exs)
+		rp.TimeScale = timeScale
+		rp.Verbose = verbose
+		mux.Handle("/fcm/", rp)
+		mux.Handle("/v1/", rp)
+		log.Printf("replaying %d exchanges in %s", len(exs), replayFile)
+	default:
+		mux.Handle("/fcm/", mock.FCMMockServer(opts))
+	}
+	// serves FCM v1 in the default mode, and the fake token endpoint in all modes
+	mux.Handle("/", mock.FCMv1MockServer(opts))
+
+	log.Printf("start fcmmock server. legacy: http://localhost:%d/fcm/send v1: http://localhost:%d/v1/projects/%s/messages:send", port, port, projectID)
+	if err := http.ListenAndServe(fmt.Sprintf(":%d", port), mux); err != nil {
+		log.Fatal(err)
+	}
+}
@@ -0,0 +1,68 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"os"
+
+	"github.com/kayac/Gunfish/bench"
+	"github.com/kayac/Gunfish/mock"
+	"github.com/sirupsen/logrus"
+)
+
+func runBench(args []string) error {
+	var (
+		asJSON   bool
+		logLevel string
+	)
+	opt := bench.DefaultOptions()
+
+	fs := flag.NewFlagSet("bench", flag.ExitOnError)
+	fs.StringVar(&opt.Provider, "type", opt.Provider, "push notification type. 'apns' or 'fcm'")
+	fs.IntVar(&opt.Notifications, "n", opt.Notifications, "total number of notifications")
+	fs.IntVar(&opt.BatchSize, "batch", opt.BatchSize, "notifications per request to Gunfish")
+	fs.IntVar(&opt.Concurrency, "concurrency", opt.Concurrency, "number of concurrent requests to Gunfish")
+	fs.IntVar(&opt.WorkerNum, "workers", opt.WorkerNum, "worker_num of Gunfish")
+	fs.IntVar(&opt.QueueSize, "queue-size", opt.QueueSize, "queue_size of Gunfish")
+	fs.DurationVar(&opt.Latency.Mean, "latency", opt.Latency.Mean, "mean response time of the mock server")
+	fs.DurationVar(&opt.Latency.Jitter, "jitter", opt.Latency.Jitter, "jitter of the response time. half width for uniform, standard deviation for normal")
+	fs.StringVar(&opt.Latency.Distribution, "distribution", opt.Latency.Distribution, "distribution of the response time. 'fixed', 'uniform', 'normal' or 'exponential'")
+	fs.Float64Var(&opt.ErrorRate, "error-rate", opt.ErrorRate, "rate of error responses of the mock server (0.0-1.0)")
+	fs.DurationVar(&opt.Timeout, "timeout", opt.Timeout, "timeout to wait for deliveries")
+	fs.DurationVar(&opt.SampleInterval, "sample-interval", opt.SampleInterval, "interval to sample queue sizes")
+	fs.BoolVar(&asJSON, "json", false, "prints the report as indented JSON")
+	fs.StringVar(&logLevel, "log-level", "fatal", "log level of Gunfish. Errors by -error-rate are too noisy for the report")
+	fs.Parse(args)
+
+	switch opt.Latency.Distribution {
+	case mock.Fixed, mock.Uniform, mock.Normal, mock.Exponential:
+	default:
+		return fmt.Errorf("unknown distribution: %s", opt.Latency.Distribution)
+	}
+	if opt.ErrorRate < 0 || opt.ErrorRate > 1 {
+		return fmt.Errorf("error rate was out of available range: %f. (0.0-1.0)", opt.ErrorRate)
+	}
+
+	lvl, err := logrus.ParseLevel(logLevel)
+	if err != nil {
+		return err
+	}
+	logrus.SetLevel(lvl)
+
+	report, err := bench.Run(opt)
+	if report == nil {
+		return err
+	}
+
+	if asJSON {
+		b, jerr := json.MarshalIndent(report, "", "  ")
+		if jerr != nil {
+			return jerr
+		}
+		fmt.Println(string(b))
+	} else {
+		report.WriteTo(os.Stdout)
+	}
+	return err
+}
@@ -0,0 +1,48 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"time"
+
+	"github.com/kayac/Gunfish/config"
+)
+
+func runConfig(args []string) error {
+	if len(args) == 0 || args[0] != "check" {
+		return fmt.Errorf("Usage: gunfish config check [-c config]")
+	}
+	return runConfigCheck(args[1:])
+}
+
+func runConfigCheck(args []string) error {
+	var confPath string
+
+	fs := flag.NewFlagSet("config check", flag.ExitOnError)
+	fs.StringVar(&confPath, "config", "/etc/gunfish/config.toml", "specify config file.")
+	fs.StringVar(&confPath, "c", "/etc/gunfish/config.toml", "specify config file.")
+	fs.Parse(args)
+
+	c, err := config.LoadConfig(confPath)
+	if err != nil {
+		return err
+	}
+
+	fmt.Printf("%s: OK\n", confPath)
+	fmt.Printf("[provider] port=%d worker_num=%d queue_size=%d max_request_size=%d max_connections=%d\n",
+		c.Provider.Port, c.Provider.WorkerNum, c.Provider.QueueSize, c.Provider.RequestQueueSize, c.Provider.MaxConnections)
+	if c.Apns.Enabled {
+		if c.Apns.CertificateNotAfter.IsZero() {
+			fmt.Printf("[apns] enabled (provider authentication token) kid=%s team_id=%s\n", c.Apns.Kid, c.Apns.TeamID)
+		} else {
+			fmt.Printf("[apns] enabled (certificate) not_after=%s\n", c.Apns.CertificateNotAfter.Format(time.RFC3339))
+		}
+	}
+	if c.FCM.Enabled {
+		fmt.Println("[fcm] enabled")
+	}
+	if c.FCMv1.Enabled {
+		fmt.Printf("[fcm_v1] enabled project_id=%s\n", c.FCMv1.ProjectID)
+	}
+	return nil
+}
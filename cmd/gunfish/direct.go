@@ -0,0 +1,195 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net/url"
+	"os"
+	"time"
+
+	gunfish "github.com/kayac/Gunfish"
+	"github.com/kayac/Gunfish/apns"
+	"github.com/kayac/Gunfish/config"
+	"github.com/kayac/Gunfish/fcm"
+	"github.com/kayac/Gunfish/fcmv1"
+)
+
+// directResult is an output of send -direct.
+type directResult struct {
+	Result       json.RawMessage `json:"result,omitempty"`
+	Error        string          `json:"error,omitempty"`
+	ResponseTime float64         `json:"response_time"`
+}
+
+// sendFunc sends a notification to the provider synchronously.
+type sendFunc func() ([]gunfish.Result, error)
+
+// sendDirect sends notifications in body to the provider without Gunfish server.
+func (opt sendOptions) sendDirect(body []byte) error {
+	c, err := config.LoadConfig(opt.confPath)
+	if err != nil {
+		return err
+	}
+
+	env, err := parseEnvironment(opt.environment)
+	if err != nil {
+		return err
+	}
+
+	var sends []sendFunc
+	switch opt.typ {
+	case "apns":
+		sends, err = directAPNs(c, env, body)
+	case "fcm":
+		sends, err = directFCM(c, body)
+	case "fcmv1":
+		sends, err = directFCMv1(c, body)
+	default:
+		err = fmt.Errorf("wrong push notification type: %s", opt.typ)
+	}
+	if err != nil {
+		return err
+	}
+
+	enc := json.NewEncoder(os.Stdout)
+	var failed int
+	for _, send := range sends {
+		start := time.Now()
+		results, err := send()
+		respTime := time.Now().Sub(start).Seconds()
+		if opt.verbose {
+			log.Printf("response time: %f sec", respTime)
+		}
+
+		if err != nil {
+			failed++
+			enc.Encode(directResult{Error: err.Error(), ResponseTime: respTime})
+			continue
+		}
+		for _, r := range results {
+			if r.Err() != nil {
+				failed++
+			}
+			b, err := r.MarshalJSON()
+			if err != nil {
+				return err
+			}
+			enc.Encode(directResult{Result: b, ResponseTime: respTime})
+		}
+	}
+
+	if failed > 0 {
+		return fmt.Errorf("failed to send %d notifications", failed)
+	}
+	return nil
+}
+
+func directAPNs(c config.Config, env gunfish.Environment, body []byte) ([]sendFunc, error) {
+	if !c.Apns.Enabled {
+		return nil, fmt.Errorf("[apns] is not configured")
+	}
+	if host := env.APNsHost(); host != "" {
+		c.Apns.Host = host
+	}
+
+	var ps []gunfish.PostedData
+	if err := json.Unmarshal(body, &ps); err != nil {
+		return nil, err
+	}
+	client, err := apns.NewClient(c.Apns)
+	if err != nil {
+		return nil, err
+	}
+
+	sends := make([]sendFunc, 0, len(ps))
+	for _, p := range ps {
+		n := apns.Notification{
+			Header:  p.Header,
+			Token:   p.Token,
+			Payload: p.Payload,
+		}
+		sends = append(sends, func() ([]gunfish.Result, error) {
+			results, err := client.Send(n)
+			rs := make([]gunfish.Result, 0, len(results))
+			for _, r := range results {
+				rs = append(rs, r)
+			}
+			return rs, err
+		})
+	}
+	return sends, nil
+}
+
+func directFCM(c config.Config, body []byte) ([]sendFunc, error) {
+	if !c.FCM.Enabled {
+		return nil, fmt.Errorf("[fcm] is not configured")
+	}
+
+	var p fcm.Payload
+	if err := json.Unmarshal(body, &p); err != nil {
+		return nil, err
+	}
+	endpoint, err := parseEndpoint(c.FCM.Endpoint)
+	if err != nil {
+		return nil, fmt.Errorf("invalid endpoint for fcm: %s", err)
+	}
+	client, err := fcm.NewClient(c.FCM.APIKey, endpoint, fcm.ClientTimeout)
+	if err != nil {
+		return nil, err
+	}
+
+	return []sendFunc{func() ([]gunfish.Result, error) {
+		results, err := client.Send(p)
+		rs := make([]gunfish.Result, 0, len(results))
+		for _, r := range results {
+			rs = append(rs, r)
+		}
+		return rs, err
+	}}, nil
+}
+
+func directFCMv1(c config.Config, body []byte) ([]sendFunc, error) {
+	if !c.FCMv1.Enabled {
+		return nil, fmt.Errorf("[fcm_v1] is not configured")
+	}
+
+	endpoint, err := parseEndpoint(c.FCMv1.Endpoint)
+	if err != nil {
+		return nil, fmt.Errorf("invalid endpoint for fcmv1: %s", err)
+	}
+	client, err := fcmv1.NewClient(c.FCMv1.TokenSource, c.FCMv1.ProjectID, endpoint, fcmv1.ClientTimeout)
+	if err != nil {
+		return nil, err
+	}
+
+	var sends []sendFunc
+	dec := json.NewDecoder(bytes.NewReader(body))
+	for {
+		var p fcmv1.Payload
+		if err := dec.Decode(&p); err == io.EOF {
+			break
+		} else if err != nil {
+			return nil, err
+		}
+		sends = append(sends, func() ([]gunfish.Result, error) {
+			results, err := client.Send(p)
+			rs := make([]gunfish.Result, 0, len(results))
+			for _, r := range results {
+				rs = append(rs, r)
+			}
+			return rs, err
+		})
+	}
+	return sends, nil
+}
+
+// parseEndpoint returns nil when s is empty, so that the client uses its default endpoint.
+func parseEndpoint(s string) (*url.URL, error) {
+	if s == "" {
+		return nil, nil
+	}
+	return url.Parse(s)
+}
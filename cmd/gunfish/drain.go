@@ -0,0 +1,61 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"log"
+	"syscall"
+	"time"
+
+	gunfish "github.com/kayac/Gunfish"
+)
+
+func runDrain(args []string) error {
+	var (
+		host     string
+		port     int
+		interval time.Duration
+		timeout  time.Duration
+		stop     bool
+	)
+
+	fs := flag.NewFlagSet("drain", flag.ExitOnError)
+	fs.StringVar(&host, "host", "localhost", "gunfish host")
+	fs.IntVar(&port, "port", 8003, "gunfish port")
+	fs.DurationVar(&interval, "interval", time.Second, "polling interval of stats")
+	fs.DurationVar(&timeout, "timeout", 2*time.Minute, "gives up draining after this duration")
+	fs.BoolVar(&stop, "stop", false, "sends SIGTERM to gunfish after drained (gunfish must run on the same host)")
+	fs.Parse(args)
+
+	deadline := time.Now().Add(timeout)
+	for {
+		st, err := fetchStats(host, port)
+		if err != nil {
+			return err
+		}
+
+		n := queuedCount(st)
+		log.Printf("queued notifications: %d", n)
+		if n == 0 {
+			if stop {
+				log.Printf("sending SIGTERM to pid %d", st.Pid)
+				return syscall.Kill(st.Pid, syscall.SIGTERM)
+			}
+			return nil
+		}
+
+		if time.Now().After(deadline) {
+			return fmt.Errorf("gunfish is not drained in %s", timeout)
+		}
+		time.Sleep(interval)
+	}
+}
+
+func queuedCount(st gunfish.Stats) int64 {
+	n := st.QueueSize + st.RetryQueueSize + st.WorkersQueueSize + st.CommandQueueSize
+	// in_flight includes notifications being sent, but older versions of gunfish do not report it
+	if st.InFlight.Total > n {
+		return st.InFlight.Total
+	}
+	return n
+}
@@ -0,0 +1,47 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"time"
+
+	"github.com/kayac/Gunfish/apns"
+	"github.com/kayac/Gunfish/config"
+)
+
+func runJWT(args []string) error {
+	var (
+		confPath string
+		iat      int64
+	)
+
+	fs := flag.NewFlagSet("jwt", flag.ExitOnError)
+	fs.StringVar(&confPath, "config", "/etc/gunfish/config.toml", "specify config file.")
+	fs.StringVar(&confPath, "c", "/etc/gunfish/config.toml", "specify config file.")
+	fs.Int64Var(&iat, "iat", 0, "issued at (unixtime). default is the same time which Gunfish uses now.")
+	fs.Parse(args)
+
+	c, err := config.LoadConfig(confPath)
+	if err != nil {
+		return err
+	}
+	if c.Apns.Kid == "" || c.Apns.TeamID == "" {
+		return fmt.Errorf("kid and team_id are required in [apns] section")
+	}
+
+	key, err := ioutil.ReadFile(c.Apns.KeyFile)
+	if err != nil {
+		return err
+	}
+
+	if iat == 0 {
+		iat = apns.ProviderTokenTime(time.Now())
+	}
+	token, err := apns.CreateJWT(key, c.Apns.Kid, c.Apns.TeamID, iat)
+	if err != nil {
+		return err
+	}
+	fmt.Println(token)
+	return nil
+}
@@ -0,0 +1,24 @@
+package main
+
+import (
+	"sort"
+
+	"github.com/kayac/Gunfish/logger"
+)
+
+// loggers are constructors of loggers which are chosen by -logger.
+var loggers = map[string]func(format, level string) (logger.Logger, error){
+	// the standard logger of logrus is configured by initLogrus
+	"logrus": func(format, level string) (logger.Logger, error) {
+		return logger.NewLogrus(nil), nil
+	},
+}
+
+func loggerNames() []string {
+	names := make([]string, 0, len(loggers))
+	for name := range loggers {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
@@ -0,0 +1,42 @@
+//go:build go1.21
+// +build go1.21
+
+package main
+
+import (
+	"fmt"
+	"log/slog"
+	"os"
+
+	"github.com/kayac/Gunfish/logger"
+)
+
+func init() {
+	loggers["slog"] = newSlog
+}
+
+func newSlog(format, level string) (logger.Logger, error) {
+	var lvl slog.Level
+	switch level {
+	case "debug":
+		lvl = slog.LevelDebug
+	case "info":
+		lvl = slog.LevelInfo
+	case "warn", "warning":
+		lvl = slog.LevelWarn
+	case "error":
+		lvl = slog.LevelError
+	case "fatal":
+		lvl = logger.SlogFatalLevel
+	default:
+		return nil, fmt.Errorf("Unknown log level: %s", level)
+	}
+	opts := &slog.HandlerOptions{Level: lvl}
+	switch format {
+	case "json":
+		return logger.NewSlog(slog.New(slog.NewJSONHandler(os.Stderr, opts))), nil
+	case "", "text":
+		return logger.NewSlog(slog.New(slog.NewTextHandler(os.Stderr, opts))), nil
+	}
+	return nil, fmt.Errorf("%s log format is not supported by slog", format)
+}
@@ -0,0 +1,371 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	gunfish "github.com/kayac/Gunfish"
+	"github.com/kayac/Gunfish/clock"
+	"github.com/kayac/Gunfish/config"
+	"github.com/kayac/Gunfish/fcmv1"
+)
+
+// Max size of a line in NDJSON file
+const replayMaxLineSize = 1024 * 1024
+
+type replayOptions struct {
+	typ         string
+	file        string
+	host        string
+	port        int
+	rate        float64
+	concurrency int
+	batchSize   int
+	offset      int
+	maxRetries  int
+	progress    time.Duration
+
+	supervisor  bool
+	confPath    string
+	environment string
+}
+
+// replayBatch is a chunk of NDJSON lines [offset, end) posted at once.
+// Lines are counted from 0 and blank lines are included in the range.
+type replayBatch struct {
+	offset int
+	end    int
+	items  [][]byte
+}
+
+// postFunc posts body to path of Gunfish and returns the status code and Retry-After.
+type postFunc func(path string, body []byte) (int, time.Duration, []byte, error)
+
+type replayer struct {
+	opt   replayOptions
+	path  string
+	post  postFunc
+	clock clock.Clock
+
+	read    int64
+	sent    int64
+	failed  int64
+	retried int64
+
+	mu        sync.Mutex
+	done      map[int]int // offset -> end of finished batches
+	watermark int         // all lines before watermark are finished
+}
+
+func newReplayer(opt replayOptions, path string, post postFunc) *replayer {
+	return &replayer{
+		opt:       opt,
+		path:      path,
+		post:      post,
+		clock:     clock.Real,
+		done:      make(map[int]int),
+		watermark: opt.offset,
+	}
+}
+
+func runReplay(args []string) error {
+	var opt replayOptions
+
+	fs := flag.NewFlagSet("replay", flag.ExitOnError)
+	fs.StringVar(&opt.typ, "type", "apns", "push notification type. 'apns', 'fcm' or 'fcmv1'")
+	fs.StringVar(&opt.file, "file", "-", "NDJSON file of push items. '-' reads from STDIN")
+	fs.StringVar(&opt.host, "host", "localhost", "gunfish host")
+	fs.IntVar(&opt.port, "port", 8003, "gunfish port")
+	fs.Float64Var(&opt.rate, "rate", 0, "max items per second (0 is unlimited)")
+	fs.IntVar(&opt.concurrency, "concurrency", 1, "number of concurrent requests")
+	fs.IntVar(&opt.batchSize, "batch", 100, "items per request (apns and fcmv1 only)")
+	fs.IntVar(&opt.offset, "offset", 0, "skips lines before this offset to resume")
+	fs.IntVar(&opt.maxRetries, "max-retries", 10, "max retries of a request which failed by 503 or connection error")
+	fs.DurationVar(&opt.progress, "progress", 5*time.Second, "interval of progress report")
+	fs.BoolVar(&opt.supervisor, "supervisor", false, "enqueues items into an in-process supervisor instead of Gunfish server")
+	fs.StringVar(&opt.confPath, "config", "/etc/gunfish/config.toml", "specify config file. (for -supervisor)")
+	fs.StringVar(&opt.confPath, "c", "/etc/gunfish/config.toml", "specify config file. (for -supervisor)")
+	fs.StringVar(&opt.environment, "environment", "production", "APNS environment. (production, development, or test) (for -supervisor)")
+	fs.StringVar(&opt.environment, "E", "production", "APNS environment. (production, development, or test) (for -supervisor)")
+	fs.Parse(args)
+
+	path, err := pushPath(opt.typ)
+	if err != nil {
+		return err
+	}
+	switch {
+	case opt.typ == "fcm":
+		// FCM legacy endpoint accepts a payload in a request.
+		opt.batchSize = 1
+	case opt.typ == "fcmv1" && opt.batchSize >= fcmv1.MaxBulkRequests:
+		opt.batchSize = fcmv1.MaxBulkRequests - 1
+	case opt.batchSize > config.MaxRequestSize:
+		opt.batchSize = config.MaxRequestSize
+	}
+	if opt.batchSize < 1 {
+		opt.batchSize = 1
+	}
+	if opt.concurrency < 1 {
+		opt.concurrency = 1
+	}
+
+	var src io.Reader = os.Stdin
+	if opt.file != "-" {
+		f, err := os.Open(opt.file)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		src = f
+	}
+
+	var post postFunc
+	if opt.supervisor {
+		sup, err := startReplaySupervisor(opt)
+		if err != nil {
+			return err
+		}
+		defer sup.Shutdown()
+		post = supervisorPoster(sup)
+	} else {
+		post = httpPoster(fmt.Sprintf("http://%s:%d", opt.host, opt.port))
+	}
+
+	return newReplayer(opt, path, post).run(src)
+}
+
+func (r *replayer) run(src io.Reader) error {
+	start := r.clock.Now()
+	batches := make(chan replayBatch, r.opt.concurrency)
+
+	var wg sync.WaitGroup
+	for i := 0; i < r.opt.concurrency; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for b := range batches {
+				r.send(b)
+			}
+		}()
+	}
+
+	stop := make(chan struct{})
+	go func() {
+		ticker := r.clock.NewTicker(r.opt.progress)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C():
+				r.report("progress", start)
+			case <-stop:
+				return
+			}
+		}
+	}()
+
+	err := r.readBatches(src, start, batches)
+	close(batches)
+	wg.Wait()
+	close(stop)
+
+	r.report("summary", start)
+	if err != nil {
+		return err
+	}
+	if n := atomic.LoadInt64(&r.failed); n > 0 {
+		return fmt.Errorf("failed to replay %d items", n)
+	}
+	return nil
+}
+
+// readBatches reads NDJSON lines from src and sends batches at the rate.
+func (r *replayer) readBatches(src io.Reader, start time.Time, batches chan<- replayBatch) error {
+	scanner := bufio.NewScanner(src)
+	scanner.Buffer(make([]byte, 64*1024), replayMaxLineSize)
+
+	var (
+		line  int
+		items int
+		b     = replayBatch{offset: r.opt.offset}
+	)
+	for scanner.Scan() {
+		line++
+		if line <= r.opt.offset {
+			continue
+		}
+		item := bytes.TrimSpace(scanner.Bytes())
+		if len(item) == 0 {
+			continue
+		}
+		b.items = append(b.items, append([]byte(nil), item...))
+		atomic.AddInt64(&r.read, 1)
+		items++
+
+		if r.opt.rate > 0 {
+			next := start.Add(time.Duration(float64(items) / r.opt.rate * float64(time.Second)))
+			if d := next.Sub(r.clock.Now()); d > 0 {
+				r.clock.Sleep(d)
+			}
+		}
+
+		if len(b.items) >= r.opt.batchSize {
+			b.end = line
+			batches <- b
+			b = replayBatch{offset: line}
+		}
+	}
+	if line > b.offset {
+		// includes trailing blank lines to advance the watermark to the end.
+		b.end = line
+		if len(b.items) > 0 {
+			batches <- b
+		} else {
+			r.finish(b)
+		}
+	}
+	return scanner.Err()
+}
+
+// send posts a batch. The watermark does not move past a failed batch, so that it is sent again when resumed.
+func (r *replayer) send(b replayBatch) {
+	body := r.requestBody(b.items)
+
+	for tries := 0; ; tries++ {
+		status, retryAfter, resp, err := r.post(r.path, body)
+		if err == nil && status == http.StatusOK {
+			atomic.AddInt64(&r.sent, int64(len(b.items)))
+			r.finish(b)
+			return
+		}
+		if err == nil && status != http.StatusServiceUnavailable {
+			log.Printf("lines %d-%d are rejected: status %d %s", b.offset+1, b.end, status, resp)
+			atomic.AddInt64(&r.failed, int64(len(b.items)))
+			return
+		}
+		if tries >= r.opt.maxRetries {
+			log.Printf("lines %d-%d are given up after %d retries: status %d %v", b.offset+1, b.end, tries, status, err)
+			atomic.AddInt64(&r.failed, int64(len(b.items)))
+			return
+		}
+
+		atomic.AddInt64(&r.retried, 1)
+		if retryAfter <= 0 {
+			retryAfter = time.Second
+		}
+		r.clock.Sleep(retryAfter)
+	}
+}
+
+// requestBody builds a request body of the push endpoint from NDJSON items.
+func (r *replayer) requestBody(items [][]byte) []byte {
+	switch r.opt.typ {
+	case "apns":
+		return append(append([]byte{'['}, bytes.Join(items, []byte{','})...), ']')
+	default:
+		return bytes.Join(items, []byte{'\n'})
+	}
+}
+
+// finish marks a batch finished and advances the watermark to resume.
+func (r *replayer) finish(b replayBatch) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	r.done[b.offset] = b.end
+	for {
+		end, ok := r.done[r.watermark]
+		if !ok {
+			break
+		}
+		delete(r.done, r.watermark)
+		r.watermark = end
+	}
+}
+
+func (r *replayer) report(label string, start time.Time) {
+	r.mu.Lock()
+	watermark := r.watermark
+	r.mu.Unlock()
+
+	elapsed := r.clock.Now().Sub(start)
+	sent := atomic.LoadInt64(&r.sent)
+	log.Printf("[%s] read:%d sent:%d failed:%d retried:%d elapsed:%s rate:%.1f/s resume_offset:%d",
+		label,
+		atomic.LoadInt64(&r.read),
+		sent,
+		atomic.LoadInt64(&r.failed),
+		atomic.LoadInt64(&r.retried),
+		elapsed.Truncate(time.Millisecond),
+		float64(sent)/elapsed.Seconds(),
+		watermark,
+	)
+}
+
+func httpPoster(baseURL string) postFunc {
+	return func(path string, body []byte) (int, time.Duration, []byte, error) {
+		resp, err := http.Post(baseURL+path, gunfish.ApplicationJSON, bytes.NewReader(body))
+		if err != nil {
+			return 0, 0, nil, err
+		}
+		defer resp.Body.Close()
+		b, _ := ioutil.ReadAll(resp.Body)
+		return resp.StatusCode, retryAfter(resp.Header), b, nil
+	}
+}
+
+func supervisorPoster(sup gunfish.Supervisor) postFunc {
+	prov := &gunfish.Provider{Sup: sup}
+	handlers := map[string]http.Handler{
+		"/push/apns":   prov.PushAPNsHandler(),
+		"/push/fcm":    prov.PushFCMHandler(false),
+		"/push/fcm/v1": prov.PushFCMHandler(true),
+	}
+	return func(path string, body []byte) (int, time.Duration, []byte, error) {
+		req, err := http.NewRequest(http.MethodPost, path, bytes.NewReader(body))
+		if err != nil {
+			return 0, 0, nil, err
+		}
+		req.Header.Set("Content-Type", gunfish.ApplicationJSON)
+		w := httptest.NewRecorder()
+		handlers[path].ServeHTTP(w, req)
+		return w.Code, retryAfter(w.Header()), w.Body.Bytes(), nil
+	}
+}
+
+func startReplaySupervisor(opt replayOptions) (gunfish.Supervisor, error) {
+	c, err := config.LoadConfig(opt.confPath)
+	if err != nil {
+		return gunfish.Supervisor{}, err
+	}
+	env, err := parseEnvironment(opt.environment)
+	if err != nil {
+		return gunfish.Supervisor{}, err
+	}
+	if host := env.APNsHost(); host != "" {
+		c.Apns.Host = host
+	}
+
+	gunfish.InitSuccessResponseHandler(gunfish.DefaultResponseHandler{})
+	gunfish.InitErrorResponseHandler(gunfish.DefaultResponseHandler{Hook: c.Provider.ErrorHook})
+	return gunfish.StartSupervisor(&c)
+}
+
+func retryAfter(h http.Header) time.Duration {
+	sec, err := strconv.Atoi(h.Get("Retry-After"))
+	if err != nil {
+		return 0
+	}
+	return time.Duration(sec) * time.Second
+}
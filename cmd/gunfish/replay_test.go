@@ -0,0 +1,136 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"reflect"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/kayac/Gunfish/clock"
+)
+
+// fakePoster records posted bodies and responds by respond, which is called with the number of the post.
+type fakePoster struct {
+	mu      sync.Mutex
+	bodies  []string
+	respond func(n int, body string) (int, time.Duration)
+}
+
+func (p *fakePoster) post(path string, body []byte) (int, time.Duration, []byte, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.bodies = append(p.bodies, string(body))
+	if p.respond == nil {
+		return http.StatusOK, 0, nil, nil
+	}
+	status, retryAfter := p.respond(len(p.bodies), string(body))
+	return status, retryAfter, nil, nil
+}
+
+func testReplayer(opt replayOptions, p *fakePoster) (*replayer, *clock.Fake) {
+	opt.typ = "apns"
+	opt.concurrency = 1
+	opt.progress = time.Minute
+	r := newReplayer(opt, "/push/apns", p.post)
+	fake := clock.NewFake(time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC))
+	r.clock = fake
+	return r, fake
+}
+
+func replayLines(n int) string {
+	var b strings.Builder
+	for i := 1; i <= n; i++ {
+		fmt.Fprintf(&b, "{\"token\":\"%d\"}\n", i)
+	}
+	return b.String()
+}
+
+func TestReplayResume(t *testing.T) {
+	p := &fakePoster{}
+	r, _ := testReplayer(replayOptions{batchSize: 2, offset: 3}, p)
+	if err := r.run(strings.NewReader(replayLines(7))); err != nil {
+		t.Fatal(err)
+	}
+	want := []string{
+		`[{"token":"4"},{"token":"5"}]`,
+		`[{"token":"6"},{"token":"7"}]`,
+	}
+	if !reflect.DeepEqual(p.bodies, want) {
+		t.Errorf("unexpected bodies: %v", p.bodies)
+	}
+	if r.watermark != 7 || r.read != 4 || r.sent != 4 {
+		t.Errorf("unexpected watermark %d read %d sent %d", r.watermark, r.read, r.sent)
+	}
+}
+
+func TestReplayPartialBatch(t *testing.T) {
+	p := &fakePoster{}
+	r, _ := testReplayer(replayOptions{batchSize: 2}, p)
+	// trailing blank lines are counted to the watermark
+	if err := r.run(strings.NewReader(replayLines(5) + "\n\n")); err != nil {
+		t.Fatal(err)
+	}
+	want := []string{
+		`[{"token":"1"},{"token":"2"}]`,
+		`[{"token":"3"},{"token":"4"}]`,
+		`[{"token":"5"}]`,
+	}
+	if !reflect.DeepEqual(p.bodies, want) {
+		t.Errorf("unexpected bodies: %v", p.bodies)
+	}
+	if r.watermark != 7 || r.sent != 5 {
+		t.Errorf("unexpected watermark %d sent %d", r.watermark, r.sent)
+	}
+}
+
+func TestReplayRetryAfter(t *testing.T) {
+	p := &fakePoster{respond: func(n int, body string) (int, time.Duration) {
+		switch n {
+		case 1:
+			return http.StatusServiceUnavailable, 3 * time.Second
+		case 2:
+			return http.StatusServiceUnavailable, 0
+		}
+		return http.StatusOK, 0
+	}}
+	r, fake := testReplayer(replayOptions{batchSize: 2, maxRetries: 10}, p)
+	if err := r.run(strings.NewReader(replayLines(2))); err != nil {
+		t.Fatal(err)
+	}
+	if len(p.bodies) != 3 || r.retried != 2 || r.sent != 2 || r.watermark != 2 {
+		t.Errorf("unexpected posts %d retried %d sent %d watermark %d", len(p.bodies), r.retried, r.sent, r.watermark)
+	}
+	// waits Retry-After, or a second without it
+	if slept := fake.Slept(); !reflect.DeepEqual(slept, []time.Duration{3 * time.Second, time.Second}) {
+		t.Errorf("unexpected waits: %v", slept)
+	}
+}
+
+func TestReplayWatermarkStopsAtFailedBatch(t *testing.T) {
+	testCases := []struct {
+		name    string
+		status  int
+		retried int64
+	}{
+		{"rejected", http.StatusBadRequest, 0},
+		{"given up", http.StatusServiceUnavailable, 2},
+	}
+	for _, c := range testCases {
+		p := &fakePoster{respond: func(n int, body string) (int, time.Duration) {
+			if strings.Contains(body, `"3"`) {
+				return c.status, 0
+			}
+			return http.StatusOK, 0
+		}}
+		r, _ := testReplayer(replayOptions{batchSize: 2, maxRetries: 2}, p)
+		if err := r.run(strings.NewReader(replayLines(6))); err == nil {
+			t.Errorf("%s: failed items are not reported", c.name)
+		}
+		if r.watermark != 2 || r.sent != 4 || r.failed != 2 || r.retried != c.retried {
+			t.Errorf("%s: unexpected watermark %d sent %d failed %d retried %d", c.name, r.watermark, r.sent, r.failed, r.retried)
+		}
+	}
+}
@@ -0,0 +1,205 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"os"
+	"strings"
+
+	gunfish "github.com/kayac/Gunfish"
+)
+
+type sendOptions struct {
+	typ       string
+	host      string
+	port      int
+	apnsTopic string
+	count     int
+	message   string
+	sound     string
+	options   string
+	token     string
+	jsonFile  string
+	dryrun    bool
+	verbose   bool
+
+	direct      bool
+	confPath    string
+	environment string
+}
+
+func runSend(args []string) error {
+	var opt sendOptions
+
+	fs := flag.NewFlagSet("send", flag.ExitOnError)
+	fs.StringVar(&opt.typ, "type", "apns", "push notification type. 'apns', 'fcm' or 'fcmv1'")
+	fs.IntVar(&opt.count, "count", 1, "send count")
+	fs.IntVar(&opt.port, "port", 8003, "gunfish port")
+	fs.StringVar(&opt.host, "host", "localhost", "gunfish host")
+	fs.StringVar(&opt.apnsTopic, "apns-topic", "", "apns topic")
+	fs.StringVar(&opt.message, "message", "test notification", "push notification message")
+	fs.StringVar(&opt.sound, "sound", "default", "push notification sound")
+	fs.StringVar(&opt.options, "options", "", "options (key1=value1,key2=value2...)")
+	fs.StringVar(&opt.token, "token", "", "device token (required unless -json-file is given)")
+	fs.StringVar(&opt.jsonFile, "json-file", "", "json input file which is posted as is")
+	fs.BoolVar(&opt.dryrun, "dryrun", false, "prints request body without sending")
+	fs.BoolVar(&opt.verbose, "verbose", false, "verbose output")
+	fs.BoolVar(&opt.direct, "direct", false, "sends directly to APNs or FCM with the credentials in config file, without Gunfish server")
+	fs.StringVar(&opt.confPath, "config", "/etc/gunfish/config.toml", "specify config file. (for -direct)")
+	fs.StringVar(&opt.confPath, "c", "/etc/gunfish/config.toml", "specify config file. (for -direct)")
+	fs.StringVar(&opt.environment, "environment", "production", "APNS environment. (production, development, or test) (for -direct)")
+	fs.StringVar(&opt.environment, "E", "production", "APNS environment. (production, development, or test) (for -direct)")
+	fs.Parse(args)
+
+	path, err := pushPath(opt.typ)
+	if err != nil {
+		return err
+	}
+
+	body, err := opt.requestBody()
+	if err != nil {
+		return err
+	}
+
+	if opt.dryrun {
+		log.Println("[dryrun] checks request payload:")
+		fmt.Println(string(body))
+		return nil
+	}
+
+	if opt.direct {
+		return opt.sendDirect(body)
+	}
+
+	endpoint := fmt.Sprintf("http://%s:%d%s", opt.host, opt.port, path)
+	if opt.verbose {
+		log.Printf("endpoint: %s, send count: %d", endpoint, opt.count)
+		log.Printf("post data: %s", body)
+	}
+
+	resp, err := http.Post(endpoint, gunfish.ApplicationJSON, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if opt.verbose {
+		log.Printf("status: %s", resp.Status)
+	}
+	if _, err := io.Copy(os.Stdout, resp.Body); err != nil {
+		return err
+	}
+	fmt.Println()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("unexpected status: %s", resp.Status)
+	}
+	return nil
+}
+
+func pushPath(typ string) (string, error) {
+	switch typ {
+	case "apns":
+		return "/push/apns", nil
+	case "fcm":
+		return "/push/fcm", nil
+	case "fcmv1":
+		return "/push/fcm/v1", nil
+	}
+	return "", fmt.Errorf("wrong push notification type: %s", typ)
+}
+
+// requestBody builds a request body for the push endpoint of the type.
+func (opt sendOptions) requestBody() ([]byte, error) {
+	if opt.jsonFile != "" {
+		return ioutil.ReadFile(opt.jsonFile)
+	}
+	if opt.token == "" {
+		return nil, fmt.Errorf("-token is required")
+	}
+
+	opts := map[string]string{}
+	if opt.options != "" {
+		for _, o := range strings.Split(opt.options, ",") {
+			kv := strings.SplitN(o, "=", 2)
+			if len(kv) != 2 {
+				return nil, fmt.Errorf("invalid option: %s", o)
+			}
+			opts[kv[0]] = kv[1]
+		}
+	}
+
+	switch opt.typ {
+	case "apns":
+		payloads := make([]map[string]interface{}, opt.count)
+		for i := range payloads {
+			payloads[i] = opt.apnsPayload(opts)
+		}
+		return json.Marshal(payloads)
+	case "fcm":
+		ids := make([]string, opt.count)
+		for i := range ids {
+			ids[i] = opt.token
+		}
+		return json.Marshal(opt.fcmPayload(ids, opts))
+	case "fcmv1":
+		// FCM v1 endpoint accepts concatenated payloads.
+		b := &bytes.Buffer{}
+		enc := json.NewEncoder(b)
+		for i := 0; i < opt.count; i++ {
+			if err := enc.Encode(opt.fcmv1Payload(opts)); err != nil {
+				return nil, err
+			}
+		}
+		return b.Bytes(), nil
+	}
+	return nil, fmt.Errorf("wrong push notification type: %s", opt.typ)
+}
+
+func (opt sendOptions) apnsPayload(opts map[string]string) map[string]interface{} {
+	payload := map[string]interface{}{
+		"aps": map[string]string{
+			"alert": opt.message,
+			"sound": opt.sound,
+		},
+	}
+	for k, v := range opts {
+		payload[k] = v
+	}
+
+	return map[string]interface{}{
+		"payload": payload,
+		"token":   opt.token,
+		"header": map[string]interface{}{
+			"apns-topic": opt.apnsTopic,
+		},
+	}
+}
+
+func (opt sendOptions) fcmPayload(ids []string, opts map[string]string) map[string]interface{} {
+	return map[string]interface{}{
+		"registration_ids": ids,
+		"notification": map[string]string{
+			"body":  opt.message,
+			"sound": opt.sound,
+		},
+		"data": opts,
+	}
+}
+
+func (opt sendOptions) fcmv1Payload(opts map[string]string) map[string]interface{} {
+	return map[string]interface{}{
+		"message": map[string]interface{}{
+			"token": opt.token,
+			"notification": map[string]string{
+				"body": opt.message,
+			},
+			"data": opts,
+		},
+	}
+}
@@ -0,0 +1,177 @@
+package main
+
+import (
+	"crypto/tls"
+	"flag"
+	"fmt"
+	"net"
+	"net/http"
+	"net/http/pprof"
+	"runtime"
+	"strconv"
+	"strings"
+	"time"
+
+	gunfish "github.com/kayac/Gunfish"
+	"github.com/kayac/Gunfish/apns"
+	"github.com/kayac/Gunfish/config"
+	"github.com/kayac/Gunfish/logger"
+	"github.com/sirupsen/logrus"
+)
+
+func runServe(args []string) error {
+	var (
+		confPath    string
+		environment string
+		logFormat   string
+		logTime     string
+		port        int
+		enablePprof bool
+		showVersion bool
+		logLevel    string
+		loggerName  string
+	)
+
+	fs := flag.NewFlagSet("serve", flag.ExitOnError)
+	fs.StringVar(&confPath, "config", "/etc/gunfish/config.toml", "specify config file.")
+	fs.StringVar(&confPath, "c", "/etc/gunfish/config.toml", "specify config file.")
+	fs.StringVar(&environment, "environment", "production", "APNS environment. (production, development, or test)")
+	fs.StringVar(&environment, "E", "production", "APNS environment. (production, development, or test)")
+	fs.IntVar(&port, "port", 0, "Gunfish port number (range 1024-65535).")
+	fs.StringVar(&loggerName, "logger", "logrus", "specifies the logger: "+strings.Join(loggerNames(), " or ")+".")
+	fs.StringVar(&logFormat, "log-format", "", "specifies the log format: ltsv or json.")
+	fs.BoolVar(&logger.ReportCaller, "log-caller", false, "adds file and line of the caller to logs.")
+	fs.StringVar(&logTime, "log-timestamp", "rfc3339", "specifies the timestamp format of logs: rfc3339, rfc3339ms, epoch or epoch_ms.")
+	fs.BoolVar(&enablePprof, "enable-pprof", false, ".")
+	fs.BoolVar(&showVersion, "v", false, "show version number.")
+	fs.BoolVar(&showVersion, "version", false, "show version number.")
+	fs.BoolVar(&gunfish.OutputHookStdout, "output-hook-stdout", false, "merge stdout of hook command to gunfish's stdout")
+	fs.BoolVar(&gunfish.OutputHookStderr, "output-hook-stderr", false, "merge stderr of hook command to gunfish's stderr")
+
+	fs.StringVar(&logLevel, "log-level", "info", "set the log level (debug, warn, info)")
+	fs.Parse(args)
+
+	if showVersion {
+		return runVersion(nil)
+	}
+
+	if err := initLogrus(logFormat, logTime, logLevel); err != nil {
+		return err
+	}
+	newLogger, ok := loggers[loggerName]
+	if !ok {
+		return fmt.Errorf("Unknown logger: %s", loggerName)
+	}
+	l, err := newLogger(logFormat, logLevel)
+	if err != nil {
+		return err
+	}
+	gunfish.SetLogger(l)
+
+	c, err := config.LoadConfig(confPath)
+	if err != nil {
+		return err
+	}
+
+	c.Provider.DebugPort = 0
+	if port != 0 {
+		c.Provider.Port = port // Default port number
+	}
+
+	env, err := parseEnvironment(environment)
+	if err != nil {
+		return err
+	}
+
+	// for profiling
+	if enablePprof {
+		mux := http.NewServeMux()
+		l, err := net.Listen("tcp", "localhost:0")
+		if err != nil {
+			return err
+		}
+		debugAddr := l.Addr().String()
+		_, p, err := net.SplitHostPort(debugAddr)
+		if err != nil {
+			return err
+		}
+		dp, err := strconv.Atoi(p)
+		if err != nil {
+			return err
+		}
+		gunfish.LogWithFields(logger.Fields{"type": "provider"}).Infof("Debug port (pprof) is %d.", dp)
+		c.Provider.DebugPort = dp
+
+		mux.HandleFunc("/debug/pprof/cmdline", pprof.Cmdline)
+		mux.HandleFunc("/debug/pprof/profile", pprof.Profile)
+		mux.HandleFunc("/debug/pprof/symbol", pprof.Symbol)
+		mux.HandleFunc("/debug/pprof/", pprof.Index)
+
+		go func() {
+			gunfish.LogWithFields(logger.Fields{"type": "provider"}).Fatal(http.Serve(l, mux))
+		}()
+	}
+
+	gunfish.StartServer(c, env)
+	return nil
+}
+
+func runVersion(args []string) error {
+	fmt.Printf("Compiler: %s %s\n", runtime.Compiler, runtime.Version())
+	fmt.Printf("Gunfish version: %s\n", version)
+	return nil
+}
+
+func parseEnvironment(environment string) (gunfish.Environment, error) {
+	switch environment {
+	case "production":
+		return gunfish.Production, nil
+	case "development":
+		return gunfish.Development, nil
+	case "test":
+		apns.ClientTransport = func(cert tls.Certificate) *http.Transport {
+			return &http.Transport{
+				TLSClientConfig: &tls.Config{
+					InsecureSkipVerify: true,
+					Certificates:       []tls.Certificate{cert},
+				},
+			}
+		}
+		return gunfish.Test, nil
+	}
+	return gunfish.Disable, fmt.Errorf("Unknown environment: %s. Please look at help.", environment)
+}
+
+func initLogrus(format, timestamp, logLevel string) error {
+	var timestampFormat string
+	switch timestamp {
+	case "rfc3339":
+		timestampFormat = time.RFC3339
+	case "rfc3339ms":
+		timestampFormat = gunfish.RFC3339Milli
+	case "epoch":
+		timestampFormat = gunfish.TimestampEpoch
+	case "epoch_ms":
+		timestampFormat = gunfish.TimestampEpochMilli
+	default:
+		return fmt.Errorf("Unknown log timestamp format: %s", timestamp)
+	}
+
+	switch format {
+	case "ltsv":
+		logrus.SetFormatter(&gunfish.LtsvFormatter{TimestampFormat: timestampFormat})
+	case "json":
+		if timestampFormat == gunfish.TimestampEpoch || timestampFormat == gunfish.TimestampEpochMilli {
+			return fmt.Errorf("%s timestamp is supported only by ltsv log format", timestamp)
+		}
+		logrus.SetFormatter(&logrus.JSONFormatter{TimestampFormat: timestampFormat})
+	}
+
+	lvl, err := logrus.ParseLevel(logLevel)
+	if err != nil {
+		lvl = logrus.InfoLevel
+	}
+
+	logrus.SetLevel(lvl)
+	return nil
+}
@@ -0,0 +1,66 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"net/http"
+	"os"
+	"reflect"
+	"strings"
+	"text/tabwriter"
+
+	gunfish "github.com/kayac/Gunfish"
+)
+
+func runStats(args []string) error {
+	var (
+		host   string
+		port   int
+		asJSON bool
+	)
+
+	fs := flag.NewFlagSet("stats", flag.ExitOnError)
+	fs.StringVar(&host, "host", "localhost", "gunfish host")
+	fs.IntVar(&port, "port", 8003, "gunfish port")
+	fs.BoolVar(&asJSON, "json", false, "prints stats as indented JSON")
+	fs.Parse(args)
+
+	st, err := fetchStats(host, port)
+	if err != nil {
+		return err
+	}
+
+	if asJSON {
+		b, err := json.MarshalIndent(st, "", "  ")
+		if err != nil {
+			return err
+		}
+		fmt.Println(string(b))
+		return nil
+	}
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 8, 2, ' ', 0)
+	v := reflect.ValueOf(st)
+	for i := 0; i < v.NumField(); i++ {
+		name := strings.Split(v.Type().Field(i).Tag.Get("json"), ",")[0]
+		fmt.Fprintf(w, "%s\t%v\n", name, v.Field(i).Interface())
+	}
+	return w.Flush()
+}
+
+func fetchStats(host string, port int) (gunfish.Stats, error) {
+	var st gunfish.Stats
+
+	resp, err := http.Get(fmt.Sprintf("http://%s:%d/stats/app", host, port))
+	if err != nil {
+		return st, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return st, fmt.Errorf("unexpected status: %s", resp.Status)
+	}
+	err = json.NewDecoder(resp.Body).Decode(&st)
+	return st, err
+}
@@ -0,0 +1,110 @@
+package gunfish
+
+import (
+	"strings"
+	"sync"
+
+	"github.com/kayac/Gunfish/apns"
+	"github.com/kayac/Gunfish/fcm"
+	"github.com/kayac/Gunfish/fcmv1"
+)
+
+// coalescer replaces a queued notification with a newer one which has the same recipient and collapse identifier.
+// A notification is queued until a sender takes it. A nil coalescer coalesces nothing.
+type coalescer struct {
+	mu    sync.Mutex
+	slots map[string]*coalesceSlot
+}
+
+// coalesceSlot holds the latest notification of a collapse key, which is sent instead of the queued one.
+type coalesceSlot struct {
+	key string
+	req Request
+}
+
+func newCoalescer() *coalescer {
+	return &coalescer{slots: make(map[string]*coalesceSlot)}
+}
+
+// coalesce replaces queued notifications with reqs of the same collapse keys, and calls enqueue with the rest of reqs.
+// The replacements are reverted when enqueue fails. It returns the replaced notifications.
+func (c *coalescer) coalesce(reqs []Request, enqueue func([]Request) bool) ([]Request, bool) {
+	if c == nil {
+		return nil, enqueue(reqs)
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	var (
+		rest     = reqs[:0:0]
+		replaced []Request
+		slots    []*coalesceSlot
+		added    []*coalesceSlot
+	)
+	for _, req := range reqs {
+		key := collapseKey(req.Notification)
+		if key == "" {
+			rest = append(rest, req)
+			continue
+		}
+		if slot, ok := c.slots[key]; ok {
+			replaced = append(replaced, slot.req)
+			slots = append(slots, slot)
+			req.slot = slot
+			slot.req = req
+			continue
+		}
+		slot := &coalesceSlot{key: key}
+		req.slot = slot
+		slot.req = req
+		c.slots[key] = slot
+		added = append(added, slot)
+		rest = append(rest, req)
+	}
+	if len(rest) == 0 || enqueue(rest) {
+		return replaced, true
+	}
+	// in reverse order, so that a slot replaced twice gets back the original one
+	for i := len(slots) - 1; i >= 0; i-- {
+		slots[i].req = replaced[i]
+	}
+	for _, slot := range added {
+		delete(c.slots, slot.key)
+	}
+	return nil, false
+}
+
+// take returns the latest notification of req, and stops coalescing it.
+func (c *coalescer) take(req Request) Request {
+	if c == nil || req.slot == nil {
+		return req
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	slot := req.slot
+	if c.slots[slot.key] == slot {
+		delete(c.slots, slot.key)
+	}
+	req = slot.req
+	req.slot = nil
+	return req
+}
+
+// collapseKey returns the key of the recipient and the collapse identifier of n, or "" when n has no collapse identifier.
+func collapseKey(n Notification) string {
+	switch no := n.(type) {
+	case apns.Notification:
+		if no.Header.ApnsCollapseID != "" {
+			return "apns\x00" + no.Token + "\x00" + no.Header.ApnsCollapseID
+		}
+	case fcm.Payload:
+		if no.CollapseKey != "" {
+			return "fcm\x00" + no.To + "\x00" + strings.Join(no.RegistrationIDs, ",") + "\x00" + no.CollapseKey
+		}
+	case fcmv1.Payload:
+		if a := no.Message.Android; a != nil && a.CollapseKey != "" && no.Message.Token != "" {
+			return "fcmv1\x00" + no.Message.Token + "\x00" + a.CollapseKey
+		}
+	}
+	return ""
+}
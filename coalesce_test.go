@@ -0,0 +1,161 @@
+package gunfish
+
+import (
+	"bytes"
+	"fmt"
+	"strings"
+	"sync/atomic"
+	"testing"
+
+	"firebase.google.com/go/messaging"
+	"github.com/kayac/Gunfish/apns"
+	"github.com/kayac/Gunfish/audit"
+	"github.com/kayac/Gunfish/fcm"
+	"github.com/kayac/Gunfish/fcmv1"
+)
+
+func apnsRequest(token, collapseID string, badge int) Request {
+	return Request{Notification: apns.Notification{
+		Token:   token,
+		Header:  apns.Header{ApnsCollapseID: collapseID},
+		Payload: apns.Payload{APS: &apns.APS{Badge: badge}},
+	}}
+}
+
+func badgeOf(req Request) int {
+	return req.Notification.(apns.Notification).Payload.APS.Badge
+}
+
+func TestCoalesce(t *testing.T) {
+	c := newCoalescer()
+	var queue []Request
+	enqueue := func(reqs []Request) bool {
+		queue = append(queue, reqs...)
+		return true
+	}
+
+	replaced, _ := c.coalesce([]Request{
+		apnsRequest("aaa", "unread", 1),
+		apnsRequest("aaa", "unread", 2),
+		apnsRequest("bbb", "unread", 1),
+		apnsRequest("aaa", "", 1),
+	}, enqueue)
+	if len(replaced) != 1 || badgeOf(replaced[0]) != 1 || len(queue) != 3 {
+		t.Fatalf("unexpected coalescing: %d replaced, %d queued", len(replaced), len(queue))
+	}
+	replaced, _ = c.coalesce([]Request{apnsRequest("aaa", "unread", 3)}, enqueue)
+	if len(replaced) != 1 || badgeOf(replaced[0]) != 2 || len(queue) != 3 {
+		t.Fatalf("unexpected coalescing: %d replaced, %d queued", len(replaced), len(queue))
+	}
+
+	// the latest one is sent
+	if req := c.take(queue[0]); badgeOf(req) != 3 || req.slot != nil {
+		t.Errorf("unexpected request: %#v", req)
+	}
+	// not coalesced after it is taken
+	replaced, _ = c.coalesce([]Request{apnsRequest("aaa", "unread", 4)}, enqueue)
+	if len(replaced) != 0 || len(queue) != 4 {
+		t.Errorf("coalesced with a taken request")
+	}
+
+	// reverted when the queue is full
+	replaced, ok := c.coalesce([]Request{apnsRequest("bbb", "unread", 5), apnsRequest("ccc", "unread", 1)}, func([]Request) bool {
+		return false
+	})
+	if ok || replaced != nil {
+		t.Errorf("unexpected result: %v %v", replaced, ok)
+	}
+	if req := c.take(queue[1]); badgeOf(req) != 1 {
+		t.Errorf("replacement is not reverted: %d", badgeOf(req))
+	}
+	if _, ok := c.slots[collapseKey(apnsRequest("ccc", "unread", 1).Notification)]; ok {
+		t.Error("slot is not removed")
+	}
+
+	// reverted to the queued one when a batch replaces it twice
+	replaced, ok = c.coalesce([]Request{
+		apnsRequest("aaa", "unread", 5),
+		apnsRequest("aaa", "unread", 6),
+		apnsRequest("ddd", "unread", 1),
+	}, func([]Request) bool {
+		return false
+	})
+	if ok || replaced != nil {
+		t.Errorf("unexpected result: %v %v", replaced, ok)
+	}
+	if req := c.take(queue[3]); badgeOf(req) != 4 {
+		t.Errorf("replacement is not reverted: %d", badgeOf(req))
+	}
+}
+
+func TestCollapseKey(t *testing.T) {
+	android := &messaging.AndroidConfig{CollapseKey: "unread"}
+	for _, n := range []Notification{
+		apns.Notification{Token: "aaa"},
+		fcm.Payload{To: "aaa"},
+		fcmv1.Payload{Message: messaging.Message{Token: "aaa"}},
+		fcmv1.Payload{Message: messaging.Message{Topic: "news", Android: android}},
+	} {
+		if k := collapseKey(n); k != "" {
+			t.Errorf("%#v must not have a collapse key: %q", n, k)
+		}
+	}
+	keys := map[string]bool{}
+	for _, n := range []Notification{
+		apns.Notification{Token: "aaa", Header: apns.Header{ApnsCollapseID: "unread"}},
+		apns.Notification{Token: "bbb", Header: apns.Header{ApnsCollapseID: "unread"}},
+		fcm.Payload{To: "aaa", CollapseKey: "unread"},
+		fcm.Payload{RegistrationIDs: []string{"aaa", "bbb"}, CollapseKey: "unread"},
+		fcm.Payload{RegistrationIDs: []string{"aaa"}, CollapseKey: "unread"},
+		fcmv1.Payload{Message: messaging.Message{Token: "aaa", Android: android}},
+	} {
+		k := collapseKey(n)
+		if k == "" || keys[k] {
+			t.Errorf("unexpected collapse key of %#v: %q", n, k)
+		}
+		keys[k] = true
+	}
+}
+
+func TestEnqueueCoalesced(t *testing.T) {
+	var b bytes.Buffer
+	al, err := audit.New(&b, audit.FormatLTSV, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := Supervisor{
+		queue:     make(chan *[]Request, 2),
+		memory:    &memoryBudget{},
+		inflight:  &inFlight{},
+		coalescer: newCoalescer(),
+		audit:     al,
+	}
+	before := atomic.LoadInt64(&srvStats.CoalescedCount)
+	for i := 1; i <= 3; i++ {
+		reqs := []Request{apnsRequest("aaa", "unread", i)}
+		reqs[0].Caller = map[string]string{"remote_addr": fmt.Sprintf("192.0.2.%d", i)}
+		setSize(reqs, 100)
+		if err := s.EnqueueClientRequest(&reqs); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if n := atomic.LoadInt64(&srvStats.CoalescedCount) - before; n != 2 {
+		t.Errorf("coalesced %d notifications, want 2", n)
+	}
+	// the replaced ones are recorded with their callers
+	records := strings.Split(strings.TrimSpace(b.String()), "\n")
+	for i, r := range records {
+		if !strings.Contains(r, "\treason:"+audit.ReasonCoalesced+"\t") || !strings.Contains(r, fmt.Sprintf("caller.remote_addr:192.0.2.%d", i+1)) {
+			t.Errorf("unexpected record: %s", r)
+		}
+	}
+	if len(records) != 2 {
+		t.Errorf("unexpected records: %s", b.String())
+	}
+	if len(s.queue) != 1 || s.memory.load() != 100 || s.inflight.load() != 1 {
+		t.Errorf("unexpected queue: %d requests, %d bytes, %d in flight", len(s.queue), s.memory.load(), s.inflight.load())
+	}
+	if req := s.coalescer.take((*<-s.queue)[0]); badgeOf(req) != 3 {
+		t.Errorf("unexpected badge: %d", badgeOf(req))
+	}
+}
@@ -7,9 +7,11 @@ import (
 	"encoding/json"
 	"fmt"
 	"io/ioutil"
+	"net/url"
 	"time"
 
 	"github.com/kayac/Gunfish/fcmv1"
+	"github.com/kayac/Gunfish/logger"
 	goconf "github.com/kayac/go-config"
 	"github.com/pkg/errors"
 	"golang.org/x/oauth2"
@@ -18,13 +20,14 @@ import (
 
 // Limit values
 const (
-	MaxWorkerNum           = 119   // Maximum of worker number
-	MinWorkerNum           = 1     // Minimum of worker number
-	MaxQueueSize           = 40960 // Maximum queue size.
-	MinQueueSize           = 128   // Minimum Queue size.
-	MaxRequestSize         = 5000  // Maximum of requset count.
-	MinRequestSize         = 1     // Minimum of request size.
-	LimitApnsTokenByteSize = 100   // Payload byte size.
+	MaxWorkerNum           = 119      // Maximum of worker number
+	MinWorkerNum           = 1        // Minimum of worker number
+	MaxQueueSize           = 40960    // Maximum queue size.
+	MinQueueSize           = 128      // Minimum Queue size.
+	MaxRequestSize         = 5000     // Maximum of requset count.
+	MinRequestSize         = 1        // Minimum of request size.
+	MaxQueuedNotifications = 10000000 // Maximum of queue_size * max_request_size.
+	LimitApnsTokenByteSize = 100      // Payload byte size.
 )
 
 const (
@@ -34,6 +37,14 @@ const (
 	DefaultPort = 8003
 	// Default supervisor's queue size. If not configures at file, this value is set.
 	DefaultQueueSize = 1000
+	// Default number of workers. If not configures at file, this value is set.
+	DefaultWorkerNum = 8
+	// Default limit of simultaneous connections to the provider server.
+	DefaultMaxConnections = 2000
+	// Default time to wait for in-flight notifications at shutdown.
+	DefaultShutdownTimeout = 2 * time.Minute
+	// Default interval of logs of repeated warnings, like full queues.
+	DefaultThrottleInterval = 10 * time.Second
 )
 
 // Config is the configure of an APNS provider server
@@ -42,6 +53,14 @@ type Config struct {
 	Provider SectionProvider `toml:"provider"`
 	FCM      SectionFCM      `toml:"fcm"`
 	FCMv1    SectionFCMv1    `toml:"fcm_v1"`
+	Chaos    SectionChaos    `toml:"chaos"`
+	Sandbox  SectionSandbox  `toml:"sandbox"`
+	Audit    SectionAudit    `toml:"audit"`
+	Log      SectionLog      `toml:"log"`
+
+	// Logger writes logs of the supervisor and the provider started with the config.
+	// The logger set by gunfish.SetLogger is used when nil.
+	Logger logger.Logger `toml:"-"`
 }
 
 // SectionProvider is Gunfish provider configuration
@@ -51,8 +70,12 @@ type SectionProvider struct {
 	RequestQueueSize int `toml:"max_request_size"`
 	Port             int `toml:"port"`
 	DebugPort        int
-	MaxConnections   int    `toml:"max_connections"`
-	ErrorHook        string `toml:"error_hook"`
+	MaxConnections   int      `toml:"max_connections"`
+	ErrorHook        string   `toml:"error_hook"`
+	ShutdownTimeout  Duration `toml:"shutdown_timeout"`
+	Passthrough      bool     `toml:"passthrough"`      // sends posted payloads of APNs and FCM v1 as is
+	MaxQueueMemory   int64    `toml:"max_queue_memory"` // megabytes of queued notifications, unlimited when 0
+	Coalesce         bool     `toml:"coalesce"`         // replaces queued notifications with newer ones of the same collapse key
 }
 
 // SectionApns is the configure which is loaded from gunfish.toml
@@ -68,18 +91,73 @@ type SectionApns struct {
 
 // SectionFCM is the configuration of fcm
 type SectionFCM struct {
-	APIKey  string `toml:"api_key"`
-	Enabled bool
+	APIKey   string `toml:"api_key"`
+	Endpoint string `toml:"endpoint"`
+	Enabled  bool
 }
 
 // SectionFCMv1 is the configuration of fcm/v1
 type SectionFCMv1 struct {
 	GoogleApplicationCredentials string `toml:"google_application_credentials"`
+	Endpoint                     string `toml:"endpoint"`
 	Enabled                      bool
 	ProjectID                    string
 	TokenSource                  oauth2.TokenSource
 }
 
+// SectionChaos is the configuration of fault injection into provider clients and hooks.
+// It is for resilience testing and must not be enabled in production.
+type SectionChaos struct {
+	Enabled         bool     `toml:"enabled"`
+	Seed            int64    `toml:"seed"`
+	Latency         Duration `toml:"latency"`
+	LatencyRate     float64  `toml:"latency_rate"`
+	ErrorRate       float64  `toml:"error_rate"`
+	Timeout         Duration `toml:"timeout"`
+	TimeoutRate     float64  `toml:"timeout_rate"`
+	DropRate        float64  `toml:"drop_rate"`
+	HookLatency     Duration `toml:"hook_latency"`
+	HookLatencyRate float64  `toml:"hook_latency_rate"`
+	HookErrorRate   float64  `toml:"hook_error_rate"`
+}
+
+// SectionSandbox is the configuration of sandbox mode, which stores notifications in memory instead of sending them.
+// It is for staging environments and must not be enabled in production.
+type SectionSandbox struct {
+	Enabled     bool `toml:"enabled"`
+	MaxMessages int  `toml:"max_messages"`
+}
+
+// SectionAudit is the configuration of the delivery event log, which records the outcome of each notification.
+type SectionAudit struct {
+	Enabled        bool     `toml:"enabled"`
+	Output         string   `toml:"output"`   // file path, or "stdout"
+	Format         string   `toml:"format"`   // json or ltsv
+	MaxSize        int64    `toml:"max_size"` // megabytes
+	RotateInterval Duration `toml:"rotate_interval"`
+	MaxBackups     int      `toml:"max_backups"`
+	MaxAge         Duration `toml:"max_age"`
+	CallerHeaders  []string `toml:"caller_headers"`
+}
+
+// SectionLog is the configuration of logs under load.
+type SectionLog struct {
+	ThrottleInterval Duration `toml:"throttle_interval"` // aggregates repeated warnings, like full queues, into a log per the interval, 10s by default and negative to disable
+	SuccessSampling  int      `toml:"success_sampling"`  // writes one of every N logs of succeeded notifications
+}
+
+// Duration is a time.Duration which is written as a string like "100ms" in a config file.
+type Duration struct {
+	time.Duration
+}
+
+// UnmarshalText parses a duration string.
+func (d *Duration) UnmarshalText(text []byte) error {
+	var err error
+	d.Duration, err = time.ParseDuration(string(text))
+	return err
+}
+
 // DefaultLoadConfig loads default /etc/gunfish.toml
 func DefaultLoadConfig() (Config, error) {
 	return LoadConfig("/etc/gunfish/gunfish.toml")
@@ -106,6 +184,22 @@ func LoadConfig(fn string) (Config, error) {
 		config.Provider.Port = DefaultPort
 	}
 
+	if config.Provider.WorkerNum == 0 {
+		config.Provider.WorkerNum = DefaultWorkerNum
+	}
+
+	if config.Provider.MaxConnections == 0 {
+		config.Provider.MaxConnections = DefaultMaxConnections
+	}
+
+	if config.Provider.ShutdownTimeout.Duration == 0 {
+		config.Provider.ShutdownTimeout.Duration = DefaultShutdownTimeout
+	}
+
+	if config.Log.ThrottleInterval.Duration == 0 {
+		config.Log.ThrottleInterval.Duration = DefaultThrottleInterval
+	}
+
 	// validates config parameters
 	if err := (&config).validateConfig(); err != nil {
 		return config, errors.Wrap(err, "validate config failed")
@@ -136,33 +230,117 @@ func (c *Config) validateConfig() error {
 			return errors.Wrap(err, "[fcm_v1]")
 		}
 	}
+	if c.Chaos.Enabled {
+		if err := c.validateConfigChaos(); err != nil {
+			return errors.Wrap(err, "[chaos]")
+		}
+	}
+	if c.Sandbox.Enabled && c.Sandbox.MaxMessages < 0 {
+		return errors.Wrap(fmt.Errorf("max_messages must not be negative: %d", c.Sandbox.MaxMessages), "[sandbox]")
+	}
+	if c.Audit.Enabled {
+		if err := c.validateConfigAudit(); err != nil {
+			return errors.Wrap(err, "[audit]")
+		}
+	}
+	if c.Log.SuccessSampling < 0 {
+		return errors.Wrap(fmt.Errorf("success_sampling must not be negative: %d", c.Log.SuccessSampling), "[log]")
+	}
 	return nil
 }
 
 func (c *Config) validateConfigProvider() error {
 	if c.Provider.RequestQueueSize < MinRequestSize || c.Provider.RequestQueueSize > MaxRequestSize {
-		return fmt.Errorf("MaxRequestSize was out of available range: %d. (%d-%d)", c.Provider.RequestQueueSize,
+		return fmt.Errorf("max_request_size was out of available range: %d. (%d-%d)", c.Provider.RequestQueueSize,
 			MinRequestSize, MaxRequestSize)
 	}
 
 	if c.Provider.QueueSize < MinQueueSize || c.Provider.QueueSize > MaxQueueSize {
-		return fmt.Errorf("QueueSize was out of available range: %d. (%d-%d)", c.Provider.QueueSize,
+		return fmt.Errorf("queue_size was out of available range: %d. (%d-%d)", c.Provider.QueueSize,
 			MinQueueSize, MaxQueueSize)
 	}
 
 	if c.Provider.WorkerNum < MinWorkerNum || c.Provider.WorkerNum > MaxWorkerNum {
-		return fmt.Errorf("WorkerNum was out of available range: %d. (%d-%d)", c.Provider.WorkerNum,
+		return fmt.Errorf("worker_num was out of available range: %d. (%d-%d)", c.Provider.WorkerNum,
 			MinWorkerNum, MaxWorkerNum)
 	}
 
+	if c.Provider.Port < 1 || c.Provider.Port > 65535 {
+		return fmt.Errorf("port was out of available range: %d. (1-65535)", c.Provider.Port)
+	}
+
+	if c.Provider.ShutdownTimeout.Duration < 0 {
+		return fmt.Errorf("shutdown_timeout must not be negative: %s", c.Provider.ShutdownTimeout.Duration)
+	}
+
+	if c.Provider.MaxQueueMemory < 0 {
+		return fmt.Errorf("max_queue_memory must not be negative: %d", c.Provider.MaxQueueMemory)
+	}
+
+	if c.Provider.MaxConnections < 1 {
+		return fmt.Errorf("max_connections must be a positive number: %d", c.Provider.MaxConnections)
+	}
+
+	// Each slot of the supervisor's queue holds a request of up to max_request_size notifications.
+	if n := c.Provider.QueueSize * c.Provider.RequestQueueSize; n > MaxQueuedNotifications {
+		return fmt.Errorf("queue_size * max_request_size was too large: %d * %d = %d. (<= %d)",
+			c.Provider.QueueSize, c.Provider.RequestQueueSize, n, MaxQueuedNotifications)
+	}
+
+	return nil
+}
+
+func (c *Config) validateConfigChaos() error {
+	rates := map[string]float64{
+		"latency_rate":      c.Chaos.LatencyRate,
+		"error_rate":        c.Chaos.ErrorRate,
+		"timeout_rate":      c.Chaos.TimeoutRate,
+		"drop_rate":         c.Chaos.DropRate,
+		"hook_latency_rate": c.Chaos.HookLatencyRate,
+		"hook_error_rate":   c.Chaos.HookErrorRate,
+	}
+	for name, rate := range rates {
+		if rate < 0 || rate > 1 {
+			return fmt.Errorf("%s was out of available range: %g. (0-1)", name, rate)
+		}
+	}
+	if c.Chaos.Latency.Duration < 0 || c.Chaos.Timeout.Duration < 0 || c.Chaos.HookLatency.Duration < 0 {
+		return fmt.Errorf("durations must not be negative")
+	}
+	return nil
+}
+
+func (c *Config) validateConfigAudit() error {
+	switch c.Audit.Format {
+	case "", "json", "ltsv":
+	default:
+		return fmt.Errorf("format must be json or ltsv: %s", c.Audit.Format)
+	}
+	if c.Audit.MaxSize < 0 || c.Audit.MaxBackups < 0 {
+		return fmt.Errorf("max_size and max_backups must not be negative")
+	}
+	if c.Audit.RotateInterval.Duration < 0 || c.Audit.MaxAge.Duration < 0 {
+		return fmt.Errorf("durations must not be negative")
+	}
 	return nil
 }
 
 func (c *Config) validateConfigFCM() error {
+	if c.FCM.Endpoint != "" {
+		if _, err := url.Parse(c.FCM.Endpoint); err != nil {
+			return fmt.Errorf("endpoint is invalid: %s", err)
+		}
+	}
 	return nil
 }
 
 func (c *Config) validateConfigFCMv1() error {
+	if c.FCMv1.Endpoint != "" {
+		if _, err := url.Parse(c.FCMv1.Endpoint); err != nil {
+			return fmt.Errorf("endpoint is invalid: %s", err)
+		}
+	}
+
 	b, err := ioutil.ReadFile(c.FCMv1.GoogleApplicationCredentials)
 	if err != nil {
 		return err
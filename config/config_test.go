@@ -1,8 +1,11 @@
 package config
 
 import (
+	"io/ioutil"
 	"os"
+	"strings"
 	"testing"
+	"time"
 )
 
 func TestLoadTomlConfigFile(t *testing.T) {
@@ -19,3 +22,103 @@ func TestLoadTomlConfigFile(t *testing.T) {
 		t.Errorf("not match error hook: got %s want %s", g, w)
 	}
 }
+
+func TestLoadConfigDefaults(t *testing.T) {
+	f, err := ioutil.TempFile("", "gunfish_test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(f.Name())
+	if _, err := f.WriteString("[provider]\n"); err != nil {
+		t.Fatal(err)
+	}
+	f.Close()
+
+	c, err := LoadConfig(f.Name())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if g, w := c.Provider.WorkerNum, DefaultWorkerNum; g != w {
+		t.Errorf("unexpected worker_num: got %d want %d", g, w)
+	}
+	if g, w := c.Provider.MaxConnections, DefaultMaxConnections; g != w {
+		t.Errorf("unexpected max_connections: got %d want %d", g, w)
+	}
+	if g, w := c.Provider.QueueSize, DefaultQueueSize; g != w {
+		t.Errorf("unexpected queue_size: got %d want %d", g, w)
+	}
+	if g, w := c.Provider.RequestQueueSize, DefaultRequestQueueSize; g != w {
+		t.Errorf("unexpected max_request_size: got %d want %d", g, w)
+	}
+	if g, w := c.Provider.Port, DefaultPort; g != w {
+		t.Errorf("unexpected port: got %d want %d", g, w)
+	}
+	if g, w := c.Log.ThrottleInterval.Duration, DefaultThrottleInterval; g != w {
+		t.Errorf("unexpected throttle_interval: got %s want %s", g, w)
+	}
+}
+
+func TestValidateConfigProvider(t *testing.T) {
+	valid := SectionProvider{
+		WorkerNum:        8,
+		QueueSize:        DefaultQueueSize,
+		RequestQueueSize: DefaultRequestQueueSize,
+		Port:             DefaultPort,
+		MaxConnections:   DefaultMaxConnections,
+	}
+
+	testTable := []struct {
+		modify func(p *SectionProvider)
+		key    string
+	}{
+		{func(p *SectionProvider) { p.WorkerNum = 0 }, "worker_num"},
+		{func(p *SectionProvider) { p.WorkerNum = MaxWorkerNum + 1 }, "worker_num"},
+		{func(p *SectionProvider) { p.QueueSize = MinQueueSize - 1 }, "queue_size"},
+		{func(p *SectionProvider) { p.RequestQueueSize = MaxRequestSize + 1 }, "max_request_size"},
+		{func(p *SectionProvider) { p.Port = 70000 }, "port"},
+		{func(p *SectionProvider) { p.MaxConnections = -1 }, "max_connections"},
+		{func(p *SectionProvider) { p.QueueSize, p.RequestQueueSize = MaxQueueSize, MaxRequestSize }, "queue_size * max_request_size"},
+	}
+
+	c := Config{Provider: valid}
+	if err := c.validateConfigProvider(); err != nil {
+		t.Errorf("unexpected error: %s", err)
+	}
+
+	for _, tt := range testTable {
+		c := Config{Provider: valid}
+		tt.modify(&c.Provider)
+		err := c.validateConfigProvider()
+		if err == nil {
+			t.Errorf("expected error for %s: %#v", tt.key, c.Provider)
+			continue
+		}
+		if !strings.HasPrefix(err.Error(), tt.key) {
+			t.Errorf("error message should name %s: %s", tt.key, err)
+		}
+	}
+}
+
+func TestLoadChaosConfig(t *testing.T) {
+	f, err := ioutil.TempFile("", "gunfish_test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(f.Name())
+	f.WriteString("[provider]\n[chaos]\nenabled = true\nlatency = \"150ms\"\nlatency_rate = 0.5\ndrop_rate = 0.1\n")
+	f.Close()
+
+	c, err := LoadConfig(f.Name())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !c.Chaos.Enabled || c.Chaos.Latency.Duration != 150*time.Millisecond || c.Chaos.LatencyRate != 0.5 || c.Chaos.DropRate != 0.1 {
+		t.Errorf("unexpected chaos config: %#v", c.Chaos)
+	}
+
+	c.Chaos.ErrorRate = 1.5
+	if err := c.validateConfigChaos(); err == nil {
+		t.Error("error_rate over 1 must be invalid")
+	}
+}
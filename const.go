@@ -33,6 +33,8 @@ const (
 	// Wait millisecond interval when to shutdown.
 	ShutdownWaitTime = time.Millisecond * 10
 	// That is the count while request counter is 0 in the 'ShutdownWaitTime' period.
+	//
+	// Deprecated: Shutdown waits until no notification is in flight, up to shutdown_timeout of the configuration.
 	RestartWaitCount = 50
 )
 
@@ -60,6 +62,20 @@ const (
 	Disable
 )
 
+// APNsHost returns the APNs endpoint of the environment.
+// It returns an empty string when the environment has no endpoint.
+func (env Environment) APNsHost() string {
+	switch env {
+	case Production:
+		return ProdServer
+	case Development:
+		return DevServer
+	case Test:
+		return MockServer
+	}
+	return ""
+}
+
 // Alert fields mapping
 var (
 	AlertKeyToField = map[string]string{
@@ -0,0 +1,294 @@
+package gunfish_test
+
+import (
+	"bytes"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"encoding/json"
+	"encoding/pem"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"testing"
+	"time"
+
+	"firebase.google.com/go/messaging"
+	gunfish "github.com/kayac/Gunfish"
+	"github.com/kayac/Gunfish/apns"
+	"github.com/kayac/Gunfish/clock"
+	"github.com/kayac/Gunfish/config"
+	"github.com/kayac/Gunfish/fcm"
+	"github.com/kayac/Gunfish/fcmv1"
+	"github.com/kayac/Gunfish/mock"
+	"golang.org/x/oauth2"
+)
+
+var update = flag.Bool("update", false, "update golden files of contract tests")
+
+const goldenDir = "testdata/contract"
+
+// JWT signatures of ES256 are random, so they are replaced.
+var jwtSignature = regexp.MustCompile(`(Authorization: bearer [\w-]+\.[\w-]+)\.[\w-]+`)
+
+func assertGolden(t *testing.T, name string, reqs []mock.RecordedRequest) {
+	t.Helper()
+	var b bytes.Buffer
+	for _, r := range reqs {
+		b.WriteString(jwtSignature.ReplaceAllString(r.String(), "$1.<signature>"))
+	}
+	file := filepath.Join(goldenDir, name+".golden")
+	if *update {
+		if err := os.MkdirAll(goldenDir, 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := ioutil.WriteFile(file, b.Bytes(), 0644); err != nil {
+			t.Fatal(err)
+		}
+		return
+	}
+	golden, err := ioutil.ReadFile(file)
+	if err != nil {
+		t.Fatalf("%s (run go test -run Contract -update to create it)", err)
+	}
+	if !bytes.Equal(b.Bytes(), golden) {
+		t.Errorf("%s: request is changed:\n--- got\n%s\n--- want\n%s", name, b.String(), golden)
+	}
+}
+
+func TestContractAPNs(t *testing.T) {
+	apns.Clock = clock.NewFake(time.Date(2020, 1, 1, 12, 10, 0, 0, time.UTC))
+	defer func() { apns.Clock = clock.Real }()
+
+	dir, err := ioutil.TempDir("", "gunfish-contract")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	certFile, keyFile, err := mock.WriteCertificate(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	key, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	der, _ := x509.MarshalPKCS8PrivateKey(key)
+	p8 := filepath.Join(dir, "key.p8")
+	if err := ioutil.WriteFile(p8, pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: der}), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	clients := map[string]config.SectionApns{
+		"cert":  {Host: gunfish.ProdServer, CertFile: certFile, KeyFile: keyFile},
+		"token": {Host: gunfish.ProdServer, KeyFile: p8, Kid: "ABC123DEFG", TeamID: "DEF123GHIJ"},
+	}
+	testCases := []struct {
+		name   string
+		client string
+		n      apns.Notification
+	}{
+		{
+			name:   "alert_string",
+			client: "cert",
+			n: apns.Notification{
+				Token:   "a1b2c3",
+				Payload: apns.Payload{APS: &apns.APS{Alert: "Hello", Sound: "default", Badge: 1}},
+			},
+		},
+		{
+			name:   "alert_dictionary",
+			client: "token",
+			n: apns.Notification{
+				Token: "a1b2c3",
+				Header: apns.Header{
+					ApnsID:         "123e4567-e89b-12d3-a456-426655440000",
+					ApnsExpiration: "1577880000",
+					ApnsPriority:   "10",
+					ApnsTopic:      "com.example.app",
+					ApnsPushType:   "alert",
+				},
+				Payload: apns.Payload{
+					APS: &apns.APS{
+						Alert: apns.Alert{
+							Title:        "Title",
+							Body:         "Body",
+							TitleLocKey:  "TITLE_KEY",
+							TitleLocArgs: []string{"a", "b"},
+							ActionLocKey: "ACTION_KEY",
+							LocKey:       "BODY_KEY",
+							LocArgs:      []string{"c"},
+							LaunchImage:  "launch.png",
+						},
+						Category:        "MESSAGE",
+						ThreadID:        "thread-1",
+						MutableContent:  1,
+						TargetContentID: "window-1",
+					},
+					Optional: map[string]interface{}{"uid": 12345, "extra": map[string]interface{}{"k": "v"}},
+				},
+			},
+		},
+		{
+			name:   "background",
+			client: "token",
+			n: apns.Notification{
+				Token:   "d4e5f6",
+				Header:  apns.Header{ApnsTopic: "com.example.app", ApnsPushType: "background", ApnsPriority: "5"},
+				Payload: apns.Payload{APS: &apns.APS{ContentAvailable: 1}},
+			},
+		},
+	}
+
+	for _, c := range testCases {
+		ac, err := apns.NewClient(clients[c.client])
+		if err != nil {
+			t.Fatal(err)
+		}
+		tr := &mock.RecordingTransport{
+			Response: func(req *http.Request) *http.Response {
+				resp := mock.JSONResponse(http.StatusOK, "")
+				resp.Header.Set("apns-id", "123e4567-e89b-12d3-a456-426655440000")
+				return resp
+			},
+		}
+		ac.HTTPClient().Transport = tr
+		if _, err := ac.Send(c.n); err != nil {
+			t.Errorf("%s: %s", c.name, err)
+		}
+		assertGolden(t, "apns_"+c.name, tr.Requests())
+	}
+}
+
+func TestContractFCM(t *testing.T) {
+	data := fcm.Data{"message": "hello", "count": 1}
+	testCases := []struct {
+		name string
+		p    fcm.Payload
+	}{
+		{
+			name: "to_notification",
+			p: fcm.Payload{
+				To: "token-1",
+				Notification: &fcm.Notification{
+					Title:       "Title",
+					Body:        "Body",
+					Icon:        "icon",
+					Sound:       "default",
+					Badge:       "1",
+					Tag:         "tag",
+					Color:       "#ff0000",
+					ClickAction: "OPEN",
+				},
+			},
+		},
+		{
+			name: "registration_ids_data",
+			p: fcm.Payload{
+				RegistrationIDs:       []string{"token-1", "token-2"},
+				CollapseKey:           "updates",
+				Priority:              "high",
+				ContentAvailable:      true,
+				TimeToLive:            3600,
+				RestrictedPackageName: "com.example.app",
+				DryRun:                true,
+				Data:                  &data,
+			},
+		},
+	}
+
+	fc, err := fcm.NewClient("API_KEY", nil, fcm.ClientTimeout)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tr := &mock.RecordingTransport{
+		Response: func(req *http.Request) *http.Response {
+			var p fcm.Payload
+			json.NewDecoder(req.Body).Decode(&p)
+			n := len(p.RegistrationIDs)
+			if n == 0 {
+				n = 1
+			}
+			results := strings.Repeat(`{"message_id":"1"},`, n)
+			return mock.JSONResponse(http.StatusOK, fmt.Sprintf(`{"multicast_id":1,"success":%d,"failure":0,"results":[%s]}`, n, strings.TrimSuffix(results, ",")))
+		},
+	}
+	fc.Client.Transport = tr
+	for _, c := range testCases {
+		tr.Reset()
+		if _, err := fc.Send(c.p); err != nil {
+			t.Errorf("%s: %s", c.name, err)
+		}
+		assertGolden(t, "fcm_"+c.name, tr.Requests())
+	}
+}
+
+func TestContractFCMv1(t *testing.T) {
+	ttl := time.Hour
+	badge := 3
+	testCases := []struct {
+		name string
+		p    fcmv1.Payload
+	}{
+		{
+			name: "token_notification",
+			p: fcmv1.Payload{Message: messaging.Message{
+				Token:        "token-1",
+				Notification: &messaging.Notification{Title: "Title", Body: "Body", ImageURL: "https://example.com/image.png"},
+				Data:         map[string]string{"message": "hello"},
+			}},
+		},
+		{
+			name: "topic_platforms",
+			p: fcmv1.Payload{Message: messaging.Message{
+				Topic: "news",
+				Android: &messaging.AndroidConfig{
+					CollapseKey: "updates",
+					Priority:    "high",
+					TTL:         &ttl,
+					Notification: &messaging.AndroidNotification{
+						Title:     "Title",
+						Body:      "Body",
+						ChannelID: "channel",
+					},
+				},
+				APNS: &messaging.APNSConfig{
+					Headers: map[string]string{"apns-priority": "10"},
+					Payload: &messaging.APNSPayload{
+						Aps:        &messaging.Aps{Alert: &messaging.ApsAlert{Title: "Title", Body: "Body"}, Badge: &badge, Sound: "default"},
+						CustomData: map[string]interface{}{"uid": "12345"},
+					},
+				},
+			}},
+		},
+		{
+			name: "condition",
+			p: fcmv1.Payload{Message: messaging.Message{
+				Condition: "'news' in topics && 'sports' in topics",
+				Data:      map[string]string{"message": "hello"},
+			}},
+		},
+	}
+
+	ts := oauth2.StaticTokenSource(&oauth2.Token{AccessToken: "ya29.access-token"})
+	fc, err := fcmv1.NewClient(ts, "gunfish-test", nil, fcmv1.ClientTimeout)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tr := &mock.RecordingTransport{
+		Response: func(req *http.Request) *http.Response {
+			return mock.JSONResponse(http.StatusOK, `{"name":"projects/gunfish-test/messages/1"}`)
+		},
+	}
+	fc.Client.Transport = tr
+	for _, c := range testCases {
+		tr.Reset()
+		if _, err := fc.Send(c.p); err != nil {
+			t.Errorf("%s: %s", c.name, err)
+		}
+		assertGolden(t, "fcmv1_"+c.name, tr.Requests())
+	}
+}
@@ -31,7 +31,19 @@ func (c *Client) Send(p Payload) ([]Result, error) {
 	if err != nil {
 		return nil, err
 	}
+	return c.do(req, p.Message.Token)
+}
+
+// SendRaw sends the encoded JSON payload as is. p is used only for the token of results.
+func (c *Client) SendRaw(p Payload, payload []byte) ([]Result, error) {
+	req, err := c.NewRawRequest(payload)
+	if err != nil {
+		return nil, err
+	}
+	return c.do(req, p.Message.Token)
+}
 
+func (c *Client) do(req *http.Request, token string) ([]Result, error) {
 	res, err := c.Client.Do(req)
 	if err != nil {
 		return nil, err
@@ -48,14 +60,15 @@ func (c *Client) Send(p Payload) ([]Result, error) {
 		return []Result{
 			Result{
 				StatusCode: res.StatusCode,
-				Token:      p.Message.Token,
+				Token:      token,
+				Name:       body.Name,
 			},
 		}, nil
 	} else if body.Error != nil {
 		return []Result{
 			Result{
 				StatusCode: res.StatusCode,
-				Token:      p.Message.Token,
+				Token:      token,
 				Error:      body.Error,
 			},
 		}, nil
@@ -70,6 +83,11 @@ func (c *Client) NewRequest(p Payload) (*http.Request, error) {
 	if err != nil {
 		return nil, err
 	}
+	return c.NewRawRequest(data)
+}
+
+// NewRawRequest creates request for fcm with the encoded JSON payload.
+func (c *Client) NewRawRequest(data []byte) (*http.Request, error) {
 	token, err := c.tokenSource.Token()
 	if err != nil {
 		return nil, err
@@ -1,6 +1,8 @@
 package fcmv1
 
 import (
+	"encoding/json"
+
 	"firebase.google.com/go/messaging"
 )
 
@@ -9,5 +11,13 @@ type Payload struct {
 	Message messaging.Message `json:"message"`
 }
 
+// MarshalJSON for Payload struct.
+// messaging.Message implements json.Marshaler with a pointer receiver, so Topic is lost when Payload is marshaled as a value.
+func (p Payload) MarshalJSON() ([]byte, error) {
+	return json.Marshal(struct {
+		Message *messaging.Message `json:"message"`
+	}{&p.Message})
+}
+
 // MaxBulkRequests represens max count of request payloads in a request body.
 const MaxBulkRequests = 500
@@ -2,7 +2,11 @@ package fcmv1
 
 import (
 	"encoding/json"
+	"reflect"
+	"strings"
 	"testing"
+	"testing/quick"
+	"time"
 
 	"github.com/google/go-cmp/cmp"
 	"firebase.google.com/go/messaging"
@@ -68,3 +72,52 @@ func buildPayloadJSON() string {
   }
 }`
 }
+
+func TestPayloadRoundTrip(t *testing.T) {
+	f := func(data map[string]string, title, body, token, topic, collapseKey string, ttl uint16, headers map[string]string, sound string, badge int) bool {
+		if len(data) == 0 {
+			data = nil
+		}
+		if len(headers) == 0 {
+			headers = nil
+		}
+		d := time.Duration(ttl) * time.Second
+		p := Payload{
+			Message: messaging.Message{
+				Data:         data,
+				Notification: &messaging.Notification{Title: title, Body: body},
+				Android:      &messaging.AndroidConfig{CollapseKey: collapseKey, TTL: &d},
+				APNS: &messaging.APNSConfig{
+					Headers: headers,
+					Payload: &messaging.APNSPayload{
+						Aps: &messaging.Aps{
+							Alert: &messaging.ApsAlert{Title: title, Body: body},
+							Badge: &badge,
+							Sound: sound,
+						},
+					},
+				},
+				Token: token,
+				Topic: strings.TrimPrefix(topic, "/topics/"),
+			},
+		}
+		b, err := json.Marshal(p)
+		if err != nil {
+			t.Log(err)
+			return false
+		}
+		var decoded Payload
+		if err := json.Unmarshal(b, &decoded); err != nil {
+			t.Log(err)
+			return false
+		}
+		if !reflect.DeepEqual(p, decoded) {
+			t.Logf("mismatch decoded payload: %s", b)
+			return false
+		}
+		return true
+	}
+	if err := quick.Check(f, nil); err != nil {
+		t.Error(err)
+	}
+}
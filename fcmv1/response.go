@@ -28,6 +28,7 @@ type Detail struct {
 type Result struct {
 	StatusCode int       `json:"status,omitempty"`
 	Token      string    `json:"token,omitempty"`
+	Name       string    `json:"name,omitempty"` // name of the message accepted by FCM
 	Error      *FCMError `json:"error,omitempty"`
 }
 
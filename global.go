@@ -2,8 +2,14 @@ package gunfish
 
 import (
 	"fmt"
+
+	"github.com/kayac/Gunfish/clock"
 )
 
+// Clock is the source of time of the supervisor, retry and stats.
+// Tests may replace it with clock.Fake.
+var Clock clock.Clock = clock.Real
+
 // Application global variables
 var (
 	srvStats               Stats
@@ -0,0 +1,450 @@
+// Package gunfishtest provides a complete Gunfish with mock APNs and FCM servers for integration tests.
+//
+// A Server runs the supervisor, the HTTP handler of Gunfish and the mock servers in process on
+// ephemeral ports with generated test certificates, and records results passed to the response
+// handlers, hook invocations and requests received by the mock servers.
+//
+// Gunfish keeps response handlers and APNs client transport in package variables,
+// so only one Server can run at a time.
+package gunfishtest
+
+import (
+	"bytes"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	gunfish "github.com/kayac/Gunfish"
+	"github.com/kayac/Gunfish/apns"
+	"github.com/kayac/Gunfish/chaos"
+	"github.com/kayac/Gunfish/config"
+	"github.com/kayac/Gunfish/fcm"
+	"github.com/kayac/Gunfish/fcmv1"
+	"github.com/kayac/Gunfish/mock"
+	"github.com/kayac/Gunfish/sandbox"
+	"golang.org/x/net/http2"
+)
+
+// ProjectID is the project id of FCM v1 of Server.
+const ProjectID = "gunfish-test"
+
+// DefaultTimeout is the default timeout of Wait* methods.
+const DefaultTimeout = time.Second * 10
+
+// Options are options of Server.
+type Options struct {
+	// APNs and FCM are options of the mock servers. FCM is used for both of FCM legacy and v1.
+	// A new Scenario is created when Scenario is nil.
+	APNs mock.Options
+	FCM  mock.Options
+
+	// SuccessHandler and ErrorHandler are response handlers under test.
+	// gunfish.DefaultResponseHandler is used when nil.
+	SuccessHandler gunfish.ResponseHandler
+	ErrorHandler   gunfish.ResponseHandler
+
+	// Config modifies the configuration of Gunfish before starting it.
+	Config func(*config.Config)
+
+	// Timeout of Wait* methods. DefaultTimeout is used when 0.
+	Timeout time.Duration
+}
+
+// Server is Gunfish running with mock servers.
+type Server struct {
+	URL    string // URL of Gunfish, e.g. http://127.0.0.1:12345
+	Config config.Config
+
+	APNs         *httptest.Server
+	FCM          *httptest.Server
+	APNsScenario *mock.Scenario
+	FCMScenario  *mock.Scenario
+
+	// CertFile and KeyFile are the generated certificate of the mock APNs server.
+	// Gunfish uses them as its client certificate, too.
+	CertFile string
+	KeyFile  string
+
+	sup     *gunfish.Supervisor
+	gunfish *httptest.Server
+	dir     string
+	timeout time.Duration
+	restore func()
+
+	mu      sync.Mutex
+	results []gunfish.Result
+}
+
+// NewServer starts Gunfish with mock servers. Close it after use.
+func NewServer(opt Options) (_ *Server, err error) {
+	s := &Server{timeout: opt.Timeout}
+	if s.timeout <= 0 {
+		s.timeout = DefaultTimeout
+	}
+	defer func() {
+		if err != nil {
+			s.Close()
+		}
+	}()
+
+	if s.dir, err = ioutil.TempDir("", "gunfishtest"); err != nil {
+		return nil, err
+	}
+	if err = os.Mkdir(s.hookDir(), 0755); err != nil {
+		return nil, err
+	}
+	if s.CertFile, s.KeyFile, err = mock.WriteCertificate(s.dir); err != nil {
+		return nil, err
+	}
+	ca, err := ioutil.ReadFile(s.CertFile)
+	if err != nil {
+		return nil, err
+	}
+	roots := x509.NewCertPool()
+	roots.AppendCertsFromPEM(ca)
+
+	// mock servers
+	if opt.APNs.Scenario == nil {
+		opt.APNs.Scenario = mock.NewScenario()
+	}
+	s.APNsScenario = opt.APNs.Scenario
+	s.APNs = httptest.NewUnstartedServer(mock.NewAPNsMockServer(opt.APNs))
+	if err = http2.ConfigureServer(s.APNs.Config, nil); err != nil {
+		return nil, err
+	}
+	s.APNs.TLS = s.APNs.Config.TLSConfig
+	s.APNs.TLS.ClientAuth = tls.RequestClientCert
+	cert, err := tls.LoadX509KeyPair(s.CertFile, s.KeyFile)
+	if err != nil {
+		return nil, err
+	}
+	s.APNs.TLS.Certificates = []tls.Certificate{cert}
+	s.APNs.StartTLS()
+
+	if opt.FCM.Scenario == nil {
+		opt.FCM.Scenario = mock.NewScenario()
+	}
+	s.FCMScenario = opt.FCM.Scenario
+	fcmMux := http.NewServeMux()
+	fcmMux.Handle("/fcm/", mock.FCMMockServer(opt.FCM))
+	fcmMux.Handle("/", mock.FCMv1MockServer(opt.FCM))
+	s.FCM = httptest.NewServer(fcmMux)
+
+	// Gunfish
+	if s.Config, err = s.loadConfig(); err != nil {
+		return nil, err
+	}
+	if opt.Config != nil {
+		opt.Config(&s.Config)
+	}
+
+	orig := apns.ClientTransport
+	apns.ClientTransport = func(cert tls.Certificate) *http.Transport {
+		tr := orig(cert)
+		tr.TLSClientConfig.RootCAs = roots
+		return tr
+	}
+	s.restore = func() { apns.ClientTransport = orig }
+
+	if opt.SuccessHandler == nil {
+		opt.SuccessHandler = gunfish.DefaultResponseHandler{}
+	}
+	if opt.ErrorHandler == nil {
+		opt.ErrorHandler = gunfish.DefaultResponseHandler{Hook: s.Config.Provider.ErrorHook}
+	}
+	gunfish.InitSuccessResponseHandler(&recordingHandler{ResponseHandler: opt.SuccessHandler, s: s})
+	gunfish.InitErrorResponseHandler(&recordingHandler{ResponseHandler: opt.ErrorHandler, s: s})
+
+	sup, err := gunfish.StartSupervisor(&s.Config)
+	if err != nil {
+		return nil, err
+	}
+	s.sup = &sup
+	prov := &gunfish.Provider{Sup: sup}
+	s.gunfish = httptest.NewServer(prov.ServeMux(s.Config))
+	s.URL = s.gunfish.URL
+
+	return s, nil
+}
+
+// loadConfig writes a config file for the mock servers and loads it.
+func (s *Server) loadConfig() (config.Config, error) {
+	credentials, err := mock.WriteServiceAccount(s.dir, s.FCM.URL+"/token", ProjectID)
+	if err != nil {
+		return config.Config{}, err
+	}
+
+	toml := fmt.Sprintf(`[provider]
+worker_num = 2
+queue_size = 128
+
+[apns]
+cert_file = %q
+key_file = %q
+
+[fcm]
+api_key = "gunfishtest"
+endpoint = %q
+
+[fcm_v1]
+google_application_credentials = %q
+endpoint = %q
+`,
+		s.CertFile, s.KeyFile,
+		s.FCM.URL+"/fcm/send",
+		credentials, s.FCM.URL+"/v1/projects/"+ProjectID+"/messages:send",
+	)
+	file := filepath.Join(s.dir, "gunfish.toml")
+	if err := ioutil.WriteFile(file, []byte(toml), 0644); err != nil {
+		return config.Config{}, err
+	}
+	conf, err := config.LoadConfig(file)
+	if err != nil {
+		return conf, err
+	}
+	conf.Apns.Host = s.APNs.URL
+	return conf, nil
+}
+
+// Close shuts down Gunfish and the mock servers, and removes generated files.
+func (s *Server) Close() {
+	if s.gunfish != nil {
+		s.gunfish.Close()
+	}
+	if s.sup != nil {
+		s.sup.Shutdown()
+	}
+	if s.APNs != nil {
+		s.APNs.Close()
+	}
+	if s.FCM != nil {
+		s.FCM.Close()
+	}
+	if s.restore != nil {
+		s.restore()
+	}
+	if s.dir != "" {
+		os.RemoveAll(s.dir)
+	}
+}
+
+// PushError is an error response of Gunfish.
+type PushError struct {
+	StatusCode int
+	Body       []byte
+}
+
+func (e *PushError) Error() string {
+	return fmt.Sprintf("status:%d body:%s", e.StatusCode, string(e.Body))
+}
+
+// Post posts body to path of Gunfish as application/json.
+// It returns *PushError when Gunfish does not respond 200 OK.
+func (s *Server) Post(path string, body []byte) error {
+	resp, err := http.Post(s.URL+path, gunfish.ApplicationJSON, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	b, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return err
+	}
+	if resp.StatusCode != http.StatusOK {
+		return &PushError{StatusCode: resp.StatusCode, Body: b}
+	}
+	return nil
+}
+
+// PushAPNs posts notifications to /push/apns.
+func (s *Server) PushAPNs(ds ...gunfish.PostedData) error {
+	b, err := json.Marshal(ds)
+	if err != nil {
+		return err
+	}
+	return s.Post("/push/apns", b)
+}
+
+// PushFCM posts a payload to /push/fcm.
+func (s *Server) PushFCM(p fcm.Payload) error {
+	b, err := json.Marshal(p)
+	if err != nil {
+		return err
+	}
+	return s.Post("/push/fcm", b)
+}
+
+// PushFCMv1 posts payloads to /push/fcm/v1.
+func (s *Server) PushFCMv1(ps ...fcmv1.Payload) error {
+	var buf bytes.Buffer
+	enc := json.NewEncoder(&buf)
+	for _, p := range ps {
+		if err := enc.Encode(p); err != nil {
+			return err
+		}
+	}
+	return s.Post("/push/fcm/v1", buf.Bytes())
+}
+
+// Stats returns stats of Gunfish.
+func (s *Server) Stats() (gunfish.Stats, error) {
+	var st gunfish.Stats
+	resp, err := http.Get(s.URL + "/stats/app")
+	if err != nil {
+		return st, err
+	}
+	defer resp.Body.Close()
+	err = json.NewDecoder(resp.Body).Decode(&st)
+	return st, err
+}
+
+// Chaos returns the fault injector of Gunfish, or nil unless chaos mode is enabled by Options.Config.
+func (s *Server) Chaos() *chaos.Injector {
+	return s.sup.Chaos()
+}
+
+// Sandbox returns the store of notifications of Gunfish, or nil unless sandbox mode is enabled by Options.Config.
+func (s *Server) Sandbox() *sandbox.Store {
+	return s.sup.Sandbox()
+}
+
+// Results returns results which Gunfish passed to the response handlers.
+func (s *Server) Results() []gunfish.Result {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	rs := make([]gunfish.Result, len(s.results))
+	copy(rs, s.results)
+	return rs
+}
+
+// WaitResults waits until the response handlers receive n results in total.
+func (s *Server) WaitResults(n int) ([]gunfish.Result, error) {
+	var rs []gunfish.Result
+	err := s.wait(func() bool {
+		rs = s.Results()
+		return len(rs) >= n
+	})
+	if err != nil {
+		return rs, fmt.Errorf("received %d of %d results: %s", len(rs), n, err)
+	}
+	return rs, nil
+}
+
+// APNsRequests returns requests which the mock APNs server received.
+func (s *Server) APNsRequests() []mock.Request {
+	return s.APNsScenario.Requests()
+}
+
+// WaitAPNsRequests waits until the mock APNs server receives n requests.
+func (s *Server) WaitAPNsRequests(n int) ([]mock.Request, error) {
+	return s.waitRequests(s.APNsScenario, n)
+}
+
+// FCMRequests returns requests which the mock FCM server received, both of legacy and v1.
+func (s *Server) FCMRequests() []mock.Request {
+	return s.FCMScenario.Requests()
+}
+
+// WaitFCMRequests waits until the mock FCM server receives n requests.
+func (s *Server) WaitFCMRequests(n int) ([]mock.Request, error) {
+	return s.waitRequests(s.FCMScenario, n)
+}
+
+func (s *Server) waitRequests(sc *mock.Scenario, n int) ([]mock.Request, error) {
+	var reqs []mock.Request
+	err := s.wait(func() bool {
+		reqs = sc.Requests()
+		return len(reqs) >= n
+	})
+	if err != nil {
+		return reqs, fmt.Errorf("received %d of %d requests: %s", len(reqs), n, err)
+	}
+	return reqs, nil
+}
+
+// HookInvocations returns STDIN of the error hook command for each invocation.
+// The order of invocations is not guaranteed because hooks run concurrently.
+func (s *Server) HookInvocations() ([][]byte, error) {
+	files, err := filepath.Glob(filepath.Join(s.hookDir(), "*.json"))
+	if err != nil {
+		return nil, err
+	}
+	sort.Strings(files)
+	ins := make([][]byte, 0, len(files))
+	for _, f := range files {
+		b, err := ioutil.ReadFile(f)
+		if err != nil {
+			return nil, err
+		}
+		ins = append(ins, b)
+	}
+	return ins, nil
+}
+
+// WaitHookInvocations waits until the error hook command is invoked n times.
+func (s *Server) WaitHookInvocations(n int) ([][]byte, error) {
+	var ins [][]byte
+	var ierr error
+	err := s.wait(func() bool {
+		ins, ierr = s.HookInvocations()
+		return ierr != nil || len(ins) >= n
+	})
+	if ierr != nil {
+		return nil, ierr
+	}
+	if err != nil {
+		return ins, fmt.Errorf("invoked %d of %d hooks: %s", len(ins), n, err)
+	}
+	return ins, nil
+}
+
+func (s *Server) wait(cond func() bool) error {
+	deadline := time.Now().Add(s.timeout)
+	for !cond() {
+		if time.Now().After(deadline) {
+			return fmt.Errorf("timed out after %s", s.timeout)
+		}
+		time.Sleep(time.Millisecond * 10)
+	}
+	return nil
+}
+
+func (s *Server) hookDir() string {
+	return filepath.Join(s.dir, "hooks")
+}
+
+// hookCmd wraps the hook command to save STDIN of it as a file in hookDir.
+func (s *Server) hookCmd(hook string) string {
+	save := fmt.Sprintf(`f=$(mktemp %s/hook.XXXXXXXX)`, s.hookDir())
+	if hook == "" {
+		return save + ` && cat > "$f" && mv "$f" "$f.json"`
+	}
+	return fmt.Sprintf(`%s && tee "$f" | (%s); st=$?; mv "$f" "$f.json"; exit $st`, save, strings.TrimSpace(hook))
+}
+
+// recordingHandler records results and invocations of the hook command of a ResponseHandler.
+type recordingHandler struct {
+	gunfish.ResponseHandler
+	s *Server
+}
+
+func (h *recordingHandler) OnResponse(r gunfish.Result) {
+	h.s.mu.Lock()
+	h.s.results = append(h.s.results, r)
+	h.s.mu.Unlock()
+	h.ResponseHandler.OnResponse(r)
+}
+
+func (h *recordingHandler) HookCmd() string {
+	return h.s.hookCmd(h.ResponseHandler.HookCmd())
+}
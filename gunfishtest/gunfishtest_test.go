@@ -0,0 +1,251 @@
+package gunfishtest_test
+
+import (
+	"encoding/json"
+	"net/http"
+	"sync"
+	"testing"
+
+	"firebase.google.com/go/messaging"
+	gunfish "github.com/kayac/Gunfish"
+	"github.com/kayac/Gunfish/apns"
+	"github.com/kayac/Gunfish/config"
+	"github.com/kayac/Gunfish/fcm"
+	"github.com/kayac/Gunfish/fcmv1"
+	"github.com/kayac/Gunfish/gunfishtest"
+	"github.com/kayac/Gunfish/logger"
+	"github.com/kayac/Gunfish/mock"
+	"github.com/sirupsen/logrus"
+)
+
+func init() {
+	logrus.SetLevel(logrus.FatalLevel)
+}
+
+// countingHandler is a ResponseHandler under test.
+type countingHandler struct {
+	mu     sync.Mutex
+	tokens map[string]int
+	hook   string
+}
+
+func (h *countingHandler) OnResponse(r gunfish.Result) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.tokens[r.RecipientIdentifier()]++
+}
+
+func (h *countingHandler) HookCmd() string {
+	return h.hook
+}
+
+func (h *countingHandler) count(token string) int {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	return h.tokens[token]
+}
+
+func TestServer(t *testing.T) {
+	errorHandler := &countingHandler{tokens: map[string]int{}, hook: "cat > /dev/null"}
+	s, err := gunfishtest.NewServer(gunfishtest.Options{
+		APNs: mock.Options{
+			Scenario: mock.NewScenario(mock.Rule{
+				Match:  mock.Match{Topic: "com.example.limited"},
+				Status: http.StatusTooManyRequests,
+				Reason: apns.TooManyRequests.String(),
+			}),
+		},
+		ErrorHandler: errorHandler,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+
+	aps := apns.Payload{APS: &apns.APS{Alert: "hello"}}
+	err = s.PushAPNs(
+		gunfish.PostedData{Token: "aaa", Payload: aps, Header: apns.Header{ApnsTopic: "com.example"}},
+		gunfish.PostedData{Token: "baddevicetoken", Payload: aps, Header: apns.Header{ApnsTopic: "com.example"}},
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := s.PushFCM(fcm.Payload{RegistrationIDs: []string{"bbb", "notregistered"}}); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.PushFCMv1(fcmv1.Payload{Message: messaging.Message{Token: "ccc"}}); err != nil {
+		t.Fatal(err)
+	}
+
+	// aaa, baddevicetoken and notregistered. Gunfish does not pass successes of FCM to the handler.
+	results, err := s.WaitResults(3)
+	if err != nil {
+		t.Fatal(err)
+	}
+	errs := map[string]string{}
+	for _, r := range results {
+		if err := r.Err(); err != nil {
+			errs[r.RecipientIdentifier()] = err.Error()
+		}
+	}
+	if len(errs) != 2 || errs["baddevicetoken"] != apns.BadDeviceToken.String() || errs["notregistered"] != fcm.NotRegistered.String() {
+		t.Errorf("unexpected errors: %v", errs)
+	}
+	if errorHandler.count("baddevicetoken") != 1 || errorHandler.count("notregistered") != 1 {
+		t.Errorf("unexpected calls of the error handler: %v", errorHandler.tokens)
+	}
+
+	ins, err := s.WaitHookInvocations(2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, in := range ins {
+		var v map[string]interface{}
+		if err := json.Unmarshal(in, &v); err != nil {
+			t.Errorf("invalid hook input: %s", err)
+		}
+	}
+
+	reqs := s.APNsRequests()
+	if len(reqs) != 2 || reqs[0].Header.Get("apns-topic") != "com.example" {
+		t.Errorf("unexpected requests to APNs: %v", reqs)
+	}
+	if reqs, err := s.WaitFCMRequests(2); err != nil || len(reqs) != 2 {
+		t.Errorf("unexpected requests to FCM: %v %v", reqs, err)
+	}
+
+	// scenario rules
+	if err := s.PushAPNs(gunfish.PostedData{Token: "ddd", Payload: aps, Header: apns.Header{ApnsTopic: "com.example.limited"}}); err != nil {
+		t.Fatal(err)
+	}
+	reqs, err = s.WaitAPNsRequests(3)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if reqs[2].Status != http.StatusTooManyRequests {
+		t.Errorf("unexpected status: %d", reqs[2].Status)
+	}
+}
+
+func TestServerPushError(t *testing.T) {
+	s, err := gunfishtest.NewServer(gunfishtest.Options{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+
+	err = s.Post("/push/apns", []byte(`{"invalid"`))
+	if e, ok := err.(*gunfishtest.PushError); !ok || e.StatusCode != http.StatusBadRequest {
+		t.Errorf("unexpected error: %v", err)
+	}
+}
+
+// recordingLogger records messages of logs by their type field.
+type recordingLogger struct {
+	mu   sync.Mutex
+	msgs map[string][]string
+}
+
+func (l *recordingLogger) Enabled(level logger.Level) bool {
+	return level >= logger.InfoLevel
+}
+
+func (l *recordingLogger) Log(level logger.Level, msg string, fields logger.Fields) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	typ, _ := fields["type"].(string)
+	l.msgs[typ] = append(l.msgs[typ], msg)
+}
+
+func (l *recordingLogger) count(typ, msg string) int {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	n := 0
+	for _, m := range l.msgs[typ] {
+		if m == msg {
+			n++
+		}
+	}
+	return n
+}
+
+func TestLogger(t *testing.T) {
+	l := &recordingLogger{msgs: map[string][]string{}}
+	s, err := gunfishtest.NewServer(gunfishtest.Options{
+		Config: func(c *config.Config) {
+			c.Logger = l
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+
+	if err := s.PushAPNs(gunfish.PostedData{Token: "a1b2c3", Payload: apns.Payload{APS: &apns.APS{Alert: "hi"}}}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := s.WaitResults(1); err != nil {
+		t.Fatal(err)
+	}
+	if n := l.count("worker", "Succeeded to send a notification"); n != 1 {
+		t.Errorf("worker logs are not written to the logger of the config: %v", l.msgs)
+	}
+
+	if err := s.Post("/stats/app", nil); err == nil {
+		t.Error("POST to /stats/app must fail")
+	}
+	if n := l.count("provider", "Method Not Allowed: POST"); n != 1 {
+		t.Errorf("provider logs are not written to the logger of the config: %v", l.msgs)
+	}
+}
+
+func TestPassthrough(t *testing.T) {
+	s, err := gunfishtest.NewServer(gunfishtest.Options{
+		Config: func(c *config.Config) {
+			c.Provider.Passthrough = true
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+
+	// fields which Gunfish does not know are sent as posted
+	payload := `{"aps":{"alert":"hi","interruption-level":"time-sensitive","relevance-score":0.5},"x":{"y":[1,2.50]}}`
+	body := `[{"token":"aaa","header":{"apns-topic":"com.example"},"payload":` + payload + `}]`
+	if err := s.Post("/push/apns", []byte(body)); err != nil {
+		t.Fatal(err)
+	}
+	reqs, err := s.WaitAPNsRequests(1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if reqs[0].Body != payload || reqs[0].Token != "aaa" || reqs[0].Header.Get("apns-topic") != "com.example" {
+		t.Errorf("unexpected request to APNs: %#v", reqs[0])
+	}
+
+	message := `{"message":{"token":"bbb","android":{"priority":"high","direct_boot_ok":true}}}`
+	if err := s.Post("/push/fcm/v1", []byte(message+"\n")); err != nil {
+		t.Fatal(err)
+	}
+	freqs, err := s.WaitFCMRequests(1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if freqs[0].Body != message {
+		t.Errorf("unexpected request to FCM v1: %s", freqs[0].Body)
+	}
+
+	for _, b := range []string{
+		`[{"token":"aaa","payload":{"alert":"hi"}}]`,
+		`[{"payload":{"aps":{"alert":"hi"}}}]`,
+		`[]`,
+	} {
+		if err := s.Post("/push/apns", []byte(b)); err == nil {
+			t.Errorf("%s must be rejected", b)
+		}
+	}
+	if err := s.Post("/push/fcm/v1", []byte(`{"message":{"data":{"k":"v"}}}`)); err == nil {
+		t.Error("a message without any target must be rejected")
+	}
+}
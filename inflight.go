@@ -0,0 +1,69 @@
+package gunfish
+
+import "sync/atomic"
+
+// InFlight is the number of notifications in each stage of the supervisor, and hook commands.
+type InFlight struct {
+	Total    int64 `json:"total"`
+	Queued   int64 `json:"queued"`   // in the supervisor's queue
+	Worker   int64 `json:"worker"`   // received by workers and not yet by senders
+	Sending  int64 `json:"sending"`  // being sent, or their responses are being handled
+	Retrying int64 `json:"retrying"` // waiting to be resent
+	Hooks    int64 `json:"hooks"`    // hook commands waiting or running
+}
+
+type stage int
+
+const (
+	stageQueued stage = iota
+	stageWorker
+	stageSending
+	stageRetrying
+	stageHooks
+	numStages
+)
+
+// inFlight counts notifications in each stage. Notifications move to the next stage before leaving the previous one,
+// and total is changed only when they enter or leave the supervisor, so it never reaches 0 while any is in flight.
+// A nil inFlight counts nothing.
+type inFlight struct {
+	total  int64
+	stages [numStages]int64
+}
+
+func (f *inFlight) add(s stage, n int64) {
+	if f == nil {
+		return
+	}
+	atomic.AddInt64(&f.total, n)
+	atomic.AddInt64(&f.stages[s], n)
+}
+
+func (f *inFlight) move(from, to stage, n int64) {
+	if f == nil {
+		return
+	}
+	atomic.AddInt64(&f.stages[to], n)
+	atomic.AddInt64(&f.stages[from], -n)
+}
+
+func (f *inFlight) load() int64 {
+	if f == nil {
+		return 0
+	}
+	return atomic.LoadInt64(&f.total)
+}
+
+func (f *inFlight) snapshot() InFlight {
+	if f == nil {
+		return InFlight{}
+	}
+	return InFlight{
+		Total:    atomic.LoadInt64(&f.total),
+		Queued:   atomic.LoadInt64(&f.stages[stageQueued]),
+		Worker:   atomic.LoadInt64(&f.stages[stageWorker]),
+		Sending:  atomic.LoadInt64(&f.stages[stageSending]),
+		Retrying: atomic.LoadInt64(&f.stages[stageRetrying]),
+		Hooks:    atomic.LoadInt64(&f.stages[stageHooks]),
+	}
+}
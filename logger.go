@@ -1,18 +1,26 @@
 package gunfish
 
 import (
-	"fmt"
-	"runtime"
-
-	"github.com/sirupsen/logrus"
+	"github.com/kayac/Gunfish/logger"
 )
 
-// LogWithFields wraps logrus's WithFields
-func LogWithFields(fields map[string]interface{}) *logrus.Entry {
-	_, file, line, _ := runtime.Caller(1)
+// defaultLogger writes logs of Gunfish to the standard logger of logrus unless SetLogger is called.
+var defaultLogger logger.Logger = logger.NewLogrus(nil)
+
+// SetLogger sets the logger of Gunfish. It is used by the supervisor and the provider
+// unless config.Config.Logger is set, and by hooks and functions of the package.
+// It must be called before starting Gunfish.
+func SetLogger(l logger.Logger) {
+	defaultLogger = l
+}
 
-	fields["file"] = file
-	fields["line"] = fmt.Sprintf("%d", line)
+// LogWithFields returns a log entry with fields. fields are not modified.
+func LogWithFields(fields map[string]interface{}) logger.Entry {
+	return logger.New(defaultLogger, fields)
+}
 
-	return logrus.WithFields(fields)
+// LogWithLazyFields returns a log entry whose fields are added by f only when it is written.
+// Use it on the hot path not to build fields of logs which the level drops.
+func LogWithLazyFields(f func(logger.Fields)) logger.Entry {
+	return logger.NewLazy(defaultLogger, f)
 }
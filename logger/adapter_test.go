@@ -0,0 +1,58 @@
+package logger
+
+import (
+	"bytes"
+	"fmt"
+	"sort"
+	"strings"
+	"testing"
+
+	"github.com/sirupsen/logrus"
+)
+
+func TestLogrus(t *testing.T) {
+	var b bytes.Buffer
+	l := logrus.New()
+	l.Out = &b
+	l.Formatter = &logrus.TextFormatter{DisableTimestamp: true, DisableColors: true}
+	l.Level = logrus.InfoLevel
+	lr := NewLogrus(l)
+
+	if lr.Enabled(DebugLevel) || !lr.Enabled(InfoLevel) || !lr.Enabled(ErrorLevel) {
+		t.Error("unexpected enabled levels")
+	}
+	New(lr, Fields{"type": "worker"}).Debug("dropped")
+	New(lr, Fields{"type": "worker"}).With("status", 410).Errorf("failed: %s", "Unregistered")
+	if got, want := b.String(), "level=error msg=\"failed: Unregistered\" status=410 type=worker\n"; got != want {
+		t.Errorf("got %q want %q", got, want)
+	}
+}
+
+type fakeSugar struct {
+	b bytes.Buffer
+}
+
+func (s *fakeSugar) write(level, msg string, kvs []interface{}) {
+	var pairs []string
+	for i := 0; i < len(kvs); i += 2 {
+		pairs = append(pairs, fmt.Sprintf("%v=%v", kvs[i], kvs[i+1]))
+	}
+	sort.Strings(pairs)
+	fmt.Fprintf(&s.b, "%s %s %s\n", level, msg, strings.Join(pairs, " "))
+}
+
+func (s *fakeSugar) Debugw(msg string, kvs ...interface{}) { s.write("debug", msg, kvs) }
+func (s *fakeSugar) Infow(msg string, kvs ...interface{})  { s.write("info", msg, kvs) }
+func (s *fakeSugar) Warnw(msg string, kvs ...interface{})  { s.write("warn", msg, kvs) }
+func (s *fakeSugar) Errorw(msg string, kvs ...interface{}) { s.write("error", msg, kvs) }
+func (s *fakeSugar) Fatalw(msg string, kvs ...interface{}) { s.write("fatal", msg, kvs) }
+
+func TestZap(t *testing.T) {
+	s := &fakeSugar{}
+	z := NewZap(s, WarnLevel)
+	New(z, Fields{"type": "worker"}).Info("dropped")
+	New(z, Fields{"type": "worker", "worker_id": 1}).Warn("queue is full")
+	if got, want := s.b.String(), "warn queue is full type=worker worker_id=1\n"; got != want {
+		t.Errorf("got %q want %q", got, want)
+	}
+}
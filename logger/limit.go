@@ -0,0 +1,126 @@
+package logger
+
+import (
+	"fmt"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/kayac/Gunfish/clock"
+)
+
+// limiter decides whether a log is written, and returns the suffix of its message.
+type limiter interface {
+	allow(r record) (suffix string, ok bool)
+}
+
+// record is a log which is not formatted yet.
+type record struct {
+	entry  Entry
+	level  Level
+	format string
+	args   []interface{}
+}
+
+// Throttle aggregates logs of a repeated condition, like a full queue, into a log per interval.
+// A written log has the number of occurrences since the last written log, e.g. "queue is full (x4213 in last 10s)".
+// Flush writes the occurrences which are suppressed after the last written log, once the condition stops.
+// A nil Throttle writes every log.
+type Throttle struct {
+	count int64 // accessed atomically, so it is at the top for the alignment on 32-bit platforms
+	last  int64 // unix nano of the last written log
+
+	interval time.Duration
+	clock    clock.Clock
+
+	mu      sync.Mutex
+	pending *record // the first suppressed log after the last written log
+}
+
+// NewThrottle creates Throttle which reads time from c, or clock.Real when c is nil.
+// It returns nil when interval is not positive.
+func NewThrottle(interval time.Duration, c clock.Clock) *Throttle {
+	if interval <= 0 {
+		return nil
+	}
+	if c == nil {
+		c = clock.Real
+	}
+	return &Throttle{interval: interval, clock: c}
+}
+
+func (t *Throttle) allow(r record) (string, bool) {
+	n := atomic.AddInt64(&t.count, 1)
+	now := t.clock.Now().UnixNano()
+	last := atomic.LoadInt64(&t.last)
+	if last != 0 && now-last < int64(t.interval) {
+		if n == 1 {
+			p := r
+			t.mu.Lock()
+			t.pending = &p
+			t.mu.Unlock()
+		}
+		return "", false
+	}
+	if !atomic.CompareAndSwapInt64(&t.last, last, now) {
+		return "", false
+	}
+	n = atomic.SwapInt64(&t.count, 0)
+	t.mu.Lock()
+	t.pending = nil
+	t.mu.Unlock()
+	if last == 0 || n <= 1 {
+		return "", true
+	}
+	return summary(n, time.Duration(now-last)), true
+}
+
+// Flush writes the suppressed logs when the interval has passed since the last written log.
+// Call it periodically, so that the occurrences are not lost when the condition stops. A nil Throttle does nothing.
+func (t *Throttle) Flush() {
+	if t == nil || atomic.LoadInt64(&t.count) == 0 {
+		return
+	}
+	now := t.clock.Now().UnixNano()
+	last := atomic.LoadInt64(&t.last)
+	if now-last < int64(t.interval) || !atomic.CompareAndSwapInt64(&t.last, last, now) {
+		return
+	}
+	n := atomic.SwapInt64(&t.count, 0)
+	t.mu.Lock()
+	r := t.pending
+	t.pending = nil
+	t.mu.Unlock()
+	if r == nil || n == 0 {
+		return
+	}
+	r.entry.write(r.level, message(r.format, r.args)+summary(n, time.Duration(now-last)), 2)
+}
+
+func summary(n int64, d time.Duration) string {
+	if d >= time.Second {
+		d = d.Round(time.Second)
+	} else {
+		d = d.Round(time.Millisecond)
+	}
+	return fmt.Sprintf(" (x%d in last %s)", n, d)
+}
+
+// Sampler writes the first of every n logs, for logs of each notification.
+// A nil Sampler writes every log.
+type Sampler struct {
+	n     uint64
+	count uint64
+}
+
+// NewSampler creates Sampler. It returns nil when n is less than 2.
+func NewSampler(n int) *Sampler {
+	if n < 2 {
+		return nil
+	}
+	return &Sampler{n: uint64(n)}
+}
+
+func (s *Sampler) allow(record) (string, bool) {
+	return "", atomic.AddUint64(&s.count, 1)%s.n == 1
+}
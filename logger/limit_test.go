@@ -0,0 +1,108 @@
+package logger
+
+import (
+	"testing"
+	"time"
+
+	"github.com/kayac/Gunfish/clock"
+)
+
+func TestThrottle(t *testing.T) {
+	r := &recorder{}
+	fake := clock.NewFake(time.Date(2026, 10, 15, 12, 0, 0, 0, time.UTC))
+	th := NewThrottle(10*time.Second, fake)
+	e := New(r, Fields{"type": "supervisor"}).Throttle(th)
+
+	for i := 0; i < 4213; i++ {
+		e.Warn("queue is full")
+		fake.Advance(time.Millisecond)
+	}
+	fake.Advance(10 * time.Second)
+	e.Warn("queue is full")
+	e.Warn("queue is full")
+	fake.Advance(time.Minute)
+	e.Warn("queue is full")
+
+	want := []string{
+		"queue is full",
+		"queue is full (x4213 in last 14s)",
+		"queue is full (x2 in last 1m0s)",
+	}
+	if len(r.logs) != len(want) {
+		t.Fatalf("unexpected logs: %#v", r.logs)
+	}
+	for i, l := range r.logs {
+		if l.msg != want[i] || l.fields["type"] != "supervisor" {
+			t.Errorf("got %q want %q", l.msg, want[i])
+		}
+	}
+
+	if NewThrottle(0, nil) != nil {
+		t.Error("throttle must be disabled by zero interval")
+	}
+	New(r, nil).Throttle(nil).Warn("not throttled")
+	if len(r.logs) != 4 {
+		t.Errorf("unexpected logs: %#v", r.logs)
+	}
+}
+
+func TestThrottleFlush(t *testing.T) {
+	r := &recorder{}
+	fake := clock.NewFake(time.Date(2026, 10, 15, 12, 0, 0, 0, time.UTC))
+	th := NewThrottle(10*time.Second, fake)
+	e := New(r, Fields{"type": "supervisor"}).Throttle(th)
+
+	th.Flush()
+	for i := 0; i < 100; i++ {
+		e.Warnf("queue is full: %d", i)
+		fake.Advance(10 * time.Millisecond)
+	}
+	th.Flush() // within the interval
+	if len(r.logs) != 1 {
+		t.Fatalf("unexpected logs: %#v", r.logs)
+	}
+
+	// the condition stopped
+	fake.Advance(10 * time.Second)
+	th.Flush()
+	th.Flush()
+	want := []string{
+		"queue is full: 0",
+		"queue is full: 1 (x99 in last 11s)",
+	}
+	if len(r.logs) != len(want) {
+		t.Fatalf("unexpected logs: %#v", r.logs)
+	}
+	for i, l := range r.logs {
+		if l.msg != want[i] || l.level != WarnLevel || l.fields["type"] != "supervisor" {
+			t.Errorf("got %q want %q", l.msg, want[i])
+		}
+	}
+
+	// the next occurrence is aggregated from the flushed log
+	e.Warn("queue is full")
+	fake.Advance(10 * time.Second)
+	e.Warn("queue is full")
+	if l := r.logs[len(r.logs)-1]; len(r.logs) != 3 || l.msg != "queue is full (x2 in last 10s)" {
+		t.Errorf("unexpected logs: %#v", r.logs)
+	}
+
+	var disabled *Throttle
+	disabled.Flush()
+}
+
+func TestSampler(t *testing.T) {
+	r := &recorder{level: InfoLevel}
+	s := NewSampler(100)
+	e := New(r, nil).Sample(s)
+	for i := 0; i < 1000; i++ {
+		e.Debug("dropped by level")
+		e.Info("succeeded")
+	}
+	if len(r.logs) != 10 {
+		t.Errorf("unexpected sampled logs: %d", len(r.logs))
+	}
+	if NewSampler(1) != nil {
+		t.Error("sampler must be disabled by 1")
+	}
+}
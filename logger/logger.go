@@ -0,0 +1,198 @@
+// Package logger is the leveled structured logging of Gunfish.
+// Fields of a log are evaluated and copied only when the log is written at an enabled level,
+// so logging on the hot path costs almost nothing when the level drops it.
+package logger
+
+import (
+	"fmt"
+	"runtime"
+	"strconv"
+	"sync"
+)
+
+// Level is a log level.
+type Level int8
+
+// Log levels
+const (
+	DebugLevel Level = iota
+	InfoLevel
+	WarnLevel
+	ErrorLevel
+	FatalLevel // exits the process after writing the log
+)
+
+func (l Level) String() string {
+	switch l {
+	case DebugLevel:
+		return "debug"
+	case InfoLevel:
+		return "info"
+	case WarnLevel:
+		return "warning"
+	case ErrorLevel:
+		return "error"
+	case FatalLevel:
+		return "fatal"
+	}
+	return "unknown"
+}
+
+// Fields are structured fields of a log.
+type Fields map[string]interface{}
+
+// Lazy is a field value which is evaluated only when the log is written.
+type Lazy func() interface{}
+
+// Logger writes logs.
+type Logger interface {
+	// Enabled reports whether logs at the level are written.
+	Enabled(level Level) bool
+	// Log writes a log. fields must not be retained after Log returns, because they are reused.
+	Log(level Level, msg string, fields Fields)
+}
+
+// ReportCaller adds file and line of the caller to logs. It costs runtime.Caller for each written log.
+var ReportCaller bool
+
+var fieldsPool = sync.Pool{
+	New: func() interface{} {
+		return make(Fields, 16)
+	},
+}
+
+// Entry is a log with fields. The zero Entry discards logs.
+// Entries are immutable and can be copied and shared between goroutines.
+type Entry struct {
+	logger Logger
+	fields Fields
+	lazy   func(Fields)
+	limit  limiter
+}
+
+// New creates Entry which is written to l with fields. fields are not modified.
+func New(l Logger, fields map[string]interface{}) Entry {
+	return Entry{logger: l, fields: fields}
+}
+
+// NewLazy creates Entry whose fields are added by f only when it is written at an enabled level.
+func NewLazy(l Logger, f func(Fields)) Entry {
+	return Entry{logger: l, lazy: f}
+}
+
+// With returns a copy of the entry with a field.
+func (e Entry) With(key string, value interface{}) Entry {
+	fields := make(Fields, len(e.fields)+1)
+	for k, v := range e.fields {
+		fields[k] = v
+	}
+	fields[key] = value
+	e.fields = fields
+	return e
+}
+
+// Throttle returns a copy of the entry whose logs are aggregated by t.
+func (e Entry) Throttle(t *Throttle) Entry {
+	if t != nil {
+		e.limit = t
+	}
+	return e
+}
+
+// Sample returns a copy of the entry whose logs are sampled by s.
+func (e Entry) Sample(s *Sampler) Entry {
+	if s != nil {
+		e.limit = s
+	}
+	return e
+}
+
+// Logger returns the logger which the entry is written to.
+func (e Entry) Logger() Logger {
+	return e.logger
+}
+
+// Enabled reports whether logs at the level are written.
+func (e Entry) Enabled(level Level) bool {
+	return e.logger != nil && e.logger.Enabled(level)
+}
+
+func (e Entry) log(level Level, format string, args []interface{}) {
+	if !e.Enabled(level) {
+		return
+	}
+	var suffix string
+	if e.limit != nil {
+		var ok bool
+		if suffix, ok = e.limit.allow(record{entry: e, level: level, format: format, args: args}); !ok {
+			return
+		}
+	}
+	// Entry.log is called by the methods of Entry
+	e.write(level, message(format, args)+suffix, 3)
+}
+
+func message(format string, args []interface{}) string {
+	if format == "" {
+		return fmt.Sprint(args...)
+	}
+	return fmt.Sprintf(format, args...)
+}
+
+// write writes msg with the fields. skip is the number of stack frames to the caller reported by ReportCaller.
+func (e Entry) write(level Level, msg string, skip int) {
+	fields := fieldsPool.Get().(Fields)
+	if e.lazy != nil {
+		e.lazy(fields)
+	}
+	for k, v := range e.fields {
+		fields[k] = v
+	}
+	for k, v := range fields {
+		if lazy, ok := v.(Lazy); ok {
+			fields[k] = lazy()
+		}
+	}
+	if ReportCaller {
+		if _, file, line, ok := runtime.Caller(skip); ok {
+			fields["file"] = file
+			fields["line"] = strconv.Itoa(line)
+		}
+	}
+	e.logger.Log(level, msg, fields)
+
+	for k := range fields {
+		delete(fields, k)
+	}
+	fieldsPool.Put(fields)
+}
+
+// Debug writes a log at DebugLevel.
+func (e Entry) Debug(args ...interface{}) { e.log(DebugLevel, "", args) }
+
+// Debugf writes a log at DebugLevel.
+func (e Entry) Debugf(format string, args ...interface{}) { e.log(DebugLevel, format, args) }
+
+// Info writes a log at InfoLevel.
+func (e Entry) Info(args ...interface{}) { e.log(InfoLevel, "", args) }
+
+// Infof writes a log at InfoLevel.
+func (e Entry) Infof(format string, args ...interface{}) { e.log(InfoLevel, format, args) }
+
+// Warn writes a log at WarnLevel.
+func (e Entry) Warn(args ...interface{}) { e.log(WarnLevel, "", args) }
+
+// Warnf writes a log at WarnLevel.
+func (e Entry) Warnf(format string, args ...interface{}) { e.log(WarnLevel, format, args) }
+
+// Error writes a log at ErrorLevel.
+func (e Entry) Error(args ...interface{}) { e.log(ErrorLevel, "", args) }
+
+// Errorf writes a log at ErrorLevel.
+func (e Entry) Errorf(format string, args ...interface{}) { e.log(ErrorLevel, format, args) }
+
+// Fatal writes a log at FatalLevel.
+func (e Entry) Fatal(args ...interface{}) { e.log(FatalLevel, "", args) }
+
+// Fatalf writes a log at FatalLevel.
+func (e Entry) Fatalf(format string, args ...interface{}) { e.log(FatalLevel, format, args) }
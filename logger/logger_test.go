@@ -0,0 +1,98 @@
+package logger
+
+import (
+	"strings"
+	"testing"
+)
+
+type recorded struct {
+	level  Level
+	msg    string
+	fields Fields
+}
+
+type recorder struct {
+	level Level
+	logs  []recorded
+}
+
+func (r *recorder) Enabled(level Level) bool {
+	return level >= r.level
+}
+
+func (r *recorder) Log(level Level, msg string, fields Fields) {
+	copied := make(Fields, len(fields))
+	for k, v := range fields {
+		copied[k] = v
+	}
+	r.logs = append(r.logs, recorded{level, msg, copied})
+}
+
+func TestEntry(t *testing.T) {
+	r := &recorder{level: InfoLevel}
+	evaluated := 0
+	lazy := Lazy(func() interface{} {
+		evaluated++
+		return "lazy"
+	})
+	fields := Fields{"type": "worker", "lazy": lazy}
+	e := New(r, fields)
+
+	e.Debugf("dropped %d", 1)
+	if len(r.logs) != 0 || evaluated != 0 {
+		t.Fatalf("debug log must be dropped without evaluation: %#v", r.logs)
+	}
+
+	e.With("status", 200).Infof("sent %d", 1)
+	e.Warn("warn ", 2)
+	if len(r.logs) != 2 {
+		t.Fatalf("unexpected logs: %#v", r.logs)
+	}
+	if l := r.logs[0]; l.level != InfoLevel || l.msg != "sent 1" || l.fields["status"] != 200 || l.fields["lazy"] != "lazy" || l.fields["type"] != "worker" {
+		t.Errorf("unexpected log: %#v", l)
+	}
+	if l := r.logs[1]; l.level != WarnLevel || l.msg != "warn 2" || l.fields["status"] != nil {
+		t.Errorf("unexpected log: %#v", l)
+	}
+	if evaluated != 2 {
+		t.Errorf("lazy value is evaluated %d times", evaluated)
+	}
+	if len(fields) != 2 || fields["lazy"] == nil {
+		t.Errorf("fields must not be modified: %#v", fields)
+	}
+
+	// the zero Entry discards logs
+	Entry{}.Error("discarded")
+}
+
+func TestNewLazy(t *testing.T) {
+	r := &recorder{level: WarnLevel}
+	called := 0
+	e := NewLazy(r, func(f Fields) {
+		called++
+		f["type"] = "worker"
+		f["status"] = "-"
+	})
+	e.Info("dropped")
+	if called != 0 {
+		t.Fatal("lazy fields must not be built for dropped logs")
+	}
+	e.With("status", 410).Error("failed")
+	if called != 1 || r.logs[0].fields["status"] != 410 || r.logs[0].fields["type"] != "worker" {
+		t.Errorf("unexpected log: %#v", r.logs)
+	}
+}
+
+func TestReportCaller(t *testing.T) {
+	ReportCaller = true
+	defer func() { ReportCaller = false }()
+
+	r := &recorder{}
+	New(r, nil).Info("with caller")
+	New(r, nil).Infof("with %s", "caller")
+	for _, l := range r.logs {
+		if file, _ := l.fields["file"].(string); !strings.HasSuffix(file, "logger_test.go") || l.fields["line"] == "" {
+			t.Errorf("unexpected caller: %v:%v", l.fields["file"], l.fields["line"])
+		}
+	}
+}
@@ -0,0 +1,63 @@
+package logger
+
+import (
+	"sync"
+	"sync/atomic"
+
+	"github.com/sirupsen/logrus"
+)
+
+var logrusLevels = map[Level]logrus.Level{
+	DebugLevel: logrus.DebugLevel,
+	InfoLevel:  logrus.InfoLevel,
+	WarnLevel:  logrus.WarnLevel,
+	ErrorLevel: logrus.ErrorLevel,
+	FatalLevel: logrus.FatalLevel,
+}
+
+// Logrus is a Logger which writes logs to a logrus.Logger.
+type Logrus struct {
+	l       *logrus.Logger
+	entries sync.Pool
+}
+
+// NewLogrus creates Logrus. logrus.StandardLogger() is used when l is nil.
+func NewLogrus(l *logrus.Logger) *Logrus {
+	if l == nil {
+		l = logrus.StandardLogger()
+	}
+	return &Logrus{
+		l: l,
+		entries: sync.Pool{
+			New: func() interface{} {
+				return logrus.NewEntry(l)
+			},
+		},
+	}
+}
+
+// Enabled reports whether the level of the logrus.Logger enables the level.
+func (lr *Logrus) Enabled(level Level) bool {
+	// logrus.Logger.SetLevel stores the level atomically
+	return logrus.Level(atomic.LoadUint32((*uint32)(&lr.l.Level))) >= logrusLevels[level]
+}
+
+// Log writes a log by a pooled logrus.Entry.
+func (lr *Logrus) Log(level Level, msg string, fields Fields) {
+	entry := lr.entries.Get().(*logrus.Entry)
+	entry.Data = logrus.Fields(fields)
+	switch level {
+	case DebugLevel:
+		entry.Debug(msg)
+	case InfoLevel:
+		entry.Info(msg)
+	case WarnLevel:
+		entry.Warn(msg)
+	case ErrorLevel:
+		entry.Error(msg)
+	case FatalLevel:
+		entry.Fatal(msg)
+	}
+	entry.Data = nil
+	lr.entries.Put(entry)
+}
@@ -0,0 +1,57 @@
+//go:build go1.21
+// +build go1.21
+
+package logger
+
+import (
+	"context"
+	"log/slog"
+	"os"
+	"sort"
+)
+
+// SlogFatalLevel is the level of slog for FatalLevel, which slog does not have.
+const SlogFatalLevel = slog.LevelError + 4
+
+var slogLevels = map[Level]slog.Level{
+	DebugLevel: slog.LevelDebug,
+	InfoLevel:  slog.LevelInfo,
+	WarnLevel:  slog.LevelWarn,
+	ErrorLevel: slog.LevelError,
+	FatalLevel: SlogFatalLevel,
+}
+
+// Slog is a Logger which writes logs to a slog.Logger.
+type Slog struct {
+	l *slog.Logger
+}
+
+// NewSlog creates Slog. slog.Default() is used when l is nil.
+func NewSlog(l *slog.Logger) *Slog {
+	if l == nil {
+		l = slog.Default()
+	}
+	return &Slog{l: l}
+}
+
+// Enabled reports whether the handler of the slog.Logger handles the level.
+func (s *Slog) Enabled(level Level) bool {
+	return s.l.Enabled(context.Background(), slogLevels[level])
+}
+
+// Log writes a log with fields as attributes sorted by the keys.
+func (s *Slog) Log(level Level, msg string, fields Fields) {
+	keys := make([]string, 0, len(fields))
+	for k := range fields {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	attrs := make([]slog.Attr, 0, len(keys))
+	for _, k := range keys {
+		attrs = append(attrs, slog.Any(k, fields[k]))
+	}
+	s.l.LogAttrs(context.Background(), slogLevels[level], msg, attrs...)
+	if level == FatalLevel {
+		os.Exit(1)
+	}
+}
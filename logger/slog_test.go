@@ -0,0 +1,33 @@
+//go:build go1.21
+// +build go1.21
+
+package logger
+
+import (
+	"bytes"
+	"log/slog"
+	"testing"
+)
+
+func TestSlog(t *testing.T) {
+	var b bytes.Buffer
+	h := slog.NewTextHandler(&b, &slog.HandlerOptions{
+		Level: slog.LevelInfo,
+		ReplaceAttr: func(groups []string, a slog.Attr) slog.Attr {
+			if a.Key == slog.TimeKey {
+				return slog.Attr{}
+			}
+			return a
+		},
+	})
+	s := NewSlog(slog.New(h))
+
+	if s.Enabled(DebugLevel) || !s.Enabled(WarnLevel) {
+		t.Error("unexpected enabled levels")
+	}
+	New(s, Fields{"type": "worker"}).Debug("dropped")
+	New(s, Fields{"type": "worker", "status": 410}).Warnf("failed: %s", "Unregistered")
+	if got, want := b.String(), "level=WARN msg=\"failed: Unregistered\" status=410 type=worker\n"; got != want {
+		t.Errorf("got %q want %q", got, want)
+	}
+}
@@ -0,0 +1,51 @@
+package logger
+
+// ZapSugaredLogger is the methods of *zap.SugaredLogger which Zap uses.
+// It is an interface not to make Gunfish depend on zap.
+type ZapSugaredLogger interface {
+	Debugw(msg string, keysAndValues ...interface{})
+	Infow(msg string, keysAndValues ...interface{})
+	Warnw(msg string, keysAndValues ...interface{})
+	Errorw(msg string, keysAndValues ...interface{})
+	Fatalw(msg string, keysAndValues ...interface{})
+}
+
+// Zap is a Logger which writes logs to a zap.SugaredLogger.
+//
+//	zl, _ := zap.NewProduction()
+//	gunfish.SetLogger(logger.NewZap(zl.Sugar(), logger.InfoLevel))
+type Zap struct {
+	s     ZapSugaredLogger
+	level Level
+}
+
+// NewZap creates Zap which writes logs at level or higher.
+// The level should be the same as the zap.Logger, because zap.SugaredLogger can not tell it.
+func NewZap(s ZapSugaredLogger, level Level) *Zap {
+	return &Zap{s: s, level: level}
+}
+
+// Enabled reports whether the level is the level of Zap or higher.
+func (z *Zap) Enabled(level Level) bool {
+	return level >= z.level
+}
+
+// Log writes a log with fields as key-value pairs.
+func (z *Zap) Log(level Level, msg string, fields Fields) {
+	kvs := make([]interface{}, 0, len(fields)*2)
+	for k, v := range fields {
+		kvs = append(kvs, k, v)
+	}
+	switch level {
+	case DebugLevel:
+		z.s.Debugw(msg, kvs...)
+	case InfoLevel:
+		z.s.Infow(msg, kvs...)
+	case WarnLevel:
+		z.s.Warnw(msg, kvs...)
+	case ErrorLevel:
+		z.s.Errorw(msg, kvs...)
+	case FatalLevel:
+		z.s.Fatalw(msg, kvs...)
+	}
+}
@@ -2,122 +2,172 @@ package gunfish
 
 import (
 	"bytes"
+	"encoding/json"
 	"fmt"
 	"sort"
+	"strconv"
 	"time"
 
 	"github.com/sirupsen/logrus"
 )
 
-var (
-	baseTimestamp time.Time
+// Special timestamp formats of LtsvFormatter
+const (
+	// RFC3339Milli is RFC3339 with milliseconds.
+	RFC3339Milli = "2006-01-02T15:04:05.000Z07:00"
+	// TimestampEpoch formats the time as seconds since the Unix epoch.
+	TimestampEpoch = "epoch"
+	// TimestampEpochMilli formats the time as milliseconds since the Unix epoch.
+	TimestampEpochMilli = "epoch_ms"
 )
 
-func init() {
-	baseTimestamp = time.Now()
-}
-
-func miniTS() int {
-	return int(time.Since(baseTimestamp) / time.Second)
-}
+// DefaultLtsvFieldOrder is the order of the leading fields of LtsvFormatter.
+var DefaultLtsvFieldOrder = []string{"level", "time", "msg"}
 
-// LtsvFormatter is ltsv format for logrus
+// LtsvFormatter is ltsv format for logrus.
+// Strings which contain other than alphanumerics, '-' and '.' are quoted and escaped,
+// and maps, slices and structs are encoded as JSON, so a value never contains tabs or newlines.
 type LtsvFormatter struct {
 	DisableTimestamp bool
-	TimestampFormat  string
-	DisableSorting   bool
+	// TimestampFormat is a layout of time.Format, TimestampEpoch or TimestampEpochMilli. (default: time.RFC3339)
+	TimestampFormat string
+	DisableSorting  bool
+	// FieldOrder is the order of fields written first. Other fields follow them. (default: DefaultLtsvFieldOrder)
+	FieldOrder []string
 }
 
 // Format entry
 func (f *LtsvFormatter) Format(entry *logrus.Entry) ([]byte, error) {
-	keys := make([]string, 0, len(entry.Data))
-	for k := range entry.Data {
-		keys = append(keys, k)
+	data := make(logrus.Fields, len(entry.Data)+3)
+	for k, v := range entry.Data {
+		switch k {
+		case "level", "time", "msg":
+			data["fields."+k] = v
+		default:
+			data[k] = v
+		}
 	}
-
-	if !f.DisableSorting {
-		sort.Strings(keys)
+	data["level"] = entry.Level.String()
+	if entry.Message != "" {
+		data["msg"] = entry.Message
+	}
+	if !f.DisableTimestamp {
+		data["time"] = f.formatTimestamp(entry.Time)
 	}
 
+	order := f.FieldOrder
+	if order == nil {
+		order = DefaultLtsvFieldOrder
+	}
 	b := &bytes.Buffer{}
-
-	prefixFieldClashes(entry.Data)
-
-	timestampFormat := f.TimestampFormat
-	if timestampFormat == "" {
-		timestampFormat = time.RFC3339
+	written := make(map[string]bool, len(order))
+	for _, key := range order {
+		if v, ok := data[key]; ok && !written[key] {
+			f.appendKeyValue(b, key, v)
+			written[key] = true
+		}
 	}
 
-	f.appendKeyValue(b, "level", entry.Level.String())
-
-	if entry.Message != "" {
-		f.appendKeyValue(b, "msg", entry.Message)
+	keys := make([]string, 0, len(data))
+	for k := range data {
+		if !written[k] {
+			keys = append(keys, k)
+		}
+	}
+	if !f.DisableSorting {
+		sort.Strings(keys)
 	}
-
 	for _, key := range keys {
-		f.appendKeyValue(b, key, entry.Data[key])
+		f.appendKeyValue(b, key, data[key])
 	}
 
-	if !f.DisableTimestamp {
-		f.appendKeyValue(b, "time", entry.Time.Format(timestampFormat))
+	// replaces the last tab with a newline
+	if b.Len() > 0 {
+		b.Truncate(b.Len() - 1)
 	}
-
 	b.WriteByte('\n')
 	return b.Bytes(), nil
 }
 
+func (f *LtsvFormatter) formatTimestamp(t time.Time) string {
+	switch f.TimestampFormat {
+	case "":
+		return t.Format(time.RFC3339)
+	case TimestampEpoch:
+		return strconv.FormatInt(t.Unix(), 10)
+	case TimestampEpochMilli:
+		return strconv.FormatInt(t.UnixNano()/int64(time.Millisecond), 10)
+	}
+	return t.Format(f.TimestampFormat)
+}
+
+// needsQuoting reports whether text must be quoted to be a LTSV value.
 func needsQuoting(text string) bool {
 	for _, ch := range text {
 		if !((ch >= 'a' && ch <= 'z') ||
 			(ch >= 'A' && ch <= 'Z') ||
 			(ch >= '0' && ch <= '9') ||
 			ch == '-' || ch == '.') {
-			return false
+			return true
 		}
 	}
-	return true
+	return false
 }
 
-func (f *LtsvFormatter) appendKeyValue(b *bytes.Buffer, key string, value interface{}) {
+func (f *LtsvFormatter) appendString(b *bytes.Buffer, s string) {
+	if needsQuoting(s) {
+		b.WriteString(strconv.Quote(s))
+	} else {
+		b.WriteString(s)
+	}
+}
 
-	b.WriteString(key)
+func (f *LtsvFormatter) appendKeyValue(b *bytes.Buffer, key string, value interface{}) {
+	appendLabel(b, key)
 	b.WriteByte(':')
 
 	switch value := value.(type) {
 	case string:
-		if needsQuoting(value) {
-			b.WriteString(value)
-		} else {
-			fmt.Fprintf(b, "%q", value)
-		}
-	case int, int64, int32:
+		f.appendString(b, value)
+	case int, int64, int32, int16, int8, uint, uint64, uint32, uint16, uint8:
 		fmt.Fprintf(b, "%d", value)
-	case float64, float32:
-		fmt.Fprintf(b, "%f", value)
+	case float64:
+		b.WriteString(strconv.FormatFloat(value, 'f', -1, 64))
+	case float32:
+		b.WriteString(strconv.FormatFloat(float64(value), 'f', -1, 32))
+	case bool:
+		b.WriteString(strconv.FormatBool(value))
 	case error:
-		errmsg := value.Error()
-		if needsQuoting(errmsg) {
-			b.WriteString(errmsg)
+		f.appendString(b, value.Error())
+	case time.Time:
+		f.appendString(b, f.formatTimestamp(value))
+	case nil:
+		b.WriteString("-")
+	default:
+		// json.Marshal escapes control characters, so the encoded value has no tabs and newlines.
+		js, err := json.Marshal(value)
+		if err != nil {
+			f.appendString(b, fmt.Sprintf("%v", value))
+		} else if len(js) > 0 && js[0] == '"' {
+			var s string
+			json.Unmarshal(js, &s)
+			f.appendString(b, s)
 		} else {
-			fmt.Fprintf(b, "%q", value)
+			b.Write(js)
 		}
-	default:
-		fmt.Fprintf(b, "\"%v\"", value)
 	}
 
 	b.WriteByte('\t')
 }
 
-func prefixFieldClashes(data logrus.Fields) {
-	if _, ok := data["time"]; ok {
-		data["fields.time"] = data["time"]
-	}
-
-	if _, ok := data["msg"]; ok {
-		data["fields.msg"] = data["msg"]
-	}
-
-	if _, ok := data["level"]; ok {
-		data["fields.level"] = data["level"]
+// appendLabel writes key replacing characters which LTSV does not allow in labels with '_'.
+func appendLabel(b *bytes.Buffer, key string) {
+	for _, ch := range []byte(key) {
+		if (ch >= 'a' && ch <= 'z') || (ch >= 'A' && ch <= 'Z') || (ch >= '0' && ch <= '9') ||
+			ch == '_' || ch == '.' || ch == '-' {
+			b.WriteByte(ch)
+		} else {
+			b.WriteByte('_')
+		}
 	}
 }
@@ -2,10 +2,16 @@ package gunfish_test
 
 import (
 	"bytes"
+	"encoding/json"
 	"errors"
+	"reflect"
+	"strconv"
+	"strings"
 	"testing"
+	"time"
 
 	gunfish "github.com/kayac/Gunfish"
+	"github.com/kayac/Gunfish/apns"
 	"github.com/sirupsen/logrus"
 )
 
@@ -34,3 +40,131 @@ func TestQuoting(t *testing.T) {
 	checkQuoting(false, errors.New("invalid"))
 	checkQuoting(true, errors.New("invalid argument"))
 }
+
+// parseLTSV parses a line of LTSV into labels in order and values, unquoting quoted values.
+func parseLTSV(t *testing.T, line []byte) ([]string, map[string]string) {
+	t.Helper()
+	if !bytes.HasSuffix(line, []byte("\n")) || bytes.Count(line, []byte("\n")) != 1 {
+		t.Fatalf("not a line: %q", line)
+	}
+	var labels []string
+	values := map[string]string{}
+	for _, field := range strings.Split(strings.TrimSuffix(string(line), "\n"), "\t") {
+		i := strings.IndexByte(field, ':')
+		if i <= 0 {
+			t.Fatalf("invalid field %q in %q", field, line)
+		}
+		label, value := field[:i], field[i+1:]
+		if strings.HasPrefix(value, `"`) {
+			var err error
+			if value, err = strconv.Unquote(value); err != nil {
+				t.Fatalf("invalid quoted value %s: %s", field, err)
+			}
+		}
+		if _, ok := values[label]; ok {
+			t.Fatalf("duplicated label %s in %q", label, line)
+		}
+		labels = append(labels, label)
+		values[label] = value
+	}
+	return labels, values
+}
+
+func TestLtsvRoundTrip(t *testing.T) {
+	payload := apns.Payload{
+		APS:      &apns.APS{Alert: apns.Alert{Title: "tab\there", Body: "new\nline"}, Sound: "default"},
+		Optional: map[string]interface{}{"uid": 1},
+	}
+	fields := logrus.Fields{
+		"string":   "multi\nline\tvalue with \"quotes\"",
+		"plain":    "v1.0",
+		"int":      42,
+		"float":    0.15,
+		"bool":     true,
+		"error":    errors.New("failed\tto send"),
+		"payload":  payload,
+		"map":      map[string]interface{}{"k": []string{"a", "b"}},
+		"nil":      nil,
+		"apns id":  "x",
+		"time":     "clash",
+		"level":    "clash",
+		"resp_uid": "abc",
+	}
+	at := time.Date(2020, 1, 2, 3, 4, 5, 678000000, time.UTC)
+	entry := logrus.WithFields(fields)
+	entry.Time = at
+	entry.Level = logrus.WarnLevel
+	entry.Message = "hello\tworld"
+
+	b, err := (&gunfish.LtsvFormatter{}).Format(entry)
+	if err != nil {
+		t.Fatal(err)
+	}
+	labels, values := parseLTSV(t, b)
+
+	if !reflect.DeepEqual(labels[:3], []string{"level", "time", "msg"}) {
+		t.Errorf("unexpected order: %v", labels)
+	}
+	want := map[string]string{
+		"level":        "warning",
+		"time":         "2020-01-02T03:04:05Z",
+		"msg":          "hello\tworld",
+		"string":       fields["string"].(string),
+		"plain":        "v1.0",
+		"int":          "42",
+		"float":        "0.15",
+		"bool":         "true",
+		"error":        "failed\tto send",
+		"map":          `{"k":["a","b"]}`,
+		"nil":          "-",
+		"apns_id":      "x",
+		"fields.time":  "clash",
+		"fields.level": "clash",
+		"resp_uid":     "abc",
+	}
+	for k, v := range want {
+		if values[k] != v {
+			t.Errorf("%s: got %q want %q", k, values[k], v)
+		}
+	}
+	var p apns.Payload
+	if err := json.Unmarshal([]byte(values["payload"]), &p); err != nil {
+		t.Fatalf("payload is not JSON: %s", err)
+	}
+	if js, _ := json.Marshal(payload); string(js) != values["payload"] {
+		t.Errorf("unexpected payload: %s", values["payload"])
+	}
+	if _, ok := fields["fields.time"]; ok {
+		t.Error("fields of the entry must not be modified")
+	}
+}
+
+func TestLtsvFieldOrderAndTimestamp(t *testing.T) {
+	at := time.Date(2020, 1, 2, 3, 4, 5, 678000000, time.UTC)
+	testCases := []struct {
+		format string
+		time   string
+	}{
+		{"", "2020-01-02T03:04:05Z"},
+		{gunfish.RFC3339Milli, "2020-01-02T03:04:05.678Z"},
+		{gunfish.TimestampEpoch, "1577934245"},
+		{gunfish.TimestampEpochMilli, "1577934245678"},
+	}
+	for _, c := range testCases {
+		entry := logrus.WithFields(logrus.Fields{"type": "worker", "b": 1, "a": 2})
+		entry.Time = at
+		entry.Message = "m"
+		f := &gunfish.LtsvFormatter{TimestampFormat: c.format, FieldOrder: []string{"time", "type", "level", "msg"}}
+		b, err := f.Format(entry)
+		if err != nil {
+			t.Fatal(err)
+		}
+		labels, values := parseLTSV(t, b)
+		if !reflect.DeepEqual(labels, []string{"time", "type", "level", "msg", "a", "b"}) {
+			t.Errorf("unexpected order: %v", labels)
+		}
+		if values["time"] != c.time {
+			t.Errorf("%q: got time %s want %s", c.format, values["time"], c.time)
+		}
+	}
+}
@@ -0,0 +1,71 @@
+package gunfish
+
+import "sync/atomic"
+
+// memoryBudget accounts bytes of notifications in the supervisor, which are estimated by the size of posted JSON.
+// Notifications are accounted when they are accepted or enqueued to be resent, and released after their responses are handled.
+// A nil memoryBudget accounts nothing and accepts everything.
+type memoryBudget struct {
+	used  int64
+	limit int64 // unlimited when 0
+}
+
+// reserve accounts n bytes, and reports whether they are within the limit. Nothing is accounted when it returns false.
+func (m *memoryBudget) reserve(n int64) bool {
+	if m == nil {
+		return true
+	}
+	for {
+		used := atomic.LoadInt64(&m.used)
+		if m.limit > 0 && used+n > m.limit {
+			return false
+		}
+		if atomic.CompareAndSwapInt64(&m.used, used, used+n) {
+			return true
+		}
+	}
+}
+
+// add accounts n bytes regardless of the limit, and releases them when n is negative.
+func (m *memoryBudget) add(n int64) {
+	if m == nil {
+		return
+	}
+	atomic.AddInt64(&m.used, n)
+}
+
+func (m *memoryBudget) load() int64 {
+	if m == nil {
+		return 0
+	}
+	return atomic.LoadInt64(&m.used)
+}
+
+func (m *memoryBudget) max() int64 {
+	if m == nil {
+		return 0
+	}
+	return m.limit
+}
+
+// setSize distributes n bytes of posted JSON to reqs as their sizes.
+func setSize(reqs []Request, n int64) {
+	if len(reqs) == 0 {
+		return
+	}
+	size, rem := n/int64(len(reqs)), n%int64(len(reqs))
+	for i := range reqs {
+		reqs[i].size = size
+		if int64(i) < rem {
+			reqs[i].size++
+		}
+	}
+}
+
+func sizeOf(reqs []Request) int64 {
+	var n int64
+	for _, req := range reqs {
+		n += req.size
+	}
+	return n
+}
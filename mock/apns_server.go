@@ -5,7 +5,6 @@ import (
 	"fmt"
 	"io"
 	"log"
-	"math/rand"
 	"net/http"
 	"strings"
 	"time"
@@ -18,21 +17,26 @@ const (
 	LimitApnsTokenByteSize = 100 // Payload byte size.
 )
 
-// StartAPNSMockServer starts HTTP/2 server for mock
+// APNsMockServer returns a handler of APNs mock server which responds in DefaultLatency.
 func APNsMockServer(verbose bool) *http.ServeMux {
+	return NewAPNsMockServer(Options{
+		Verbose: verbose,
+		Latency: DefaultLatency,
+	})
+}
+
+// NewAPNsMockServer returns a handler of APNs mock server with options.
+func NewAPNsMockServer(opts Options) *http.ServeMux {
 	mux := http.NewServeMux()
 
 	mux.HandleFunc("/3/device/", func(w http.ResponseWriter, r *http.Request) {
 		start := time.Now()
 		defer func() {
-			if verbose {
+			if opts.Verbose {
 				log.Printf("reqtime:%f proto:%s method:%s path:%s host:%s", reqtime(start), r.Proto, r.Method, r.URL.Path, r.RemoteAddr)
 			}
 		}()
 
-		// sets the response time from apns server
-		time.Sleep(time.Millisecond*200 + time.Millisecond*(time.Duration(rand.Int63n(200)-100)))
-
 		// only allow path which pattern is '/3/device/:token'
 		splitPath := strings.Split(r.URL.Path, "/")
 		if len(splitPath) != 4 {
@@ -40,11 +44,56 @@ func APNsMockServer(verbose bool) *http.ServeMux {
 			fmt.Fprintf(w, "404 Not found")
 			return
 		}
+		token := splitPath[len(splitPath)-1]
+
+		w, req, _ := opts.Scenario.begin(w, r, start)
+		req.Token = token
+		// records even if the request is dropped by panic
+		defer opts.Scenario.record(req)
+
+		if opts.ClientCAs != nil {
+			if err := verifyClientCert(r, opts.ClientCAs); err != nil {
+				if opts.Verbose {
+					log.Printf("bad certificate: %s", err)
+				}
+				w.Header().Set("Content-Type", ApplicationJSON)
+				w.WriteHeader(http.StatusForbidden)
+				createErrorResponse(w, apns.BadCertificate, http.StatusForbidden)
+				return
+			}
+		}
+		if opts.ProviderToken != nil {
+			if code, status, err := opts.ProviderToken.Verify(r); err != nil {
+				if opts.Verbose {
+					log.Printf("%s: %s", code, err)
+				}
+				w.Header().Set("Content-Type", ApplicationJSON)
+				w.WriteHeader(status)
+				createErrorResponse(w, code, status)
+				return
+			}
+		}
+
+		rule, applied := opts.Scenario.apply(r, token, r.Header.Get("apns-topic"))
+		if applied {
+			req.Rule = rule.Name
+		}
+
+		// sets the response time from apns server
+		if applied && rule.Delay > 0 {
+			time.Sleep(time.Duration(rule.Delay))
+		} else {
+			opts.Latency.sleep()
+		}
 
 		w.Header().Set("Content-Type", ApplicationJSON)
 
-		token := splitPath[len(splitPath)-1]
-		if len(([]byte(token))) > LimitApnsTokenByteSize || token == "baddevicetoken" {
+		if applied {
+			respondByRule(w, rule)
+		} else if opts.fail() {
+			w.WriteHeader(http.StatusInternalServerError)
+			createErrorResponse(w, apns.InternalServerError, http.StatusInternalServerError)
+		} else if len(([]byte(token))) > LimitApnsTokenByteSize || token == "baddevicetoken" {
 			w.Header().Set("apns-id", "apns-id")
 			w.WriteHeader(http.StatusBadRequest)
 			createErrorResponse(w, apns.BadDeviceToken, http.StatusBadRequest)
@@ -71,9 +120,32 @@ func APNsMockServer(verbose bool) *http.ServeMux {
 		return
 	})
 
+	if opts.Scenario != nil {
+		mux.Handle("/mock/", opts.Scenario)
+	}
+
 	return mux
 }
 
+// respondByRule writes a response decided by the rule.
+func respondByRule(w http.ResponseWriter, rule Rule) {
+	applyAction(w, rule)
+
+	status := rule.statusOf()
+	if status == http.StatusOK {
+		w.Header().Set("apns-id", "apns-id")
+		w.WriteHeader(status)
+		return
+	}
+
+	w.WriteHeader(status)
+	er := apns.ErrorResponse{Reason: rule.Reason}
+	if status == http.StatusGone {
+		er.Timestamp = time.Now().Unix()
+	}
+	json.NewEncoder(w).Encode(er)
+}
+
 func createErrorResponse(w io.Writer, ermsg apns.ErrorResponseCode, status int) error {
 	enc := json.NewEncoder(w)
 	var er apns.ErrorResponse
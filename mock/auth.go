@@ -0,0 +1,222 @@
+package mock
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/x509"
+	"encoding/asn1"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"math/big"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/kayac/Gunfish/apns"
+)
+
+// Limits of provider authentication tokens of APNs
+const (
+	ProviderTokenLifetime       = time.Hour
+	ProviderTokenUpdateInterval = time.Minute * 20
+	ProviderTokenClockSkew      = time.Minute // tolerance of iat in the future
+)
+
+// ProviderTokenVerifier verifies provider authentication tokens (JWT) of APNs.
+type ProviderTokenVerifier struct {
+	PublicKey *ecdsa.PublicKey
+	TeamID    string
+	Kid       string
+	Now       func() time.Time // returns the current time. time.Now is used when nil.
+
+	mu     sync.Mutex
+	tokens map[string]*providerToken // the current tokens by connections, which are the remote addresses of requests
+}
+
+// providerToken is the current token of a connection.
+type providerToken struct {
+	iat       int64
+	updatedAt time.Time // when the token was used first
+}
+
+// NewProviderTokenVerifier creates ProviderTokenVerifier.
+// key is a PEM of the PKCS#8 private key (.p8) which is used by Gunfish, or of its PKIX public key.
+func NewProviderTokenVerifier(key []byte, teamID, kid string) (*ProviderTokenVerifier, error) {
+	block, _ := pem.Decode(key)
+	if block == nil {
+		return nil, errors.New("failed to decode PEM")
+	}
+
+	var pub interface{}
+	if k, err := x509.ParsePKCS8PrivateKey(block.Bytes); err == nil {
+		if k, ok := k.(*ecdsa.PrivateKey); ok {
+			pub = &k.PublicKey
+		}
+	} else if k, err := x509.ParsePKIXPublicKey(block.Bytes); err == nil {
+		pub = k
+	} else {
+		return nil, err
+	}
+	pk, ok := pub.(*ecdsa.PublicKey)
+	if !ok {
+		return nil, errors.New("key is not ECDSA")
+	}
+
+	return &ProviderTokenVerifier{
+		PublicKey: pk,
+		TeamID:    teamID,
+		Kid:       kid,
+	}, nil
+}
+
+func (v *ProviderTokenVerifier) now() time.Time {
+	if v.Now != nil {
+		return v.Now()
+	}
+	return time.Now()
+}
+
+// Verify verifies the Authorization header of r.
+// It returns an error response code of APNs and its status when the token is not acceptable.
+func (v *ProviderTokenVerifier) Verify(r *http.Request) (apns.ErrorResponseCode, int, error) {
+	auth := r.Header.Get("Authorization")
+	if auth == "" {
+		return apns.MissingProviderToken, http.StatusForbidden, errors.New("authorization header is missing")
+	}
+	if len(auth) < 7 || !strings.EqualFold(auth[:7], "bearer ") {
+		return apns.InvalidProviderToken, http.StatusForbidden, errors.New("authorization header is not bearer")
+	}
+
+	iat, err := v.parse(auth[7:])
+	if err != nil {
+		return apns.InvalidProviderToken, http.StatusForbidden, err
+	}
+
+	now := v.now()
+	issuedAt := time.Unix(iat, 0)
+	if issuedAt.After(now.Add(ProviderTokenClockSkew)) {
+		return apns.InvalidProviderToken, http.StatusForbidden, fmt.Errorf("iat %d is in the future", iat)
+	}
+	if now.Sub(issuedAt) > ProviderTokenLifetime {
+		return apns.ExpiredProviderToken, http.StatusForbidden, fmt.Errorf("iat %d is older than %s", iat, ProviderTokenLifetime)
+	}
+
+	// APNs limits updates of the token per connection
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	cur, ok := v.tokens[r.RemoteAddr]
+	if !ok {
+		v.prune(now)
+		v.tokens[r.RemoteAddr] = &providerToken{iat: iat, updatedAt: now}
+		return 0, http.StatusOK, nil
+	}
+	if iat != cur.iat {
+		if now.Sub(cur.updatedAt) < ProviderTokenUpdateInterval {
+			return apns.TooManyProviderTokenUpdates, http.StatusTooManyRequests, fmt.Errorf("token was updated within %s", ProviderTokenUpdateInterval)
+		}
+		cur.iat = iat
+		cur.updatedAt = now
+	}
+	return 0, http.StatusOK, nil
+}
+
+// prune removes the tokens which have expired, so that closed connections do not remain.
+// An update after the lifetime is always accepted, so removing them does not change the results.
+func (v *ProviderTokenVerifier) prune(now time.Time) {
+	if v.tokens == nil {
+		v.tokens = make(map[string]*providerToken)
+	}
+	for addr, t := range v.tokens {
+		if now.Sub(t.updatedAt) > ProviderTokenLifetime {
+			delete(v.tokens, addr)
+		}
+	}
+}
+
+// parse verifies the signature, kid and iss of the JWT, and returns iat of it.
+func (v *ProviderTokenVerifier) parse(token string) (int64, error) {
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return 0, errors.New("token is not JWT")
+	}
+
+	var header struct {
+		Alg string `json:"alg"`
+		Kid string `json:"kid"`
+	}
+	if err := decodeSegment(parts[0], &header); err != nil {
+		return 0, err
+	}
+	if header.Alg != "ES256" {
+		return 0, fmt.Errorf("unexpected alg: %s", header.Alg)
+	}
+	if header.Kid != v.Kid {
+		return 0, fmt.Errorf("unexpected kid: %s", header.Kid)
+	}
+
+	var claim struct {
+		Iss string `json:"iss"`
+		Iat int64  `json:"iat"`
+	}
+	if err := decodeSegment(parts[1], &claim); err != nil {
+		return 0, err
+	}
+	if claim.Iss != v.TeamID {
+		return 0, fmt.Errorf("unexpected iss: %s", claim.Iss)
+	}
+
+	sig, err := base64.RawURLEncoding.DecodeString(parts[2])
+	if err != nil {
+		return 0, err
+	}
+	var r, s *big.Int
+	if len(sig) == 64 {
+		// JWS format, R || S
+		r, s = new(big.Int).SetBytes(sig[:32]), new(big.Int).SetBytes(sig[32:])
+	} else {
+		// ASN.1 DER format which apns.CreateJWT generates
+		var es struct{ R, S *big.Int }
+		if _, err := asn1.Unmarshal(sig, &es); err != nil {
+			return 0, err
+		}
+		r, s = es.R, es.S
+	}
+	h := crypto.SHA256.New()
+	h.Write([]byte(parts[0] + "." + parts[1]))
+	if !ecdsa.Verify(v.PublicKey, h.Sum(nil), r, s) {
+		return 0, errors.New("invalid signature")
+	}
+
+	return claim.Iat, nil
+}
+
+func decodeSegment(seg string, v interface{}) error {
+	b, err := base64.RawURLEncoding.DecodeString(seg)
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(b, v)
+}
+
+// verifyClientCert verifies the TLS client certificate of r against roots.
+// The server must request client certificates by tls.Config.ClientAuth, e.g. tls.RequestClientCert.
+func verifyClientCert(r *http.Request, roots *x509.CertPool) error {
+	if r.TLS == nil || len(r.TLS.PeerCertificates) == 0 {
+		return errors.New("client certificate is missing")
+	}
+	certs := r.TLS.PeerCertificates
+	intermediates := x509.NewCertPool()
+	for _, c := range certs[1:] {
+		intermediates.AddCert(c)
+	}
+	_, err := certs[0].Verify(x509.VerifyOptions{
+		Roots:         roots,
+		Intermediates: intermediates,
+		KeyUsages:     []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+	})
+	return err
+}
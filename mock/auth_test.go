@@ -0,0 +1,220 @@
+package mock_test
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/pem"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/kayac/Gunfish/apns"
+	"github.com/kayac/Gunfish/config"
+	"github.com/kayac/Gunfish/mock"
+	"golang.org/x/net/http2"
+)
+
+func generateP8(t *testing.T) []byte {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	der, err := x509.MarshalPKCS8PrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: der})
+}
+
+func verifyToken(v *mock.ProviderTokenVerifier, token string) (apns.ErrorResponseCode, int, error) {
+	return verifyTokenFrom(v, token, "192.0.2.1:10000")
+}
+
+func verifyTokenFrom(v *mock.ProviderTokenVerifier, token, remoteAddr string) (apns.ErrorResponseCode, int, error) {
+	r, _ := http.NewRequest(http.MethodPost, "/3/device/xxx", nil)
+	r.RemoteAddr = remoteAddr
+	if token != "" {
+		r.Header.Set("Authorization", "bearer "+token)
+	}
+	return v.Verify(r)
+}
+
+func TestProviderTokenVerifier(t *testing.T) {
+	key := generateP8(t)
+	now := time.Date(2020, 1, 1, 12, 0, 0, 0, time.UTC)
+	v, err := mock.NewProviderTokenVerifier(key, "TEAMID", "KID")
+	if err != nil {
+		t.Fatal(err)
+	}
+	v.Now = func() time.Time { return now }
+
+	iat := apns.ProviderTokenTime(now)
+	valid, _ := apns.CreateJWT(key, "KID", "TEAMID", iat)
+	wrongKid, _ := apns.CreateJWT(key, "OTHER", "TEAMID", iat)
+	wrongTeam, _ := apns.CreateJWT(key, "KID", "OTHER", iat)
+	wrongKey, _ := apns.CreateJWT(generateP8(t), "KID", "TEAMID", iat)
+	stale, _ := apns.CreateJWT(key, "KID", "TEAMID", now.Add(-time.Hour-time.Second).Unix())
+	future, _ := apns.CreateJWT(key, "KID", "TEAMID", now.Add(time.Hour).Unix())
+
+	testCases := []struct {
+		name   string
+		token  string
+		status int
+		code   apns.ErrorResponseCode
+	}{
+		{"valid", valid, http.StatusOK, 0},
+		{"missing", "", http.StatusForbidden, apns.MissingProviderToken},
+		{"malformed", "xxx", http.StatusForbidden, apns.InvalidProviderToken},
+		{"wrong kid", wrongKid, http.StatusForbidden, apns.InvalidProviderToken},
+		{"wrong team id", wrongTeam, http.StatusForbidden, apns.InvalidProviderToken},
+		{"wrong key", wrongKey, http.StatusForbidden, apns.InvalidProviderToken},
+		{"stale iat", stale, http.StatusForbidden, apns.ExpiredProviderToken},
+		{"future iat", future, http.StatusForbidden, apns.InvalidProviderToken},
+	}
+	for _, c := range testCases {
+		code, status, err := verifyToken(v, c.token)
+		if status != c.status {
+			t.Errorf("%s: unexpected status %d want %d: %v", c.name, status, c.status, err)
+		}
+		if status != http.StatusOK && code != c.code {
+			t.Errorf("%s: unexpected code %s want %s", c.name, code, c.code)
+		}
+	}
+
+	// updates the token within 20 minutes
+	now = now.Add(time.Minute * 10)
+	updated, _ := apns.CreateJWT(key, "KID", "TEAMID", iat+60)
+	if code, _, err := verifyToken(v, updated); code != apns.TooManyProviderTokenUpdates {
+		t.Errorf("unexpected code %s: %v", code, err)
+	}
+	// the same iat with a different signature is not an update
+	again, _ := apns.CreateJWT(key, "KID", "TEAMID", iat)
+	if _, status, err := verifyToken(v, again); status != http.StatusOK {
+		t.Errorf("unexpected status %d: %v", status, err)
+	}
+
+	// other connections use the new token while the old one is still used
+	if _, status, err := verifyTokenFrom(v, updated, "192.0.2.1:10001"); status != http.StatusOK {
+		t.Errorf("unexpected status %d: %v", status, err)
+	}
+	if _, status, err := verifyTokenFrom(v, valid, "192.0.2.1:10002"); status != http.StatusOK {
+		t.Errorf("unexpected status %d: %v", status, err)
+	}
+
+	now = now.Add(time.Minute * 20)
+	if _, status, err := verifyToken(v, updated); status != http.StatusOK {
+		t.Errorf("unexpected status %d: %v", status, err)
+	}
+}
+
+func TestAPNsMockServerWithProviderToken(t *testing.T) {
+	dir, err := ioutil.TempDir("", "gunfish-mock")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	key := generateP8(t)
+	keyFile := filepath.Join(dir, "key.p8")
+	if err := ioutil.WriteFile(keyFile, key, 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	v, err := mock.NewProviderTokenVerifier(key, "TEAMID", "KID")
+	if err != nil {
+		t.Fatal(err)
+	}
+	ts := httptest.NewUnstartedServer(mock.NewAPNsMockServer(mock.Options{
+		Latency:       mock.Latency{Distribution: mock.Fixed},
+		ProviderToken: v,
+	}))
+	if err := http2.ConfigureServer(ts.Config, nil); err != nil {
+		t.Fatal(err)
+	}
+	ts.TLS = ts.Config.TLSConfig
+	ts.StartTLS()
+	defer ts.Close()
+	client := &http.Client{Transport: &http2.Transport{TLSClientConfig: &tls.Config{InsecureSkipVerify: true}}}
+
+	for _, kid := range []string{"KID", "OTHER"} {
+		ac, err := apns.NewClient(config.SectionApns{Host: ts.URL, KeyFile: keyFile, Kid: kid, TeamID: "TEAMID"})
+		if err != nil {
+			t.Fatal(err)
+		}
+		req, err := ac.NewRequest("xxx", nil, apns.Payload{})
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp, err := client.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		reason := reasonOf(t, resp)
+		switch kid {
+		case "KID":
+			if resp.StatusCode != http.StatusOK {
+				t.Errorf("unexpected status: %d %s", resp.StatusCode, reason)
+			}
+		default:
+			if resp.StatusCode != http.StatusForbidden || reason != apns.InvalidProviderToken.String() {
+				t.Errorf("unexpected response: %d %s", resp.StatusCode, reason)
+			}
+		}
+	}
+}
+
+func TestAPNsMockServerWithClientCert(t *testing.T) {
+	dir, err := ioutil.TempDir("", "gunfish-mock")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	certFile, keyFile, err := mock.WriteCertificate(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	pool := x509.NewCertPool()
+	ca, _ := ioutil.ReadFile(certFile)
+	pool.AppendCertsFromPEM(ca)
+
+	ts := httptest.NewUnstartedServer(mock.NewAPNsMockServer(mock.Options{
+		Latency:   mock.Latency{Distribution: mock.Fixed},
+		ClientCAs: pool,
+	}))
+	if err := http2.ConfigureServer(ts.Config, nil); err != nil {
+		t.Fatal(err)
+	}
+	ts.TLS = ts.Config.TLSConfig
+	ts.TLS.ClientAuth = tls.RequestClientCert
+	ts.StartTLS()
+	defer ts.Close()
+
+	for _, certs := range [][]tls.Certificate{{cert}, nil} {
+		client := &http.Client{Transport: &http2.Transport{TLSClientConfig: &tls.Config{
+			InsecureSkipVerify: true,
+			Certificates:       certs,
+		}}}
+		resp, err := client.Post(ts.URL+"/3/device/xxx", mock.ApplicationJSON, strings.NewReader("{}"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		reason := reasonOf(t, resp)
+		if certs != nil && resp.StatusCode != http.StatusOK {
+			t.Errorf("unexpected response with client certificate: %d %s", resp.StatusCode, reason)
+		}
+		if certs == nil && (resp.StatusCode != http.StatusForbidden || reason != apns.BadCertificate.String()) {
+			t.Errorf("unexpected response without client certificate: %d %s", resp.StatusCode, reason)
+		}
+	}
+}
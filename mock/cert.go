@@ -0,0 +1,89 @@
+package mock
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/json"
+	"encoding/pem"
+	"io/ioutil"
+	"math/big"
+	"net"
+	"path/filepath"
+	"time"
+)
+
+// WriteCertificate generates a self-signed certificate for localhost and its key,
+// and writes them into dir as server.crt and server.key.
+func WriteCertificate(dir string) (certFile, keyFile string, err error) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return "", "", err
+	}
+
+	tmpl := x509.Certificate{
+		SerialNumber:          big.NewInt(time.Now().UnixNano()),
+		Subject:               pkix.Name{Organization: []string{"Gunfish Test"}, CommonName: "localhost"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour * 24 * 365),
+		KeyUsage:              x509.KeyUsageDigitalSignature | x509.KeyUsageKeyEncipherment | x509.KeyUsageCertSign,
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+		DNSNames:              []string{"localhost"},
+		IPAddresses:           []net.IP{net.ParseIP("127.0.0.1"), net.ParseIP("::1")},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, &tmpl, &tmpl, &key.PublicKey, key)
+	if err != nil {
+		return "", "", err
+	}
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		return "", "", err
+	}
+
+	certFile = filepath.Join(dir, "server.crt")
+	keyFile = filepath.Join(dir, "server.key")
+	certPEM := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})
+	if err := ioutil.WriteFile(certFile, certPEM, 0644); err != nil {
+		return "", "", err
+	}
+	keyPEM := pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER})
+	if err := ioutil.WriteFile(keyFile, keyPEM, 0600); err != nil {
+		return "", "", err
+	}
+	return certFile, keyFile, nil
+}
+
+// WriteServiceAccount generates a service account JSON of Google Cloud whose token_uri is tokenURL,
+// and writes it into dir as service_account.json.
+// Gunfish can use it as google_application_credentials to get MockAccessToken from FCMv1MockServer.
+func WriteServiceAccount(dir, tokenURL, projectID string) (string, error) {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		return "", err
+	}
+	keyPEM := pem.EncodeToMemory(&pem.Block{Type: "RSA PRIVATE KEY", Bytes: x509.MarshalPKCS1PrivateKey(key)})
+
+	b, err := json.MarshalIndent(map[string]string{
+		"type":           "service_account",
+		"project_id":     projectID,
+		"private_key_id": "mock",
+		"private_key":    string(keyPEM),
+		"client_email":   "gunfish@" + projectID + ".iam.gserviceaccount.com",
+		"client_id":      "0",
+		"token_uri":      tokenURL,
+	}, "", "  ")
+	if err != nil {
+		return "", err
+	}
+
+	file := filepath.Join(dir, "service_account.json")
+	if err := ioutil.WriteFile(file, b, 0600); err != nil {
+		return "", err
+	}
+	return file, nil
+}
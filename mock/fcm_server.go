@@ -0,0 +1,129 @@
+package mock
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/kayac/Gunfish/fcm"
+)
+
+// FCMMockServer returns a handler of FCM legacy mock server with options.
+//
+// Rules of the scenario are evaluated for each registration id. A rule which has
+// Action or Status other than 200 decides the response of the whole request, and
+// a rule which has only Reason sets the error of the result for the registration id.
+func FCMMockServer(opts Options) *http.ServeMux {
+	mux := http.NewServeMux()
+
+	mux.HandleFunc("/fcm/send", func(w http.ResponseWriter, r *http.Request) {
+		start := time.Now()
+		defer func() {
+			if opts.Verbose {
+				log.Printf("reqtime:%f proto:%s method:%s path:%s host:%s", reqtime(start), r.Proto, r.Method, r.URL.Path, r.RemoteAddr)
+			}
+		}()
+
+		w, req, b := opts.Scenario.begin(w, r, start)
+		// records even if the request is dropped by panic
+		defer opts.Scenario.record(req)
+
+		if !strings.HasPrefix(r.Header.Get("Authorization"), "key=") {
+			w.WriteHeader(http.StatusUnauthorized)
+			fmt.Fprint(w, "Unauthorized")
+			return
+		}
+
+		var p fcm.Payload
+		if err := json.Unmarshal(b, &p); err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+
+		ids := p.RegistrationIDs
+		if len(ids) == 0 {
+			ids = []string{p.To}
+		}
+		var topic string
+		if strings.HasPrefix(p.To, "/topics/") {
+			topic = strings.TrimPrefix(p.To, "/topics/")
+		}
+		req.Token = strings.Join(ids, ",")
+
+		var (
+			rules   = make([]*Rule, len(ids))
+			names   []string
+			whole   *Rule
+			delay   Duration
+			applied bool
+		)
+		for i, id := range ids {
+			rule, ok := opts.Scenario.apply(r, id, topic)
+			if !ok {
+				continue
+			}
+			applied = true
+			rules[i] = &rule
+			names = append(names, rule.Name)
+			if rule.Delay > delay {
+				delay = rule.Delay
+			}
+			if whole == nil && (rule.Action != "" || (rule.Status != 0 && rule.Status != http.StatusOK)) {
+				whole = &rule
+			}
+		}
+		req.Rule = strings.Join(names, ",")
+
+		if applied && delay > 0 {
+			time.Sleep(time.Duration(delay))
+		} else {
+			opts.Latency.sleep()
+		}
+
+		if whole != nil {
+			applyAction(w, *whole)
+			if status := whole.Status; status != 0 && status != http.StatusOK {
+				w.WriteHeader(status)
+				fmt.Fprint(w, http.StatusText(status))
+				return
+			}
+		}
+
+		body := fcm.ResponseBody{
+			MulticastID: int(start.UnixNano()),
+			Results:     make([]fcm.Result, 0, len(ids)),
+		}
+		for i, id := range ids {
+			var res fcm.Result
+			switch {
+			case rules[i] != nil:
+				res.Error = rules[i].Reason
+			case opts.fail():
+				res.Error = fcm.Unavailable.String()
+			case id == "notregistered":
+				res.Error = fcm.NotRegistered.String()
+			case id == "invalidregistration" || id == "":
+				res.Error = fcm.InvalidRegistration.String()
+			}
+			if res.Error != "" {
+				body.Failure++
+			} else {
+				res.MessageID = fmt.Sprintf("0:%d%%mock", start.UnixNano()+int64(i))
+				body.Success++
+			}
+			body.Results = append(body.Results, res)
+		}
+
+		w.Header().Set("Content-Type", ApplicationJSON)
+		json.NewEncoder(w).Encode(body)
+	})
+
+	if opts.Scenario != nil {
+		mux.Handle("/mock/", opts.Scenario)
+	}
+
+	return mux
+}
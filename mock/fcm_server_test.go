@@ -0,0 +1,112 @@
+package mock_test
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+
+	"github.com/kayac/Gunfish/fcm"
+	"github.com/kayac/Gunfish/fcmv1"
+	"github.com/kayac/Gunfish/mock"
+)
+
+func TestFCMMockServer(t *testing.T) {
+	scenario := mock.NewScenario(mock.Rule{Match: mock.Match{Token: "quota*"}, Reason: "DeviceMessageRateExceeded"})
+	ts := httptest.NewServer(mock.FCMMockServer(mock.Options{Scenario: scenario}))
+	defer ts.Close()
+
+	req, _ := http.NewRequest(http.MethodPost, ts.URL+"/fcm/send", strings.NewReader(`{"registration_ids":["aaa","notregistered","quota1"]}`))
+	req.Header.Set("Authorization", "key=test")
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+
+	var body fcm.ResponseBody
+	if err := json.NewDecoder(resp.Body).Decode(&body); err != nil {
+		t.Fatal(err)
+	}
+	if body.Success != 1 || body.Failure != 2 || len(body.Results) != 3 {
+		t.Fatalf("unexpected response: %#v", body)
+	}
+	for i, e := range []string{"", "NotRegistered", "DeviceMessageRateExceeded"} {
+		if body.Results[i].Error != e {
+			t.Errorf("#%d unexpected error: %s want %s", i, body.Results[i].Error, e)
+		}
+	}
+	if body.Results[0].MessageID == "" {
+		t.Error("message_id is empty")
+	}
+}
+
+func TestFCMv1MockServer(t *testing.T) {
+	ts := httptest.NewServer(mock.FCMv1MockServer(mock.Options{}))
+	defer ts.Close()
+
+	resp, err := http.PostForm(ts.URL+"/token", url.Values{
+		"grant_type": {"urn:ietf:params:oauth:grant-type:jwt-bearer"},
+		"assertion":  {"jwt"},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	var token struct {
+		AccessToken string `json:"access_token"`
+	}
+	json.NewDecoder(resp.Body).Decode(&token)
+	resp.Body.Close()
+	if token.AccessToken != mock.MockAccessToken {
+		t.Fatalf("unexpected access token: %s", token.AccessToken)
+	}
+
+	testCases := []struct {
+		token     string
+		status    int
+		errStatus string
+		errorCode string
+	}{
+		{"aaa", http.StatusOK, "", ""},
+		{"unregistered", http.StatusNotFound, "NOT_FOUND", fcmv1.Unregistered},
+		{"invalidargument", http.StatusBadRequest, "INVALID_ARGUMENT", fcmv1.InvalidArgument},
+	}
+	for _, c := range testCases {
+		req, _ := http.NewRequest(http.MethodPost, ts.URL+"/v1/projects/test/messages:send", strings.NewReader(`{"message":{"token":"`+c.token+`"}}`))
+		req.Header.Set("Authorization", "Bearer "+token.AccessToken)
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var body fcmv1.ResponseBody
+		err = json.NewDecoder(resp.Body).Decode(&body)
+		resp.Body.Close()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if resp.StatusCode != c.status {
+			t.Errorf("%s: unexpected status: %d want %d", c.token, resp.StatusCode, c.status)
+		}
+		if c.status == http.StatusOK {
+			if body.Name == "" || body.Error != nil {
+				t.Errorf("%s: unexpected response: %#v", c.token, body)
+			}
+			continue
+		}
+		if body.Error == nil || body.Error.Status != c.errStatus || len(body.Error.Details) != 1 || body.Error.Details[0].ErrorCode != c.errorCode {
+			t.Errorf("%s: unexpected error: %#v", c.token, body.Error)
+		}
+	}
+
+	req, _ := http.NewRequest(http.MethodPost, ts.URL+"/v1/projects/test/messages:send", strings.NewReader(`{"message":{"token":"aaa"}}`))
+	resp, err = http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusUnauthorized {
+		t.Errorf("unexpected status without access token: %d", resp.StatusCode)
+	}
+}
@@ -0,0 +1,152 @@
+package mock
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/kayac/Gunfish/fcmv1"
+)
+
+// MockAccessToken is the OAuth 2.0 access token which the fake token endpoint issues.
+const MockAccessToken = "mock-access-token"
+
+// FCMErrorType is @type of the details in FCM v1 error responses.
+const FCMErrorType = "type.googleapis.com/google.firebase.fcm.v1.FcmError"
+
+// googleStatus is the canonical error code of Google APIs for HTTP status.
+var googleStatus = map[int]string{
+	http.StatusBadRequest:          "INVALID_ARGUMENT",
+	http.StatusUnauthorized:        "UNAUTHENTICATED",
+	http.StatusForbidden:           "PERMISSION_DENIED",
+	http.StatusNotFound:            "NOT_FOUND",
+	http.StatusTooManyRequests:     "RESOURCE_EXHAUSTED",
+	http.StatusInternalServerError: "INTERNAL",
+	http.StatusServiceUnavailable:  "UNAVAILABLE",
+}
+
+// FCMv1MockServer returns a handler of FCM v1 mock server with options.
+// It serves /v1/projects/:project_id/messages:send and the fake OAuth 2.0 token endpoint /token.
+//
+// Reason of a rule is errorCode in the details of the error response.
+func FCMv1MockServer(opts Options) *http.ServeMux {
+	mux := http.NewServeMux()
+
+	mux.HandleFunc("/v1/projects/", func(w http.ResponseWriter, r *http.Request) {
+		start := time.Now()
+		defer func() {
+			if opts.Verbose {
+				log.Printf("reqtime:%f proto:%s method:%s path:%s host:%s", reqtime(start), r.Proto, r.Method, r.URL.Path, r.RemoteAddr)
+			}
+		}()
+
+		// only allow path which pattern is '/v1/projects/:project_id/messages:send'
+		splitPath := strings.Split(r.URL.Path, "/")
+		if len(splitPath) != 5 || splitPath[4] != "messages:send" {
+			w.WriteHeader(http.StatusNotFound)
+			fmt.Fprintf(w, "404 Not found")
+			return
+		}
+		project := splitPath[3]
+
+		w, req, b := opts.Scenario.begin(w, r, start)
+		// records even if the request is dropped by panic
+		defer opts.Scenario.record(req)
+
+		if r.Header.Get("Authorization") != "Bearer "+MockAccessToken {
+			writeFCMv1Error(w, http.StatusUnauthorized, "", "Request had invalid authentication credentials.")
+			return
+		}
+
+		var p fcmv1.Payload
+		if err := json.Unmarshal(b, &p); err != nil {
+			writeFCMv1Error(w, http.StatusBadRequest, "", err.Error())
+			return
+		}
+		token := p.Message.Token
+		req.Token = token
+
+		rule, applied := opts.Scenario.apply(r, token, p.Message.Topic)
+		if applied {
+			req.Rule = rule.Name
+		}
+
+		if applied && rule.Delay > 0 {
+			time.Sleep(time.Duration(rule.Delay))
+		} else {
+			opts.Latency.sleep()
+		}
+
+		if applied {
+			applyAction(w, rule)
+			if status := rule.statusOf(); status != http.StatusOK {
+				writeFCMv1Error(w, status, rule.Reason, "")
+				return
+			}
+		} else if opts.fail() {
+			writeFCMv1Error(w, http.StatusServiceUnavailable, "UNAVAILABLE", "The server is overloaded.")
+			return
+		} else if token == "" && p.Message.Topic == "" && p.Message.Condition == "" {
+			writeFCMv1Error(w, http.StatusBadRequest, fcmv1.InvalidArgument, "Recipient of the message is not set.")
+			return
+		} else if token == "invalidargument" {
+			writeFCMv1Error(w, http.StatusBadRequest, fcmv1.InvalidArgument, "The registration token is not a valid FCM registration token")
+			return
+		} else if token == "unregistered" {
+			writeFCMv1Error(w, http.StatusNotFound, fcmv1.Unregistered, "Requested entity was not found.")
+			return
+		}
+
+		w.Header().Set("Content-Type", ApplicationJSON)
+		json.NewEncoder(w).Encode(fcmv1.ResponseBody{
+			Name: fmt.Sprintf("projects/%s/messages/0:%d%%mock", project, start.UnixNano()),
+		})
+	})
+
+	mux.HandleFunc("/token", tokenHandler)
+
+	if opts.Scenario != nil {
+		mux.Handle("/mock/", opts.Scenario)
+	}
+
+	return mux
+}
+
+// writeFCMv1Error writes an error response of FCM v1.
+func writeFCMv1Error(w http.ResponseWriter, status int, errorCode, message string) {
+	e := fcmv1.FCMError{
+		Status:  googleStatus[status],
+		Message: message,
+	}
+	if e.Status == "" {
+		e.Status = "UNKNOWN"
+	}
+	if errorCode != "" {
+		e.Details = []fcmv1.Detail{{Type: FCMErrorType, ErrorCode: errorCode}}
+	}
+	w.Header().Set("Content-Type", ApplicationJSON)
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(fcmv1.ResponseBody{Error: &e})
+}
+
+// tokenHandler is the fake OAuth 2.0 token endpoint for service accounts.
+// It issues MockAccessToken for any JWT assertion.
+func tokenHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", ApplicationJSON)
+	if r.Method != http.MethodPost || r.FormValue("assertion") == "" {
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(map[string]string{
+			"error":             "invalid_grant",
+			"error_description": "assertion is required",
+		})
+		return
+	}
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"access_token": MockAccessToken,
+		"token_type":   "Bearer",
+		"expires_in":   3600,
+	})
+}
@@ -0,0 +1,84 @@
+package mock
+
+import (
+	"crypto/x509"
+	"math/rand"
+	"time"
+)
+
+// Distributions of the response time
+const (
+	Fixed       = "fixed"
+	Uniform     = "uniform"
+	Normal      = "normal"
+	Exponential = "exponential"
+)
+
+// DefaultLatency is the response time of mock servers, 200ms ± 100ms.
+var DefaultLatency = Latency{
+	Mean:         time.Millisecond * 200,
+	Jitter:       time.Millisecond * 100,
+	Distribution: Uniform,
+}
+
+// Latency is the distribution of the response time of mock servers.
+type Latency struct {
+	Mean         time.Duration
+	Jitter       time.Duration // half width for uniform, standard deviation for normal.
+	Distribution string
+}
+
+// Options are options of mock servers.
+type Options struct {
+	Verbose   bool
+	Latency   Latency
+	ErrorRate float64 // rate of error responses in 0.0-1.0
+
+	// Scenario overrides responses by its rules and records requests.
+	// The control API of it is served under /mock/.
+	Scenario *Scenario
+
+	// ProviderToken verifies provider authentication tokens of APNs requests when it is not nil.
+	ProviderToken *ProviderTokenVerifier
+
+	// ClientCAs verifies TLS client certificates of APNs requests when it is not nil.
+	// The server must request client certificates by tls.Config.ClientAuth.
+	ClientCAs *x509.CertPool
+}
+
+// Duration returns a response time in the distribution.
+func (l Latency) Duration() time.Duration {
+	if d := l.duration(); d > 0 {
+		return d
+	}
+	return 0
+}
+
+func (l Latency) duration() time.Duration {
+	switch l.Distribution {
+	case Uniform:
+		if l.Jitter > 0 {
+			return l.Mean + time.Duration(rand.Int63n(int64(l.Jitter)*2)) - l.Jitter
+		}
+	case Normal:
+		return l.Mean + time.Duration(rand.NormFloat64()*float64(l.Jitter))
+	case Exponential:
+		return time.Duration(rand.ExpFloat64() * float64(l.Mean))
+	}
+	return l.Mean
+}
+
+// sleep waits for the response time.
+func (l Latency) sleep() {
+	if d := l.Duration(); d > 0 {
+		time.Sleep(d)
+	}
+}
+
+// fail decides whether to return an error response by ErrorRate.
+func (o Options) fail() bool {
+	if o.ErrorRate <= 0 {
+		return false
+	}
+	return rand.Float64() < o.ErrorRate
+}
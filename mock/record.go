@@ -0,0 +1,341 @@
+package mock
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/kayac/Gunfish/fcm"
+)
+
+// Exchange is a pair of a request to a provider and its response, recorded by Recorder.
+// Device tokens and credentials in it are redacted.
+type Exchange struct {
+	Time           time.Time   `json:"time"`
+	Elapsed        Duration    `json:"elapsed"`
+	Method         string      `json:"method"`
+	Path           string      `json:"path"`
+	RequestHeader  http.Header `json:"request_header,omitempty"`
+	RequestBody    string      `json:"request_body,omitempty"`
+	Status         int         `json:"status,omitempty"`
+	ResponseHeader http.Header `json:"response_header,omitempty"`
+	ResponseBody   string      `json:"response_body,omitempty"`
+	Error          string      `json:"error,omitempty"` // the upstream did not respond by the error
+}
+
+// LoadExchanges loads exchanges from a file written by Recorder, which has a JSON object per line.
+func LoadExchanges(file string) ([]Exchange, error) {
+	f, err := os.Open(file)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	var exs []Exchange
+	dec := json.NewDecoder(bufio.NewReader(f))
+	for {
+		var ex Exchange
+		if err := dec.Decode(&ex); err == io.EOF {
+			return exs, nil
+		} else if err != nil {
+			return nil, fmt.Errorf("%s: %s", file, err)
+		}
+		exs = append(exs, ex)
+	}
+}
+
+// Redact returns a digest of a device token or a credential.
+// The same value is redacted to the same digest, so recorded requests can be told apart.
+func Redact(s string) string {
+	sum := sha256.Sum256([]byte(s))
+	return "redacted-" + hex.EncodeToString(sum[:6])
+}
+
+// redactedKeys are keys of device tokens in request and response bodies of providers.
+var redactedKeys = map[string]bool{
+	"to":               true,
+	"registration_ids": true,
+	"registration_id":  true,
+	"token":            true,
+}
+
+// redactBody redacts values of redactedKeys in a JSON body.
+func redactBody(b []byte) string {
+	if len(b) == 0 {
+		return ""
+	}
+	var v interface{}
+	if err := json.Unmarshal(b, &v); err != nil {
+		return string(b)
+	}
+	var redact func(v interface{}) interface{}
+	redact = func(v interface{}) interface{} {
+		switch t := v.(type) {
+		case map[string]interface{}:
+			for k, e := range t {
+				if redactedKeys[k] {
+					t[k] = redactValue(e)
+				} else {
+					t[k] = redact(e)
+				}
+			}
+		case []interface{}:
+			for i, e := range t {
+				t[i] = redact(e)
+			}
+		}
+		return v
+	}
+	b, _ = json.Marshal(redact(v))
+	return string(b)
+}
+
+func redactValue(v interface{}) interface{} {
+	switch t := v.(type) {
+	case string:
+		return Redact(t)
+	case []interface{}:
+		for i, e := range t {
+			t[i] = redactValue(e)
+		}
+	}
+	return v
+}
+
+func redactPath(p string) string {
+	if strings.HasPrefix(p, "/3/device/") {
+		return "/3/device/" + Redact(strings.TrimPrefix(p, "/3/device/"))
+	}
+	return p
+}
+
+func redactHeader(h http.Header) http.Header {
+	rh := make(http.Header, len(h))
+	for k, vs := range h {
+		switch http.CanonicalHeaderKey(k) {
+		case "Authorization":
+			for _, v := range vs {
+				if i := strings.IndexAny(v, " ="); i >= 0 {
+					rh.Add(k, v[:i+1]+Redact(v[i+1:]))
+				} else {
+					rh.Add(k, Redact(v))
+				}
+			}
+		case "Content-Length", "Connection", "Date":
+		default:
+			rh[k] = append([]string(nil), vs...)
+		}
+	}
+	return rh
+}
+
+// Recorder is a reverse proxy which forwards requests to a real provider and records the exchanges.
+type Recorder struct {
+	Upstream  *url.URL
+	Transport http.RoundTripper // http.DefaultTransport is used when nil
+	Verbose   bool
+
+	mu  sync.Mutex
+	enc *json.Encoder
+}
+
+// NewRecorder creates Recorder which writes exchanges with upstream into w, a JSON object per line.
+func NewRecorder(upstream *url.URL, transport http.RoundTripper, w io.Writer) *Recorder {
+	return &Recorder{
+		Upstream:  upstream,
+		Transport: transport,
+		enc:       json.NewEncoder(w),
+	}
+}
+
+func (rec *Recorder) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	start := time.Now()
+	body, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+	ex := Exchange{
+		Time:          start,
+		Method:        r.Method,
+		Path:          redactPath(r.URL.Path),
+		RequestHeader: redactHeader(r.Header),
+		RequestBody:   redactBody(body),
+	}
+	defer func() {
+		rec.mu.Lock()
+		defer rec.mu.Unlock()
+		if err := rec.enc.Encode(ex); err != nil {
+			log.Printf("failed to record: %s", err)
+		}
+		if rec.Verbose {
+			log.Printf("recorded elapsed:%s method:%s path:%s status:%d error:%s", time.Duration(ex.Elapsed), ex.Method, ex.Path, ex.Status, ex.Error)
+		}
+	}()
+
+	u := *rec.Upstream
+	u.Path = strings.TrimSuffix(u.Path, "/") + r.URL.Path
+	u.RawQuery = r.URL.RawQuery
+	out, err := http.NewRequest(r.Method, u.String(), bytes.NewReader(body))
+	if err != nil {
+		ex.Error = err.Error()
+		w.WriteHeader(http.StatusBadGateway)
+		return
+	}
+	out = out.WithContext(r.Context())
+	for k, vs := range r.Header {
+		if k != "Connection" {
+			out.Header[k] = vs
+		}
+	}
+
+	tr := rec.Transport
+	if tr == nil {
+		tr = http.DefaultTransport
+	}
+	resp, err := tr.RoundTrip(out)
+	if err != nil {
+		ex.Elapsed = Duration(time.Since(start))
+		ex.Error = err.Error()
+		w.WriteHeader(http.StatusBadGateway)
+		return
+	}
+	defer resp.Body.Close()
+	rb, err := ioutil.ReadAll(resp.Body)
+	ex.Elapsed = Duration(time.Since(start))
+	if err != nil {
+		ex.Error = err.Error()
+		w.WriteHeader(http.StatusBadGateway)
+		return
+	}
+	ex.Status = resp.StatusCode
+	ex.ResponseHeader = redactHeader(resp.Header)
+	ex.ResponseBody = redactBody(rb)
+
+	for k, vs := range resp.Header {
+		if k != "Connection" && k != "Content-Length" {
+			w.Header()[k] = vs
+		}
+	}
+	w.WriteHeader(resp.StatusCode)
+	w.Write(rb)
+}
+
+// Replayer serves responses recorded by Recorder.
+// Exchanges are replayed in the recorded order for each endpoint, and from the first again after the last.
+type Replayer struct {
+	// TimeScale scales the recorded response time. 1 replays the recorded timing, and 0 responds immediately.
+	TimeScale float64
+	Verbose   bool
+
+	mu        sync.Mutex
+	exchanges map[string][]Exchange
+	next      map[string]int
+}
+
+// NewReplayer creates Replayer which replays exs in the recorded timing.
+func NewReplayer(exs []Exchange) *Replayer {
+	rp := &Replayer{
+		TimeScale: 1,
+		exchanges: make(map[string][]Exchange),
+		next:      make(map[string]int),
+	}
+	for _, ex := range exs {
+		key := endpointOf(ex.Method, ex.Path)
+		rp.exchanges[key] = append(rp.exchanges[key], ex)
+	}
+	return rp
+}
+
+// endpointOf returns the endpoint of a request, whose device token is a wildcard.
+func endpointOf(method, path string) string {
+	if strings.HasPrefix(path, "/3/device/") {
+		path = "/3/device/*"
+	}
+	return method + " " + path
+}
+
+func (rp *Replayer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	key := endpointOf(r.Method, r.URL.Path)
+	rp.mu.Lock()
+	exs := rp.exchanges[key]
+	if len(exs) == 0 {
+		rp.mu.Unlock()
+		w.WriteHeader(http.StatusNotFound)
+		fmt.Fprintf(w, "no recorded exchange for %s", key)
+		return
+	}
+	ex := exs[rp.next[key]%len(exs)]
+	rp.next[key]++
+	rp.mu.Unlock()
+
+	if rp.Verbose {
+		log.Printf("replay elapsed:%s method:%s path:%s status:%d error:%s", time.Duration(ex.Elapsed), r.Method, r.URL.Path, ex.Status, ex.Error)
+	}
+	if rp.TimeScale > 0 {
+		time.Sleep(time.Duration(float64(ex.Elapsed) * rp.TimeScale))
+	}
+	if ex.Error != "" {
+		// drops the request as the upstream did
+		panic(http.ErrAbortHandler)
+	}
+
+	body := ex.ResponseBody
+	if strings.HasSuffix(r.URL.Path, "/fcm/send") && ex.Status == http.StatusOK {
+		body = fitFCMResults(r, body)
+	}
+	for k, vs := range ex.ResponseHeader {
+		w.Header()[k] = vs
+	}
+	w.WriteHeader(ex.Status)
+	io.WriteString(w, body)
+}
+
+// fitFCMResults fits the number of results of a FCM legacy response to registration ids of r,
+// because the client of Gunfish requires a result for each registration id.
+func fitFCMResults(r *http.Request, body string) string {
+	var p fcm.Payload
+	if err := json.NewDecoder(r.Body).Decode(&p); err != nil {
+		return body
+	}
+	n := len(p.RegistrationIDs)
+	if n == 0 {
+		n = 1
+	}
+	var res map[string]interface{}
+	if err := json.Unmarshal([]byte(body), &res); err != nil {
+		return body
+	}
+	recorded, _ := res["results"].([]interface{})
+	if len(recorded) == 0 || len(recorded) == n {
+		return body
+	}
+	results := make([]interface{}, n)
+	success, failure := 0, 0
+	for i := range results {
+		results[i] = recorded[i%len(recorded)]
+		if r, _ := results[i].(map[string]interface{}); r["error"] == nil {
+			success++
+		} else {
+			failure++
+		}
+	}
+	res["results"], res["success"], res["failure"] = results, success, failure
+	b, err := json.Marshal(res)
+	if err != nil {
+		return body
+	}
+	return string(b)
+}
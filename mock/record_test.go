@@ -0,0 +1,165 @@
+package mock_test
+
+import (
+	"bytes"
+	"crypto/tls"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/kayac/Gunfish/apns"
+	"github.com/kayac/Gunfish/fcm"
+	"github.com/kayac/Gunfish/mock"
+	"golang.org/x/net/http2"
+)
+
+func TestRecordAndReplayAPNs(t *testing.T) {
+	upstream, _ := startAPNsMockServer(t, mock.NewScenario(
+		mock.Rule{Match: mock.Match{Token: "bad*"}, Status: http.StatusBadRequest, Reason: apns.BadDeviceToken.String(), Delay: mock.Duration(time.Millisecond * 100)},
+		mock.Rule{Match: mock.Match{Token: "drop*"}, Action: mock.Drop},
+	))
+	defer upstream.Close()
+	u, _ := url.Parse(upstream.URL)
+
+	var recorded bytes.Buffer
+	rec := mock.NewRecorder(u, &http2.Transport{TLSClientConfig: &tls.Config{InsecureSkipVerify: true}}, &recorded)
+	proxy := httptest.NewServer(rec)
+	defer proxy.Close()
+
+	tokens := []string{"secret-token-1", "bad-secret-token", "drop-secret-token"}
+	for _, token := range tokens {
+		req, _ := http.NewRequest(http.MethodPost, proxy.URL+"/3/device/"+token, strings.NewReader(`{"aps":{"alert":"hi"}}`))
+		req.Header.Set("Authorization", "bearer secret-jwt")
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+	}
+
+	for _, secret := range []string{"secret-token", "secret-jwt"} {
+		if strings.Contains(recorded.String(), secret) {
+			t.Errorf("%s is not redacted: %s", secret, recorded.String())
+		}
+	}
+	dir, err := ioutil.TempDir("", "gunfish-mock")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	file := filepath.Join(dir, "apns.ndjson")
+	if err := ioutil.WriteFile(file, recorded.Bytes(), 0644); err != nil {
+		t.Fatal(err)
+	}
+	exs, err := mock.LoadExchanges(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(exs) != 3 {
+		t.Fatalf("unexpected exchanges: %d", len(exs))
+	}
+	if exs[0].Path != "/3/device/"+mock.Redact("secret-token-1") || exs[0].RequestHeader.Get("Authorization") != "bearer "+mock.Redact("secret-jwt") {
+		t.Errorf("unexpected exchange: %#v", exs[0])
+	}
+	if exs[1].Status != http.StatusBadRequest || exs[2].Error == "" {
+		t.Errorf("unexpected exchanges: %#v", exs[1:])
+	}
+
+	rp := mock.NewReplayer(exs)
+	replay := httptest.NewServer(rp)
+	defer replay.Close()
+	for i := 0; i < 2; i++ {
+		start := time.Now()
+		resp, err := http.Post(replay.URL+"/3/device/other", mock.ApplicationJSON, strings.NewReader("{}"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if resp.StatusCode != http.StatusOK || resp.Header.Get("apns-id") == "" {
+			t.Errorf("unexpected response: %d %v", resp.StatusCode, resp.Header)
+		}
+		resp.Body.Close()
+
+		resp, err = http.Post(replay.URL+"/3/device/other", mock.ApplicationJSON, strings.NewReader("{}"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if reason := reasonOf(t, resp); resp.StatusCode != http.StatusBadRequest || reason != apns.BadDeviceToken.String() {
+			t.Errorf("unexpected response: %d %s", resp.StatusCode, reason)
+		}
+		if elapsed := time.Since(start); elapsed < time.Millisecond*100 {
+			t.Errorf("recorded timing is not replayed: %s", elapsed)
+		}
+
+		if resp, err := http.Post(replay.URL+"/3/device/other", mock.ApplicationJSON, strings.NewReader("{}")); err == nil {
+			resp.Body.Close()
+			t.Errorf("dropped request is not replayed: %d", resp.StatusCode)
+		}
+	}
+}
+
+func TestReplayFCM(t *testing.T) {
+	upstream := httptest.NewServer(mock.FCMMockServer(mock.Options{}))
+	defer upstream.Close()
+	u, _ := url.Parse(upstream.URL)
+
+	var recorded bytes.Buffer
+	proxy := httptest.NewServer(mock.NewRecorder(u, nil, &recorded))
+	defer proxy.Close()
+	req, _ := http.NewRequest(http.MethodPost, proxy.URL+"/fcm/send", strings.NewReader(`{"registration_ids":["secret-1","notregistered"]}`))
+	req.Header.Set("Authorization", "key=secret-key")
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if s := recorded.String(); strings.Contains(s, "secret") {
+		t.Errorf("not redacted: %s", s)
+	}
+
+	dir, err := ioutil.TempDir("", "gunfish-mock")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	file := filepath.Join(dir, "fcm.ndjson")
+	if err := ioutil.WriteFile(file, recorded.Bytes(), 0644); err != nil {
+		t.Fatal(err)
+	}
+	exs, err := mock.LoadExchanges(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	rp := mock.NewReplayer(exs)
+	rp.TimeScale = 0
+	replay := httptest.NewServer(rp)
+	defer replay.Close()
+
+	resp, err = http.Post(replay.URL+"/fcm/send", mock.ApplicationJSON, strings.NewReader(`{"registration_ids":["a","b","c"]}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	var body fcm.ResponseBody
+	if err := json.NewDecoder(resp.Body).Decode(&body); err != nil {
+		t.Fatal(err)
+	}
+	if len(body.Results) != 3 || body.Success != 2 || body.Failure != 1 || body.Results[1].Error != fcm.NotRegistered.String() {
+		t.Errorf("unexpected response: %#v", body)
+	}
+
+	resp, err = http.Post(replay.URL+"/v1/projects/x/messages:send", mock.ApplicationJSON, strings.NewReader("{}"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusNotFound {
+		t.Errorf("unexpected status for not recorded endpoint: %d", resp.StatusCode)
+	}
+}
@@ -0,0 +1,369 @@
+package mock
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"math/rand"
+	"net/http"
+	"path"
+	"sync"
+	"time"
+)
+
+// Actions of a rule
+const (
+	// Drop resets the stream (HTTP/2) or closes the connection (HTTP/1.1) without a response.
+	Drop = "drop"
+	// GoAway responds and then sends GOAWAY to close the connection gracefully.
+	GoAway = "goaway"
+)
+
+// Duration is time.Duration which is encoded as a string like "200ms" in JSON.
+type Duration time.Duration
+
+// MarshalJSON encodes d as a string.
+func (d Duration) MarshalJSON() ([]byte, error) {
+	return json.Marshal(time.Duration(d).String())
+}
+
+// UnmarshalJSON decodes a string like "200ms" or a number of nanoseconds.
+func (d *Duration) UnmarshalJSON(b []byte) error {
+	var v interface{}
+	if err := json.Unmarshal(b, &v); err != nil {
+		return err
+	}
+	switch v := v.(type) {
+	case float64:
+		*d = Duration(v)
+	case string:
+		p, err := time.ParseDuration(v)
+		if err != nil {
+			return err
+		}
+		*d = Duration(p)
+	default:
+		return fmt.Errorf("invalid duration: %s", string(b))
+	}
+	return nil
+}
+
+// Match is the condition of a rule. Empty fields match any request.
+// Token and Topic are patterns of path.Match, e.g. "bad*".
+// Token is a device token of APNs or a registration token of FCM, and
+// Topic is apns-topic header of APNs or a topic of FCM.
+type Match struct {
+	Token  string            `json:"token,omitempty"`
+	Topic  string            `json:"topic,omitempty"`
+	Header map[string]string `json:"header,omitempty"`
+}
+
+// Rule decides a response of the mock server for requests which match it.
+type Rule struct {
+	Name   string `json:"name,omitempty"`
+	Match  Match  `json:"match"`
+	Status int    `json:"status,omitempty"` // 200, or 400 when Reason is set, by default.
+	Reason string `json:"reason,omitempty"` // reason of APNs, error of FCM legacy, or errorCode of FCM v1
+
+	Header map[string]string `json:"response_header,omitempty"`
+	Delay  Duration          `json:"delay,omitempty"`  // response time instead of Options.Latency
+	Action string            `json:"action,omitempty"` // "drop" or "goaway"
+
+	Probability float64 `json:"probability,omitempty"` // applies at the probability in 0.0-1.0. 0 means always.
+	Nth         int     `json:"nth,omitempty"`         // applies only on the Nth matched request, counted from 1.
+	Times       int     `json:"times,omitempty"`       // applies at most Times. 0 means unlimited.
+}
+
+// Request is a request received by the mock server.
+type Request struct {
+	Time   time.Time   `json:"time"`
+	Method string      `json:"method"`
+	Path   string      `json:"path"`
+	Token  string      `json:"token,omitempty"`
+	Header http.Header `json:"header"`
+	Body   string      `json:"body"`
+	Rule   string      `json:"rule,omitempty"` // names of the applied rules separated by comma
+	Status int         `json:"status"`         // 0 when the request was dropped
+}
+
+type ruleState struct {
+	Rule
+	matched int
+	applied int
+}
+
+// Scenario holds rules of a mock server and records received requests.
+// It is safe for concurrent use.
+type Scenario struct {
+	mu       sync.Mutex
+	rules    []*ruleState
+	requests []Request
+	max      int // max number of recorded requests. negative is unlimited
+	oldest   int // index of the oldest request in requests when it is full
+}
+
+// NewScenario creates a Scenario with rules, which records all received requests.
+func NewScenario(rules ...Rule) *Scenario {
+	s := &Scenario{max: -1}
+	s.SetRules(rules)
+	return s
+}
+
+// LoadScenario loads rules from a JSON file which has an array of rules.
+func LoadScenario(file string) (*Scenario, error) {
+	b, err := ioutil.ReadFile(file)
+	if err != nil {
+		return nil, err
+	}
+	var rules []Rule
+	if err := json.Unmarshal(b, &rules); err != nil {
+		return nil, fmt.Errorf("failed to parse rules in %s: %s", file, err)
+	}
+	return NewScenario(rules...), nil
+}
+
+// SetRules replaces rules and resets their counters.
+func (s *Scenario) SetRules(rules []Rule) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.rules = s.rules[:0]
+	for _, r := range rules {
+		s.rules = append(s.rules, &ruleState{Rule: r})
+	}
+}
+
+// AddRule appends a rule. Rules are evaluated in order and the first applicable one wins.
+func (s *Scenario) AddRule(r Rule) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.rules = append(s.rules, &ruleState{Rule: r})
+}
+
+// Rules returns current rules.
+func (s *Scenario) Rules() []Rule {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	rules := make([]Rule, 0, len(s.rules))
+	for _, r := range s.rules {
+		rules = append(rules, r.Rule)
+	}
+	return rules
+}
+
+// SetMaxRequests limits recorded requests to the last n, so that the history does not grow in a long run.
+// 0 disables recording, and a negative n records all requests.
+func (s *Scenario) SetMaxRequests(n int) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	reqs := s.ordered()
+	if n >= 0 && len(reqs) > n {
+		reqs = reqs[len(reqs)-n:]
+	}
+	s.requests = reqs
+	s.oldest = 0
+	s.max = n
+}
+
+// Requests returns recorded requests from the oldest.
+func (s *Scenario) Requests() []Request {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.ordered()
+}
+
+func (s *Scenario) ordered() []Request {
+	reqs := make([]Request, 0, len(s.requests))
+	reqs = append(reqs, s.requests[s.oldest:]...)
+	return append(reqs, s.requests[:s.oldest]...)
+}
+
+// Reset clears recorded requests.
+func (s *Scenario) Reset() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.requests = nil
+	s.oldest = 0
+}
+
+func (s *Scenario) record(req *Request) {
+	if s == nil {
+		return
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	switch {
+	case s.max < 0 || len(s.requests) < s.max:
+		s.requests = append(s.requests, *req)
+	case s.max > 0:
+		// overwrites the oldest one
+		s.requests[s.oldest] = *req
+		s.oldest = (s.oldest + 1) % s.max
+	}
+}
+
+// apply returns the first rule which applies to the request.
+// token and topic are the destination of the notification.
+func (s *Scenario) apply(r *http.Request, token, topic string) (Rule, bool) {
+	if s == nil {
+		return Rule{}, false
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, rs := range s.rules {
+		if !rs.Match.match(r, token, topic) {
+			continue
+		}
+		rs.matched++
+		if rs.Nth > 0 && rs.matched != rs.Nth {
+			continue
+		}
+		if rs.Times > 0 && rs.applied >= rs.Times {
+			continue
+		}
+		if rs.Probability > 0 && rand.Float64() >= rs.Probability {
+			continue
+		}
+		rs.applied++
+		return rs.Rule, true
+	}
+	return Rule{}, false
+}
+
+// begin reads the body of r and starts recording the request.
+// The caller must call s.record with the returned Request after responding,
+// and write the response to the returned ResponseWriter to record its status.
+func (s *Scenario) begin(w http.ResponseWriter, r *http.Request, start time.Time) (http.ResponseWriter, *Request, []byte) {
+	body, _ := ioutil.ReadAll(r.Body)
+	req := &Request{
+		Time:   start,
+		Method: r.Method,
+		Path:   r.URL.Path,
+		Header: r.Header,
+		Body:   string(body),
+	}
+	if s == nil {
+		return w, req, body
+	}
+	return &statusRecorder{ResponseWriter: w, status: &req.Status}, req, body
+}
+
+func (m Match) match(r *http.Request, token, topic string) bool {
+	if !matchPattern(m.Token, token) || !matchPattern(m.Topic, topic) {
+		return false
+	}
+	for k, v := range m.Header {
+		if r.Header.Get(k) != v {
+			return false
+		}
+	}
+	return true
+}
+
+func matchPattern(pattern, s string) bool {
+	if pattern == "" {
+		return true
+	}
+	ok, err := path.Match(pattern, s)
+	return err == nil && ok
+}
+
+// ServeHTTP serves the control API of the scenario.
+//
+//	GET    /mock/rules     returns rules
+//	PUT    /mock/rules     replaces rules by a JSON array
+//	POST   /mock/rules     appends a rule
+//	DELETE /mock/rules     removes all rules
+//	GET    /mock/requests  returns recorded requests
+//	DELETE /mock/requests  clears recorded requests
+func (s *Scenario) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	switch r.URL.Path {
+	case "/mock/rules":
+		switch r.Method {
+		case http.MethodGet:
+		case http.MethodPut:
+			var rules []Rule
+			if err := json.NewDecoder(r.Body).Decode(&rules); err != nil {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+			s.SetRules(rules)
+		case http.MethodPost:
+			var rule Rule
+			if err := json.NewDecoder(r.Body).Decode(&rule); err != nil {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+			s.AddRule(rule)
+		case http.MethodDelete:
+			s.SetRules(nil)
+		default:
+			w.WriteHeader(http.StatusMethodNotAllowed)
+			return
+		}
+		writeJSON(w, s.Rules())
+	case "/mock/requests":
+		switch r.Method {
+		case http.MethodGet:
+			writeJSON(w, s.Requests())
+		case http.MethodDelete:
+			s.Reset()
+			w.WriteHeader(http.StatusNoContent)
+		default:
+			w.WriteHeader(http.StatusMethodNotAllowed)
+		}
+	default:
+		http.NotFound(w, r)
+	}
+}
+
+func writeJSON(w http.ResponseWriter, v interface{}) {
+	w.Header().Set("Content-Type", ApplicationJSON)
+	json.NewEncoder(w).Encode(v)
+}
+
+// applyAction applies Action and Header of the rule to the response.
+func applyAction(w http.ResponseWriter, rule Rule) {
+	switch rule.Action {
+	case Drop:
+		// aborts the handler without any response
+		panic(http.ErrAbortHandler)
+	case GoAway:
+		// HTTP/2 server sends GOAWAY for the response with "Connection: close",
+		// and HTTP/1.1 server closes the connection.
+		w.Header().Set("Connection", "close")
+	}
+	for k, v := range rule.Header {
+		w.Header().Set(k, v)
+	}
+}
+
+// statusOf returns the status code of the response by the rule.
+func (r Rule) statusOf() int {
+	if r.Status != 0 {
+		return r.Status
+	}
+	if r.Reason != "" {
+		return http.StatusBadRequest
+	}
+	return http.StatusOK
+}
+
+// statusRecorder records the status code of a response.
+type statusRecorder struct {
+	http.ResponseWriter
+	status *int
+}
+
+func (r *statusRecorder) WriteHeader(status int) {
+	if *r.status == 0 {
+		*r.status = status
+	}
+	r.ResponseWriter.WriteHeader(status)
+}
+
+func (r *statusRecorder) Write(b []byte) (int, error) {
+	if *r.status == 0 {
+		*r.status = http.StatusOK
+	}
+	return r.ResponseWriter.Write(b)
+}
@@ -0,0 +1,210 @@
+package mock_test
+
+import (
+	"bytes"
+	"crypto/tls"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/kayac/Gunfish/apns"
+	"github.com/kayac/Gunfish/mock"
+	"golang.org/x/net/http2"
+)
+
+func startAPNsMockServer(t *testing.T, scenario *mock.Scenario) (*httptest.Server, *http.Client) {
+	ts := httptest.NewUnstartedServer(mock.NewAPNsMockServer(mock.Options{
+		Latency:  mock.Latency{Distribution: mock.Fixed},
+		Scenario: scenario,
+	}))
+	if err := http2.ConfigureServer(ts.Config, nil); err != nil {
+		t.Fatal(err)
+	}
+	ts.TLS = ts.Config.TLSConfig
+	ts.StartTLS()
+
+	client := &http.Client{
+		Transport: &http2.Transport{
+			TLSClientConfig: &tls.Config{InsecureSkipVerify: true},
+		},
+	}
+	return ts, client
+}
+
+func push(client *http.Client, url, token, topic string) (*http.Response, error) {
+	req, _ := http.NewRequest(http.MethodPost, url+"/3/device/"+token, strings.NewReader(`{"aps":{"alert":"hi"}}`))
+	req.Header.Set("apns-topic", topic)
+	return client.Do(req)
+}
+
+func reasonOf(t *testing.T, resp *http.Response) string {
+	defer resp.Body.Close()
+	if resp.StatusCode == http.StatusOK {
+		return ""
+	}
+	var er apns.ErrorResponse
+	if err := json.NewDecoder(resp.Body).Decode(&er); err != nil {
+		t.Fatal(err)
+	}
+	return er.Reason
+}
+
+func TestScenarioRules(t *testing.T) {
+	scenario := mock.NewScenario(
+		mock.Rule{
+			Name:   "too many requests",
+			Match:  mock.Match{Topic: "com.example.limited"},
+			Status: http.StatusTooManyRequests,
+			Reason: apns.TooManyRequests.String(),
+		},
+		mock.Rule{
+			Name:   "second call fails",
+			Match:  mock.Match{Token: "retry*"},
+			Status: http.StatusInternalServerError,
+			Reason: apns.InternalServerError.String(),
+			Nth:    2,
+		},
+		mock.Rule{
+			Name:   "drop",
+			Match:  mock.Match{Token: "drop"},
+			Action: mock.Drop,
+		},
+	)
+	ts, client := startAPNsMockServer(t, scenario)
+	defer ts.Close()
+
+	testCases := []struct {
+		token  string
+		topic  string
+		status int
+		reason string
+	}{
+		{"abc", "com.example.limited", http.StatusTooManyRequests, "TooManyRequests"},
+		{"abc", "com.example", http.StatusOK, ""},
+		{"retry1", "com.example", http.StatusOK, ""},
+		{"retry2", "com.example", http.StatusInternalServerError, "InternalServerError"},
+		{"retry3", "com.example", http.StatusOK, ""},
+		{"baddevicetoken", "com.example", http.StatusBadRequest, "BadDeviceToken"},
+	}
+	for _, c := range testCases {
+		resp, err := push(client, ts.URL, c.token, c.topic)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if resp.StatusCode != c.status {
+			t.Errorf("%s: unexpected status: %d want %d", c.token, resp.StatusCode, c.status)
+		}
+		if r := reasonOf(t, resp); r != c.reason {
+			t.Errorf("%s: unexpected reason: %s want %s", c.token, r, c.reason)
+		}
+	}
+
+	if _, err := push(client, ts.URL, "drop", "com.example"); err == nil {
+		t.Error("expected error for the dropped request")
+	}
+
+	reqs := scenario.Requests()
+	if len(reqs) != len(testCases)+1 {
+		t.Fatalf("unexpected number of recorded requests: %d", len(reqs))
+	}
+	if r := reqs[0]; r.Rule != "too many requests" || r.Status != http.StatusTooManyRequests || r.Header.Get("apns-topic") != "com.example.limited" {
+		t.Errorf("unexpected recorded request: %#v", r)
+	}
+	if r := reqs[len(reqs)-1]; r.Rule != "drop" || r.Status != 0 {
+		t.Errorf("unexpected recorded request: %#v", r)
+	}
+}
+
+func TestScenarioControlAPI(t *testing.T) {
+	scenario := mock.NewScenario()
+	ts, client := startAPNsMockServer(t, scenario)
+	defer ts.Close()
+
+	rules := `[{"name":"slow","match":{"token":"slow"},"delay":"100ms","times":1}]`
+	req, _ := http.NewRequest(http.MethodPut, ts.URL+"/mock/rules", bytes.NewReader([]byte(rules)))
+	resp, err := client.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("unexpected status: %d", resp.StatusCode)
+	}
+	if r := scenario.Rules(); len(r) != 1 || time.Duration(r[0].Delay) != 100*time.Millisecond {
+		t.Errorf("unexpected rules: %#v", r)
+	}
+
+	for i, min := range []time.Duration{100 * time.Millisecond, 0} {
+		start := time.Now()
+		resp, err := push(client, ts.URL, "slow", "com.example")
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		if elapsed := time.Since(start); elapsed < min || (min == 0 && elapsed >= 100*time.Millisecond) {
+			t.Errorf("#%d: unexpected response time: %s", i, elapsed)
+		}
+	}
+
+	resp, err = client.Get(ts.URL + "/mock/requests")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var reqs []mock.Request
+	if err := json.NewDecoder(resp.Body).Decode(&reqs); err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if len(reqs) != 2 || reqs[0].Rule != "slow" || reqs[1].Rule != "" {
+		t.Errorf("unexpected requests: %#v", reqs)
+	}
+	if reqs[0].Body != `{"aps":{"alert":"hi"}}` {
+		t.Errorf("unexpected body: %s", reqs[0].Body)
+	}
+}
+
+func TestScenarioMaxRequests(t *testing.T) {
+	scenario := mock.NewScenario()
+	scenario.SetMaxRequests(3)
+	ts, client := startAPNsMockServer(t, scenario)
+	defer ts.Close()
+
+	tokens := func() string {
+		var tokens []string
+		for _, r := range scenario.Requests() {
+			tokens = append(tokens, strings.TrimPrefix(r.Path, "/3/device/"))
+		}
+		return strings.Join(tokens, ",")
+	}
+	send := func(token string) {
+		resp, err := push(client, ts.URL, token, "com.example")
+		if err != nil {
+			t.Fatal(err)
+		}
+		// the request is recorded before the end of the response
+		ioutil.ReadAll(resp.Body)
+		resp.Body.Close()
+	}
+	for _, token := range []string{"a", "b", "c", "d", "e"} {
+		send(token)
+	}
+	// keeps the last ones from the oldest
+	if got := tokens(); got != "c,d,e" {
+		t.Errorf("unexpected requests: %s", got)
+	}
+
+	scenario.SetMaxRequests(2)
+	if got := tokens(); got != "d,e" {
+		t.Errorf("unexpected requests: %s", got)
+	}
+
+	scenario.SetMaxRequests(0)
+	send("f")
+	if got := tokens(); got != "" {
+		t.Errorf("recorded while disabled: %v", got)
+	}
+}
@@ -0,0 +1,109 @@
+package mock
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// RecordingTransport is an http.RoundTripper which records requests instead of sending them.
+// Set it to the http.Client of a provider client to test exactly what the provider would receive.
+type RecordingTransport struct {
+	// Response returns the response to req, whose body can be read again. 200 OK with an empty JSON object is returned when nil.
+	Response func(req *http.Request) *http.Response
+
+	mu       sync.Mutex
+	requests []RecordedRequest
+}
+
+// RecordedRequest is a request recorded by RecordingTransport.
+type RecordedRequest struct {
+	Method string
+	URL    string
+	Header http.Header
+	Body   []byte
+}
+
+// String formats the request like HTTP/1.1 with sorted headers, for golden files.
+func (r RecordedRequest) String() string {
+	var b strings.Builder
+	fmt.Fprintf(&b, "%s %s\n", r.Method, r.URL)
+	keys := make([]string, 0, len(r.Header))
+	for k := range r.Header {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	for _, k := range keys {
+		for _, v := range r.Header[k] {
+			fmt.Fprintf(&b, "%s: %s\n", k, v)
+		}
+	}
+	fmt.Fprintf(&b, "\n%s\n", r.Body)
+	return b.String()
+}
+
+// RoundTrip records req and returns the response of t.Response.
+func (t *RecordingTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	rec := RecordedRequest{
+		Method: req.Method,
+		URL:    req.URL.String(),
+		Header: make(http.Header, len(req.Header)),
+	}
+	for k, v := range req.Header {
+		rec.Header[k] = append([]string(nil), v...)
+	}
+	if req.Body != nil {
+		body, err := ioutil.ReadAll(req.Body)
+		req.Body.Close()
+		if err != nil {
+			return nil, err
+		}
+		rec.Body = body
+		req.Body = ioutil.NopCloser(bytes.NewReader(body))
+	}
+	t.mu.Lock()
+	t.requests = append(t.requests, rec)
+	t.mu.Unlock()
+
+	var resp *http.Response
+	if t.Response != nil {
+		resp = t.Response(req)
+	} else {
+		resp = JSONResponse(http.StatusOK, "{}")
+	}
+	if resp.Request == nil {
+		resp.Request = req
+	}
+	return resp, nil
+}
+
+// Requests returns recorded requests.
+func (t *RecordingTransport) Requests() []RecordedRequest {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return append([]RecordedRequest(nil), t.requests...)
+}
+
+// Reset clears recorded requests.
+func (t *RecordingTransport) Reset() {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.requests = nil
+}
+
+// JSONResponse creates a response with a JSON body for RecordingTransport.
+func JSONResponse(status int, body string) *http.Response {
+	return &http.Response{
+		Status:        fmt.Sprintf("%d %s", status, http.StatusText(status)),
+		StatusCode:    status,
+		Proto:         "HTTP/2.0",
+		ProtoMajor:    2,
+		Header:        http.Header{"Content-Type": {ApplicationJSON}},
+		Body:          ioutil.NopCloser(bytes.NewBufferString(body)),
+		ContentLength: int64(len(body)),
+	}
+}
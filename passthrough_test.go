@@ -0,0 +1,101 @@
+package gunfish
+
+import (
+	"bytes"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/kayac/Gunfish/apns"
+)
+
+func TestNewRawAPNsRequests(t *testing.T) {
+	payload := `{"aps":{"alert":{"title":"t","subtitle-loc-key":"k"}},"custom":[1,2.50]}`
+	reqs, err := newRawAPNsRequests([]byte(`[{"token":"aaa","header":{"apns-topic":"com.example"},"payload":` + payload + `}]`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	no := reqs[0].Notification.(apns.Notification)
+	if string(reqs[0].Raw) != payload || no.Token != "aaa" || no.Header.ApnsTopic != "com.example" {
+		t.Errorf("unexpected request: %#v", reqs[0])
+	}
+
+	for _, body := range []string{
+		`{"token":"aaa"}`,
+		`[]`,
+		`[{"payload":{"aps":{}}}]`,
+		`[{"token":"aaa","payload":{"aps":"x"}}]`,
+		`[{"token":"aaa","payload":null}]`,
+		`[{"token":"aaa"}]`,
+	} {
+		if _, err := newRawAPNsRequests([]byte(body)); err == nil {
+			t.Errorf("%s must be rejected", body)
+		}
+	}
+}
+
+func TestNewRawFCMv1Requests(t *testing.T) {
+	reqs, err := newRawFCMv1Requests(strings.NewReader(`{"message":{"token":"a","fcm_options":{"analytics_label":"x"}}}
+{"message":{"topic":"b"}} {"message":{"condition":"'c' in topics"}}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(reqs) != 3 || string(reqs[0].Raw) != `{"message":{"token":"a","fcm_options":{"analytics_label":"x"}}}` {
+		t.Errorf("unexpected requests: %#v", reqs)
+	}
+
+	for _, body := range []string{
+		`{"message":{"data":{"k":"v"}}}`,
+		`{"token":"a"}`,
+		`{"message":{"token":1}}`,
+		`{"message":`,
+	} {
+		if _, err := newRawFCMv1Requests(strings.NewReader(body)); err == nil {
+			t.Errorf("%s must be rejected", body)
+		}
+	}
+}
+
+// benchmarkPushAPNs measures a request of 100 notifications from posting to creating requests to APNs.
+func benchmarkPushAPNs(b *testing.B, passthrough bool) {
+	n := `{"token":"token-x","header":{"apns-topic":"com.example"},"payload":{"aps":{"alert":{"title":"bench test","body":"message","loc-args":["a","b"]},"sound":"default","badge":1},"suboption":"test"}}`
+	body := []byte("[" + strings.Repeat(n+",", 99) + n + "]")
+
+	sup := Supervisor{queue: make(chan *[]Request, 1), passthrough: passthrough}
+	handler := (&Provider{Sup: sup}).PushAPNsHandler()
+	ac := &apns.Client{Host: "https://localhost"}
+
+	b.ReportAllocs()
+	b.SetBytes(int64(len(body)))
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		req := httptest.NewRequest(http.MethodPost, "/push/apns", bytes.NewReader(body))
+		req.Header.Set("Content-Type", ApplicationJSON)
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, req)
+		if w.Code != http.StatusOK {
+			b.Fatalf("unexpected status %d: %s", w.Code, w.Body)
+		}
+		for _, r := range *<-sup.queue {
+			no := r.Notification.(apns.Notification)
+			var err error
+			if r.Raw != nil {
+				_, err = ac.NewRawRequest(no.Token, &no.Header, r.Raw)
+			} else {
+				_, err = ac.NewRequest(no.Token, &no.Header, no.Payload)
+			}
+			if err != nil {
+				b.Fatal(err)
+			}
+		}
+	}
+}
+
+func BenchmarkPushAPNs(b *testing.B) {
+	benchmarkPushAPNs(b, false)
+}
+
+func BenchmarkPushAPNsPassthrough(b *testing.B) {
+	benchmarkPushAPNs(b, true)
+}
@@ -1,16 +1,29 @@
 package gunfish
 
 import (
+	"encoding/json"
+
 	"github.com/kayac/Gunfish/apns"
 )
 
 type Request struct {
 	Notification Notification
 	Tries        int
+	Caller       map[string]string // metadata of the caller written to the delivery event log
+	Raw          json.RawMessage   // posted payload which is sent as is in passthrough mode
+	size         int64             // estimated bytes accounted for the memory budget
+	slot         *coalesceSlot     // holds the latest notification of the collapse key while queued
 }
 
 type Notification interface{}
 
+// rawPostedData is PostedData whose payload is kept as posted in passthrough mode.
+type rawPostedData struct {
+	Header  apns.Header     `json:"header,omitempty"`
+	Token   string          `json:"token"`
+	Payload json.RawMessage `json:"payload"`
+}
+
 // PostedData is posted data to this provider server /push/apns.
 type PostedData struct {
 	Header  apns.Header  `json:"header,omitempty"`
@@ -0,0 +1,121 @@
+package gunfish
+
+import (
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/kayac/Gunfish/clock"
+	"github.com/kayac/Gunfish/config"
+	"github.com/kayac/Gunfish/logger"
+)
+
+func withFakeClock(t time.Time) (*clock.Fake, func()) {
+	fake := clock.NewFake(t)
+	Clock = fake
+	return fake, func() { Clock = clock.Real }
+}
+
+func TestRetryAfterClock(t *testing.T) {
+	fake, restore := withFakeClock(time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC))
+	defer restore()
+	defer func(s Stats) { srvStats = s }(srvStats)
+	srvStats = NewStats(config.Config{})
+
+	testCases := []struct {
+		interval   time.Duration
+		retryAfter int64
+	}{
+		{0, 14},
+		{time.Second, 18},
+		{time.Second * 5, 22},
+		{time.Second * 30, 26},
+		{time.Second * 61, 30},
+	}
+	for i, c := range testCases {
+		fake.Advance(c.interval)
+		w := httptest.NewRecorder()
+		setRetryAfter(w, httptest.NewRequest(http.MethodPost, "/push/apns", nil), "queue is full")
+		if w.Code != http.StatusServiceUnavailable {
+			t.Errorf("#%d unexpected status: %d", i, w.Code)
+		}
+		ra, _ := strconv.ParseInt(w.Header().Get("Retry-After"), 10, 64)
+		if ra != c.retryAfter {
+			t.Errorf("#%d unexpected Retry-After after %s: %d want %d", i, c.interval, ra, c.retryAfter)
+		}
+		if srvStats.ServiceUnavailableAt != fake.Now().Unix() {
+			t.Errorf("#%d unexpected su_at: %d", i, srvStats.ServiceUnavailableAt)
+		}
+	}
+}
+
+func TestStatsUptime(t *testing.T) {
+	start := time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)
+	fake, restore := withFakeClock(start)
+	defer restore()
+
+	var conf config.Config
+	conf.Apns.CertificateNotAfter = start.Add(time.Hour * 24)
+	st := NewStats(conf)
+
+	fake.Advance(time.Second * 90)
+	st.GetStats()
+	if st.Uptime != 90 || st.Period != 90 {
+		t.Errorf("unexpected uptime: %d period: %d", st.Uptime, st.Period)
+	}
+	fake.Advance(time.Second * 30)
+	st.GetStats()
+	if st.Uptime != 120 || st.Period != 30 {
+		t.Errorf("unexpected uptime: %d period: %d", st.Uptime, st.Period)
+	}
+	if st.CertificateExpireUntil != 24*3600-120 {
+		t.Errorf("unexpected certificate_expire_until: %d", st.CertificateExpireUntil)
+	}
+}
+
+func TestRetryUntilSendRetryCount(t *testing.T) {
+	start := time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)
+	fake, restore := withFakeClock(start)
+	defer restore()
+
+	s := Supervisor{
+		queue:  make(chan *[]Request, 10),
+		retryq: make(chan Request, 10),
+		exit:   make(chan struct{}),
+		ticker: Clock.NewTicker(RetryWaitTime),
+	}
+	go s.resendRetryQueue()
+	defer close(s.exit)
+
+	req := Request{}
+	(&Worker{}).retry(s.retryq, req, errors.New("failed"), logger.Entry{})
+	for tries := 1; tries <= SendRetryCount; tries++ {
+		fake.Advance(RetryWaitTime - time.Millisecond)
+		select {
+		case <-s.queue:
+			t.Fatalf("#%d resent before RetryWaitTime", tries)
+		case <-time.After(time.Millisecond * 10):
+		}
+
+		fake.Advance(time.Millisecond)
+		select {
+		case reqs := <-s.queue:
+			req = (*reqs)[0]
+		case <-time.After(time.Second):
+			t.Fatalf("#%d not resent after RetryWaitTime", tries)
+		}
+		if req.Tries != tries {
+			t.Errorf("unexpected tries: %d want %d", req.Tries, tries)
+		}
+		if elapsed := fake.Now().Sub(start); elapsed != RetryWaitTime*time.Duration(tries) {
+			t.Errorf("#%d unexpected elapsed time: %s", tries, elapsed)
+		}
+		(&Worker{}).retry(s.retryq, req, errors.New("failed"), logger.Entry{})
+	}
+	if len(s.retryq) != 0 {
+		t.Errorf("request is retried over SendRetryCount: %#v", <-s.retryq)
+	}
+}
@@ -0,0 +1,77 @@
+package sandbox_test
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"testing"
+	"time"
+
+	gunfish "github.com/kayac/Gunfish"
+	"github.com/kayac/Gunfish/apns"
+	"github.com/kayac/Gunfish/config"
+	"github.com/kayac/Gunfish/fcm"
+	"github.com/kayac/Gunfish/gunfishtest"
+	"github.com/kayac/Gunfish/sandbox"
+	"github.com/sirupsen/logrus"
+)
+
+func TestSandboxDoesNotSend(t *testing.T) {
+	logrus.SetLevel(logrus.FatalLevel)
+
+	s, err := gunfishtest.NewServer(gunfishtest.Options{
+		Config: func(c *config.Config) {
+			c.Sandbox = config.SectionSandbox{Enabled: true}
+		},
+		Timeout: time.Second * 10,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+
+	var ds []gunfish.PostedData
+	for i := 0; i < 10; i++ {
+		ds = append(ds, gunfish.PostedData{Token: fmt.Sprintf("apns-%02d", i), Payload: apns.Payload{APS: &apns.APS{Alert: "sandbox"}}})
+	}
+	if err := s.PushAPNs(ds...); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.PushFCM(fcm.Payload{RegistrationIDs: []string{"fcm-00", "fcm-01"}}); err != nil {
+		t.Fatal(err)
+	}
+	// results of APNs are passed to the response handlers as sent
+	if _, err := s.WaitResults(10); err != nil {
+		t.Fatal(err)
+	}
+	for deadline := time.Now().Add(time.Second * 5); len(s.Sandbox().Messages(sandbox.Filter{})) < 11 && time.Now().Before(deadline); {
+		time.Sleep(time.Millisecond * 10)
+	}
+
+	if n := len(s.APNsRequests()) + len(s.FCMRequests()); n != 0 {
+		t.Errorf("providers received %d requests", n)
+	}
+
+	resp, err := http.Get(s.URL + "/sandbox/messages?token=fcm-01")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	var msgs []sandbox.Message
+	if err := json.NewDecoder(resp.Body).Decode(&msgs); err != nil {
+		t.Fatal(err)
+	}
+	if len(msgs) != 1 || msgs[0].Provider != fcm.Provider || len(msgs[0].Tokens) != 2 {
+		t.Errorf("unexpected messages: %#v", msgs)
+	}
+	if msgs := s.Sandbox().Messages(sandbox.Filter{Provider: apns.Provider}); len(msgs) != 10 {
+		t.Errorf("unexpected apns messages: %d", len(msgs))
+	}
+	st, err := s.Stats()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if st.SentCount != 12 {
+		t.Errorf("unexpected sent count: %d", st.SentCount)
+	}
+}
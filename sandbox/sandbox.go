@@ -0,0 +1,202 @@
+// Package sandbox stores notifications in memory instead of sending them to providers.
+// It is enabled by the [sandbox] section of the configuration for staging environments,
+// and stored notifications are served by Store as the /sandbox/messages endpoint.
+package sandbox
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/kayac/Gunfish/apns"
+	"github.com/kayac/Gunfish/fcm"
+	"github.com/kayac/Gunfish/fcmv1"
+	uuid "github.com/satori/go.uuid"
+)
+
+// DefaultMaxMessages is the number of messages kept by Store when the configured value is 0.
+const DefaultMaxMessages = 10000
+
+// Message is a notification which would have been sent to a provider.
+type Message struct {
+	ID           int64       `json:"id"`
+	Time         time.Time   `json:"time"`
+	Provider     string      `json:"provider"`
+	Tokens       []string    `json:"tokens,omitempty"`
+	Topic        string      `json:"topic,omitempty"` // topic or condition of FCM
+	Notification interface{} `json:"notification"`
+}
+
+// Filter selects messages. Empty fields match any message.
+type Filter struct {
+	Provider string
+	Token    string
+}
+
+func (f Filter) match(m Message) bool {
+	if f.Provider != "" && f.Provider != m.Provider {
+		return false
+	}
+	if f.Token == "" {
+		return true
+	}
+	for _, t := range m.Tokens {
+		if t == f.Token {
+			return true
+		}
+	}
+	return false
+}
+
+// Store keeps messages in memory. The oldest message is discarded when it is full.
+type Store struct {
+	max int
+
+	mu       sync.Mutex
+	lastID   int64
+	messages []Message
+}
+
+// NewStore creates Store which keeps max messages at most. DefaultMaxMessages is used when max is 0.
+func NewStore(max int) *Store {
+	if max <= 0 {
+		max = DefaultMaxMessages
+	}
+	return &Store{max: max}
+}
+
+func (s *Store) add(provider, topic string, tokens []string, n interface{}) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.lastID++
+	s.messages = append(s.messages, Message{
+		ID:           s.lastID,
+		Time:         time.Now(),
+		Provider:     provider,
+		Tokens:       tokens,
+		Topic:        topic,
+		Notification: n,
+	})
+	if over := len(s.messages) - s.max; over > 0 {
+		s.messages = append(s.messages[:0:0], s.messages[over:]...)
+	}
+}
+
+// Messages returns stored messages which match f in the stored order.
+func (s *Store) Messages(f Filter) []Message {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	msgs := make([]Message, 0)
+	for _, m := range s.messages {
+		if f.match(m) {
+			msgs = append(msgs, m)
+		}
+	}
+	return msgs
+}
+
+// Clear removes stored messages which match f, and returns the number of them.
+func (s *Store) Clear(f Filter) int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	kept := s.messages[:0]
+	for _, m := range s.messages {
+		if !f.match(m) {
+			kept = append(kept, m)
+		}
+	}
+	n := len(s.messages) - len(kept)
+	s.messages = kept
+	return n
+}
+
+// rawAPNs is apns.Notification whose payload is kept as posted in passthrough mode.
+type rawAPNs struct {
+	Header  apns.Header     `json:"header"`
+	Token   string          `json:"token"`
+	Payload json.RawMessage `json:"payload"`
+}
+
+// SendAPNs stores n and returns the result as APNs accepted it.
+func (s *Store) SendAPNs(n apns.Notification) []apns.Result {
+	return s.sendAPNs(n, n)
+}
+
+// SendRawAPNs stores n with the encoded JSON payload as is, and returns the result as APNs accepted it. n.Payload is ignored.
+func (s *Store) SendRawAPNs(n apns.Notification, payload json.RawMessage) []apns.Result {
+	return s.sendAPNs(n, rawAPNs{Header: n.Header, Token: n.Token, Payload: payload})
+}
+
+func (s *Store) sendAPNs(n apns.Notification, stored interface{}) []apns.Result {
+	id := n.Header.ApnsID
+	if id == "" {
+		id = strings.ToUpper(uuid.NewV4().String())
+	}
+	s.add(apns.Provider, n.Header.ApnsTopic, []string{n.Token}, stored)
+	return []apns.Result{{APNsID: id, StatusCode: http.StatusOK, Token: n.Token}}
+}
+
+// SendFCM stores p and returns the results as FCM accepted it.
+func (s *Store) SendFCM(p fcm.Payload) []fcm.Result {
+	if len(p.RegistrationIDs) == 0 {
+		s.add(fcm.Provider, "", []string{p.To}, p)
+		return []fcm.Result{{StatusCode: http.StatusOK, MessageID: messageID(), To: p.To}}
+	}
+	s.add(fcm.Provider, "", append([]string(nil), p.RegistrationIDs...), p)
+	results := make([]fcm.Result, 0, len(p.RegistrationIDs))
+	for _, id := range p.RegistrationIDs {
+		results = append(results, fcm.Result{StatusCode: http.StatusOK, MessageID: messageID(), RegistrationID: id})
+	}
+	return results
+}
+
+// SendFCMv1 stores p and returns the result as FCM accepted it.
+func (s *Store) SendFCMv1(p fcmv1.Payload) []fcmv1.Result {
+	return s.sendFCMv1(p, p)
+}
+
+// SendRawFCMv1 stores the encoded JSON payload as is, and returns the result as FCM accepted it.
+// p is used only for the target of the message.
+func (s *Store) SendRawFCMv1(p fcmv1.Payload, payload json.RawMessage) []fcmv1.Result {
+	return s.sendFCMv1(p, payload)
+}
+
+func (s *Store) sendFCMv1(p fcmv1.Payload, stored interface{}) []fcmv1.Result {
+	var tokens []string
+	if p.Message.Token != "" {
+		tokens = []string{p.Message.Token}
+	}
+	topic := p.Message.Topic
+	if topic == "" {
+		topic = p.Message.Condition
+	}
+	s.add(fcmv1.Provider, topic, tokens, stored)
+	return []fcmv1.Result{{StatusCode: http.StatusOK, Token: p.Message.Token, Name: "projects/sandbox/messages/" + uuid.NewV4().String()}}
+}
+
+func messageID() string {
+	return "sandbox:" + uuid.NewV4().String()
+}
+
+// ServeHTTP lists stored messages by GET and removes them by DELETE.
+// Messages are filtered by the provider and token query parameters.
+func (s *Store) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	f := Filter{
+		Provider: r.URL.Query().Get("provider"),
+		Token:    r.URL.Query().Get("token"),
+	}
+	w.Header().Set("Content-Type", "application/json")
+	switch r.Method {
+	case http.MethodGet:
+		json.NewEncoder(w).Encode(s.Messages(f))
+	case http.MethodDelete:
+		fmt.Fprintf(w, `{"deleted":%d}`+"\n", s.Clear(f))
+	default:
+		w.Header().Set("Allow", "GET, DELETE")
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		fmt.Fprintf(w, `{"reason":"Method Not Allowed."}`+"\n")
+	}
+}
@@ -0,0 +1,129 @@
+package sandbox
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"firebase.google.com/go/messaging"
+	"github.com/kayac/Gunfish/apns"
+	"github.com/kayac/Gunfish/fcm"
+	"github.com/kayac/Gunfish/fcmv1"
+)
+
+func TestStore(t *testing.T) {
+	s := NewStore(3)
+	if rs := s.SendAPNs(apns.Notification{Token: "a", Header: apns.Header{ApnsID: "ID", ApnsTopic: "com.example"}}); rs[0].Err() != nil || rs[0].APNsID != "ID" || rs[0].Token != "a" {
+		t.Errorf("unexpected apns result: %#v", rs)
+	}
+	if rs := s.SendFCM(fcm.Payload{RegistrationIDs: []string{"b", "c"}}); len(rs) != 2 || rs[1].RegistrationID != "c" || rs[1].Err() != nil {
+		t.Errorf("unexpected fcm results: %#v", rs)
+	}
+	if rs := s.SendFCM(fcm.Payload{To: "a"}); len(rs) != 1 || rs[0].To != "a" {
+		t.Errorf("unexpected fcm result: %#v", rs)
+	}
+	if rs := s.SendFCMv1(fcmv1.Payload{Message: messaging.Message{Topic: "news"}}); len(rs) != 1 || rs[0].Err() != nil {
+		t.Errorf("unexpected fcmv1 result: %#v", rs)
+	}
+
+	// the oldest message is discarded
+	msgs := s.Messages(Filter{})
+	if len(msgs) != 3 || msgs[0].ID != 2 || msgs[2].Topic != "news" {
+		t.Fatalf("unexpected messages: %#v", msgs)
+	}
+	if msgs := s.Messages(Filter{Token: "a"}); len(msgs) != 1 || msgs[0].Provider != fcm.Provider {
+		t.Errorf("unexpected messages of token a: %#v", msgs)
+	}
+	if msgs := s.Messages(Filter{Token: "c"}); len(msgs) != 1 || msgs[0].ID != 2 {
+		t.Errorf("unexpected messages of token c: %#v", msgs)
+	}
+	if msgs := s.Messages(Filter{Provider: fcmv1.Provider}); len(msgs) != 1 || msgs[0].ID != 4 {
+		t.Errorf("unexpected messages of fcmv1: %#v", msgs)
+	}
+
+	if n := s.Clear(Filter{Provider: fcm.Provider}); n != 2 {
+		t.Errorf("unexpected cleared: %d", n)
+	}
+	if msgs := s.Messages(Filter{}); len(msgs) != 1 || msgs[0].ID != 4 {
+		t.Errorf("unexpected messages after clear: %#v", msgs)
+	}
+}
+
+func TestServeHTTP(t *testing.T) {
+	s := NewStore(0)
+	s.SendAPNs(apns.Notification{Token: "a", Payload: apns.Payload{APS: &apns.APS{Alert: "hello"}}})
+	s.SendAPNs(apns.Notification{Token: "b"})
+	ts := httptest.NewServer(s)
+	defer ts.Close()
+
+	resp, err := http.Get(ts.URL + "?token=a")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	var msgs []struct {
+		Tokens       []string
+		Notification apns.Notification
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&msgs); err != nil {
+		t.Fatal(err)
+	}
+	if len(msgs) != 1 || msgs[0].Tokens[0] != "a" || msgs[0].Notification.Payload.APS.Alert != "hello" {
+		t.Errorf("unexpected messages: %#v", msgs)
+	}
+
+	req, _ := http.NewRequest(http.MethodDelete, ts.URL, nil)
+	resp, err = http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	var deleted struct{ Deleted int }
+	if err := json.NewDecoder(resp.Body).Decode(&deleted); err != nil {
+		t.Fatal(err)
+	}
+	if deleted.Deleted != 2 || len(s.Messages(Filter{})) != 0 {
+		t.Errorf("unexpected deleted: %d", deleted.Deleted)
+	}
+
+	resp, err = http.Post(ts.URL, "application/json", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusMethodNotAllowed {
+		t.Errorf("unexpected status: %d", resp.StatusCode)
+	}
+}
+
+func TestStoreRaw(t *testing.T) {
+	s := NewStore(0)
+	payload := json.RawMessage(`{"aps":{"alert":"hi","relevance-score":0.5},"x":1}`)
+	if rs := s.SendRawAPNs(apns.Notification{Token: "a", Header: apns.Header{ApnsTopic: "com.example"}}, payload); rs[0].Err() != nil || rs[0].Token != "a" {
+		t.Errorf("unexpected apns result: %#v", rs)
+	}
+	message := json.RawMessage(`{"message":{"token":"b","android":{"direct_boot_ok":true}}}`)
+	if rs := s.SendRawFCMv1(fcmv1.Payload{Message: messaging.Message{Token: "b"}}, message); rs[0].Err() != nil || rs[0].Token != "b" {
+		t.Errorf("unexpected fcmv1 result: %#v", rs)
+	}
+
+	b, err := json.Marshal(s.Messages(Filter{}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var msgs []struct {
+		Tokens       []string
+		Topic        string
+		Notification json.RawMessage
+	}
+	if err := json.Unmarshal(b, &msgs); err != nil {
+		t.Fatal(err)
+	}
+	if got, want := string(msgs[0].Notification), `{"header":{"apns-topic":"com.example"},"token":"a","payload":`+string(payload)+`}`; got != want {
+		t.Errorf("got %s want %s", got, want)
+	}
+	if got := string(msgs[1].Notification); got != string(message) || msgs[1].Tokens[0] != "b" {
+		t.Errorf("unexpected fcmv1 message: %s", got)
+	}
+}
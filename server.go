@@ -6,6 +6,7 @@ import (
 	"errors"
 	"fmt"
 	"io"
+	"io/ioutil"
 	"math"
 	"net"
 	"net/http"
@@ -17,13 +18,14 @@ import (
 	"syscall"
 	"time"
 
+	"firebase.google.com/go/messaging"
 	stats_api "github.com/fukata/golang-stats-api-handler"
 	"github.com/kayac/Gunfish/apns"
 	"github.com/kayac/Gunfish/config"
 	"github.com/kayac/Gunfish/fcm"
 	"github.com/kayac/Gunfish/fcmv1"
+	"github.com/kayac/Gunfish/logger"
 	"github.com/lestrrat-go/server-starter/listener"
-	"github.com/sirupsen/logrus"
 	"golang.org/x/net/netutil"
 )
 
@@ -66,41 +68,41 @@ func StartServer(conf config.Config, env Environment) {
 		InitErrorResponseHandler(DefaultResponseHandler{Hook: conf.Provider.ErrorHook})
 	}
 
+	if conf.Logger == nil {
+		conf.Logger = defaultLogger
+	}
+
 	// Init Provider
 	srvStats = NewStats(conf)
 	prov := &Provider{}
 
 	srvStats.DebugPort = conf.Provider.DebugPort
-	LogWithFields(logrus.Fields{
+	logger.New(conf.Logger, logger.Fields{
 		"type": "provider",
 	}).Infof("Size of POST request queue is %d", conf.Provider.QueueSize)
 
 	// Set APNS host addr according of environment
-	if env == Production {
-		conf.Apns.Host = ProdServer
-	} else if env == Development {
-		conf.Apns.Host = DevServer
-	} else if env == Test {
-		conf.Apns.Host = MockServer
+	if host := env.APNsHost(); host != "" {
+		conf.Apns.Host = host
 	}
 
 	// start supervisor
 	sup, err := StartSupervisor(&conf)
 	if err != nil {
-		LogWithFields(logrus.Fields{
+		logger.New(conf.Logger, logger.Fields{
 			"type": "provider",
 		}).Fatalf("Failed to start Gunfish: %s", err.Error())
 	}
 	prov.Sup = sup
 
-	LogWithFields(logrus.Fields{
+	logger.New(conf.Logger, logger.Fields{
 		"type": "supervisor",
 	}).Infof("Starts supervisor at %s", Production.String())
 
 	// StartServer listener
 	listeners, err := listener.ListenAll()
 	if err != nil {
-		LogWithFields(logrus.Fields{
+		logger.New(conf.Logger, logger.Fields{
 			"type": "provider",
 		}).Infof("%s. If you want graceful to restart Gunfish, you should use 'starter_server' (github.com/lestrrat/go-server-starter).", err)
 	}
@@ -112,7 +114,7 @@ func StartServer(conf config.Config, env Environment) {
 		service := fmt.Sprintf(":%d", conf.Provider.Port)
 		lis, err = net.Listen("tcp", service)
 		if err != nil {
-			LogWithFields(logrus.Fields{
+			logger.New(conf.Logger, logger.Fields{
 				"type": "provider",
 			}).Error(err)
 			sup.Shutdown()
@@ -120,7 +122,7 @@ func StartServer(conf config.Config, env Environment) {
 		}
 	} else {
 		if l, ok := listeners[0].Addr().(*net.TCPAddr); ok && l.Port != conf.Provider.Port {
-			LogWithFields(logrus.Fields{
+			logger.New(conf.Logger, logger.Fields{
 				"type": "provider",
 			}).Infof("'start_server' starts on :%d", l.Port)
 		}
@@ -131,54 +133,38 @@ func StartServer(conf config.Config, env Environment) {
 
 	// If many connections establishs between Gunfish provider and your application,
 	// Gunfish provider would be overload, and decrease performance.
-	llis := netutil.LimitListener(lis, conf.Provider.MaxConnections)
+	// LimitListener with 0 blocks every connection, so it is applied only with a positive value.
+	llis := lis
+	if conf.Provider.MaxConnections > 0 {
+		llis = netutil.LimitListener(lis, conf.Provider.MaxConnections)
+	}
 
 	// Start Gunfish provider
-	LogWithFields(logrus.Fields{
+	logger.New(conf.Logger, logger.Fields{
 		"type": "provider",
 	}).Infof("Starts provider on :%d ...", conf.Provider.Port)
 
-	mux := http.NewServeMux()
-	if conf.Apns.Enabled {
-		LogWithFields(logrus.Fields{
-			"type": "provider",
-		}).Infof("Enable endpoint /push/apns")
-		mux.HandleFunc("/push/apns", prov.PushAPNsHandler())
-	}
-	if conf.FCM.Enabled {
-		LogWithFields(logrus.Fields{
-			"type": "provider",
-		}).Infof("Enable endpoint /push/fcm")
-		mux.HandleFunc("/push/fcm", prov.PushFCMHandler(false))
-	}
-	if conf.FCMv1.Enabled {
-		LogWithFields(logrus.Fields{
-			"type": "provider",
-		}).Infof("Enable endpoint /push/fcm/v1")
-		mux.HandleFunc("/push/fcm/v1", prov.PushFCMHandler(true))
-	}
-	mux.HandleFunc("/stats/app", prov.StatsHandler())
-	mux.HandleFunc("/stats/profile", stats_api.Handler)
+	mux := prov.ServeMux(conf)
 
 	srv := &http.Server{Handler: mux}
 	var wg sync.WaitGroup
 	wg.Add(1)
 	go func() {
 		if err := srv.Serve(llis); err != nil && err != http.ErrServerClosed {
-			LogWithFields(logrus.Fields{}).Error(err)
+			logger.New(conf.Logger, logger.Fields{}).Error(err)
 		}
 		wg.Done()
 	}()
 
 	// signal handling
 	wg.Add(1)
-	go startSignalReciever(&wg, srv)
+	go startSignalReciever(&wg, srv, conf.Logger)
 
 	// wait for server shutdown complete
 	wg.Wait()
 
 	// if Gunfish server stop, Close queue
-	LogWithFields(logrus.Fields{
+	logger.New(conf.Logger, logger.Fields{
 		"type": "provider",
 	}).Info("Stopping server")
 
@@ -186,39 +172,83 @@ func StartServer(conf config.Config, env Environment) {
 	sup.Shutdown()
 }
 
+// ServeMux returns a ServeMux which routes push endpoints enabled by conf and stats endpoints.
+func (prov *Provider) ServeMux(conf config.Config) *http.ServeMux {
+	mux := http.NewServeMux()
+	if conf.Apns.Enabled {
+		prov.Sup.logWithFields(logger.Fields{
+			"type": "provider",
+		}).Infof("Enable endpoint /push/apns")
+		mux.HandleFunc("/push/apns", prov.PushAPNsHandler())
+	}
+	if conf.FCM.Enabled {
+		prov.Sup.logWithFields(logger.Fields{
+			"type": "provider",
+		}).Infof("Enable endpoint /push/fcm")
+		mux.HandleFunc("/push/fcm", prov.PushFCMHandler(false))
+	}
+	if conf.FCMv1.Enabled {
+		prov.Sup.logWithFields(logger.Fields{
+			"type": "provider",
+		}).Infof("Enable endpoint /push/fcm/v1")
+		mux.HandleFunc("/push/fcm/v1", prov.PushFCMHandler(true))
+	}
+	if sb := prov.Sup.Sandbox(); sb != nil {
+		prov.Sup.logWithFields(logger.Fields{
+			"type": "provider",
+		}).Infof("Enable endpoint /sandbox/messages")
+		mux.Handle("/sandbox/messages", sb)
+	}
+	mux.HandleFunc("/stats/app", prov.StatsHandler())
+	mux.HandleFunc("/stats/profile", stats_api.Handler)
+
+	return mux
+}
+
 func (prov *Provider) PushAPNsHandler() http.HandlerFunc {
 	return http.HandlerFunc(func(res http.ResponseWriter, req *http.Request) {
 		atomic.AddInt64(&(srvStats.RequestCount), 1)
 
 		// Method Not Alllowed
 		if err := validateMethod(res, req); err != nil {
-			logrus.Warn(err)
+			prov.Sup.logWithFields(logger.Fields{"type": "provider"}).Warn(err)
+			return
+		}
+
+		if prov.Sup.passthrough {
+			prov.pushRawAPNs(res, req)
 			return
 		}
 
 		// Parse request body
 		c := req.Header.Get("Content-Type")
-		var ps []PostedData
+		var (
+			ps   []PostedData
+			size int64
+		)
 		switch c {
 		case ApplicationXW3FormURLEncoded:
 			body := req.FormValue("json")
 			if err := json.Unmarshal([]byte(body), &ps); err != nil {
-				LogWithFields(logrus.Fields{}).Warnf("%s: %s", err, body)
+				prov.Sup.logWithFields(logger.Fields{"type": "provider"}).Warnf("%s: %s", err, body)
 				res.WriteHeader(http.StatusBadRequest)
 				fmt.Fprintf(res, `{"reason": "%s"}`, err.Error())
 				return
 			}
+			size = int64(len(body))
 		case ApplicationJSON:
-			decoder := json.NewDecoder(req.Body)
+			body := &countingReader{r: req.Body}
+			decoder := json.NewDecoder(body)
 			if err := decoder.Decode(&ps); err != nil {
-				LogWithFields(logrus.Fields{}).Warnf("%s: %v", err, ps)
+				prov.Sup.logWithFields(logger.Fields{"type": "provider"}).Warnf("%s: %v", err, ps)
 				res.WriteHeader(http.StatusBadRequest)
 				fmt.Fprintf(res, `{"reason": "%s"}`, err.Error())
 				return
 			}
+			size = body.n
 		default:
 			// Unsupported Media Type
-			logrus.Warnf("Unsupported Media Type: %s", c)
+			prov.Sup.logWithFields(logger.Fields{"type": "provider"}).Warnf("Unsupported Media Type: %s", c)
 			res.WriteHeader(http.StatusUnsupportedMediaType)
 			fmt.Fprintf(res, `{"reason":"Unsupported Media Type"}`)
 			return
@@ -237,7 +267,11 @@ func (prov *Provider) PushAPNsHandler() http.HandlerFunc {
 			switch t := p.Payload.Alert.(type) {
 			case map[string]interface{}:
 				var alert apns.Alert
-				mapToAlert(t, &alert)
+				if err := mapToAlert(t, &alert, prov.Sup.logWithFields(logger.Fields{"type": "provider"})); err != nil {
+					res.WriteHeader(http.StatusBadRequest)
+					fmt.Fprintf(res, `{"reason":"%s"}`, err.Error())
+					return
+				}
 				p.Payload.Alert = alert
 			}
 
@@ -252,6 +286,8 @@ func (prov *Provider) PushAPNsHandler() http.HandlerFunc {
 
 			reqs[i] = req
 		}
+		setSize(reqs, size)
+		prov.setCaller(reqs, req)
 
 		// enqueues one request into supervisor's queue.
 		if err := prov.Sup.EnqueueClientRequest(&reqs); err != nil {
@@ -271,7 +307,7 @@ func (prov *Provider) PushFCMHandler(v1 bool) http.HandlerFunc {
 
 		// Method Not Alllowed
 		if err := validateMethod(res, req); err != nil {
-			logrus.Warn(err)
+			prov.Sup.logWithFields(logger.Fields{"type": "provider"}).Warn(err)
 			return
 		}
 
@@ -279,20 +315,31 @@ func (prov *Provider) PushFCMHandler(v1 bool) http.HandlerFunc {
 		c := req.Header.Get("Content-Type")
 		if c != ApplicationJSON {
 			// Unsupported Media Type
-			logrus.Warnf("Unsupported Media Type: %s", c)
+			prov.Sup.logWithFields(logger.Fields{"type": "provider"}).Warnf("Unsupported Media Type: %s", c)
 			res.WriteHeader(http.StatusUnsupportedMediaType)
 			fmt.Fprintf(res, `{"reason":"Unsupported Media Type"}`)
 			return
 		}
 
 		// create request for fcm
-		grs, err := newFCMRequests(req.Body, v1)
+		var (
+			grs  []Request
+			err  error
+			body = &countingReader{r: req.Body}
+		)
+		if v1 && prov.Sup.passthrough {
+			grs, err = newRawFCMv1Requests(body)
+		} else {
+			grs, err = newFCMRequests(body, v1)
+		}
 		if err != nil {
-			logrus.Warnf("bad request: %s", err)
+			prov.Sup.logWithFields(logger.Fields{"type": "provider"}).Warnf("bad request: %s", err)
 			res.WriteHeader(http.StatusBadRequest)
 			fmt.Fprintf(res, "{\"reason\":\"%s\"}", err.Error())
 			return
 		}
+		setSize(grs, body.n)
+		prov.setCaller(grs, req)
 
 		// enqueues one request into supervisor's queue.
 		if err := prov.Sup.EnqueueClientRequest(&grs); err != nil {
@@ -306,6 +353,161 @@ func (prov *Provider) PushFCMHandler(v1 bool) http.HandlerFunc {
 	})
 }
 
+// setCaller sets the caller metadata of req to reqs when the delivery event log is enabled.
+func (prov *Provider) setCaller(reqs []Request, req *http.Request) {
+	al := prov.Sup.Audit()
+	if al == nil {
+		return
+	}
+	caller := al.Caller(req)
+	for i := range reqs {
+		reqs[i].Caller = caller
+	}
+}
+
+// countingReader counts bytes read from r.
+type countingReader struct {
+	r io.Reader
+	n int64
+}
+
+func (c *countingReader) Read(p []byte) (int, error) {
+	n, err := c.r.Read(p)
+	c.n += int64(n)
+	return n, err
+}
+
+// pushRawAPNs is PushAPNsHandler in passthrough mode.
+func (prov *Provider) pushRawAPNs(res http.ResponseWriter, req *http.Request) {
+	var body []byte
+	switch c := req.Header.Get("Content-Type"); c {
+	case ApplicationXW3FormURLEncoded:
+		body = []byte(req.FormValue("json"))
+	case ApplicationJSON:
+		var err error
+		if body, err = ioutil.ReadAll(req.Body); err != nil {
+			prov.Sup.logWithFields(logger.Fields{"type": "provider"}).Warnf("failed to read body: %s", err)
+			res.WriteHeader(http.StatusBadRequest)
+			fmt.Fprintf(res, `{"reason":"%s"}`, err.Error())
+			return
+		}
+	default:
+		// Unsupported Media Type
+		prov.Sup.logWithFields(logger.Fields{"type": "provider"}).Warnf("Unsupported Media Type: %s", c)
+		res.WriteHeader(http.StatusUnsupportedMediaType)
+		fmt.Fprintf(res, `{"reason":"Unsupported Media Type"}`)
+		return
+	}
+
+	reqs, err := newRawAPNsRequests(body)
+	if err != nil {
+		prov.Sup.logWithFields(logger.Fields{"type": "provider"}).Warnf("bad request: %s", err)
+		res.WriteHeader(http.StatusBadRequest)
+		fmt.Fprintf(res, `{"reason":%q}`, err.Error())
+		return
+	}
+	setSize(reqs, int64(len(body)))
+	prov.setCaller(reqs, req)
+
+	// enqueues one request into supervisor's queue.
+	if err := prov.Sup.EnqueueClientRequest(&reqs); err != nil {
+		setRetryAfter(res, req, err.Error())
+		return
+	}
+
+	// success
+	res.WriteHeader(http.StatusOK)
+	fmt.Fprint(res, "{\"result\": \"ok\"}")
+}
+
+// newRawAPNsRequests creates requests which keep payloads as posted.
+// It validates only that each payload is an object which has an object of "aps".
+func newRawAPNsRequests(body []byte) ([]Request, error) {
+	var ps []rawPostedData
+	if err := json.Unmarshal(body, &ps); err != nil {
+		return nil, err
+	}
+	if len(ps) == 0 {
+		return nil, errors.New("PostedData must not be empty")
+	}
+	if len(ps) > config.MaxRequestSize {
+		return nil, fmt.Errorf("PostedData was too long. Be less than %d: %v", config.MaxRequestSize, len(ps))
+	}
+
+	reqs := make([]Request, len(ps))
+	for i, p := range ps {
+		if p.Token == "" || !hasObject(p.Payload, "aps") {
+			return nil, fmt.Errorf("Payload format was malformed: %s", p.Payload)
+		}
+		reqs[i] = Request{
+			Notification: apns.Notification{
+				Header: p.Header,
+				Token:  p.Token,
+			},
+			Raw: p.Payload,
+		}
+	}
+	return reqs, nil
+}
+
+// newRawFCMv1Requests creates requests which keep payloads as posted.
+// It decodes only the target and the collapse key of each message, and validates that it has a token, a topic or a condition.
+func newRawFCMv1Requests(src io.Reader) ([]Request, error) {
+	dec := json.NewDecoder(src)
+	reqs := []Request{}
+	for {
+		var raw json.RawMessage
+		if err := dec.Decode(&raw); err == io.EOF {
+			break
+		} else if err != nil {
+			return nil, err
+		}
+		if len(reqs)+1 >= fcmv1.MaxBulkRequests {
+			return nil, errors.New("Too many requests")
+		}
+
+		var p struct {
+			Message *struct {
+				Token     string `json:"token"`
+				Topic     string `json:"topic"`
+				Condition string `json:"condition"`
+				Android   *struct {
+					CollapseKey string `json:"collapse_key"`
+				} `json:"android"`
+			} `json:"message"`
+		}
+		if err := json.Unmarshal(raw, &p); err != nil {
+			return nil, err
+		}
+		if p.Message == nil || p.Message.Token == "" && p.Message.Topic == "" && p.Message.Condition == "" {
+			return nil, fmt.Errorf("message must have token, topic or condition: %s", raw)
+		}
+		m := messaging.Message{
+			Token:     p.Message.Token,
+			Topic:     p.Message.Topic,
+			Condition: p.Message.Condition,
+		}
+		if p.Message.Android != nil {
+			m.Android = &messaging.AndroidConfig{CollapseKey: p.Message.Android.CollapseKey}
+		}
+		reqs = append(reqs, Request{
+			Notification: fcmv1.Payload{Message: m},
+			Raw:          raw,
+		})
+	}
+	return reqs, nil
+}
+
+// hasObject reports whether src is a JSON object which has an object of the key.
+func hasObject(src json.RawMessage, key string) bool {
+	var m map[string]json.RawMessage
+	if err := json.Unmarshal(src, &m); err != nil {
+		return false
+	}
+	v := m[key]
+	return len(v) > 0 && v[0] == '{'
+}
+
 func newFCMRequests(src io.Reader, v1 bool) ([]Request, error) {
 	dec := json.NewDecoder(src)
 	reqs := []Request{}
@@ -348,7 +550,7 @@ func validateMethod(res http.ResponseWriter, req *http.Request) error {
 }
 
 func setRetryAfter(res http.ResponseWriter, req *http.Request, reason string) {
-	now := time.Now().Unix()
+	now := Clock.Now().Unix()
 	atomic.StoreInt64(&(srvStats.ServiceUnavailableAt), now)
 	updateRetryAfterStat(now - srvStats.ServiceUnavailableAt)
 	// Retry-After is set seconds
@@ -359,7 +561,7 @@ func setRetryAfter(res http.ResponseWriter, req *http.Request, reason string) {
 
 func (prov *Provider) StatsHandler() http.HandlerFunc {
 	return http.HandlerFunc(func(res http.ResponseWriter, req *http.Request) {
-		if ok := validateStatsHandler(res, req); ok != true {
+		if ok := prov.validateStatsHandler(res, req); ok != true {
 			return
 		}
 
@@ -372,6 +574,9 @@ func (prov *Provider) StatsHandler() http.HandlerFunc {
 		atomic.StoreInt64(&(srvStats.RetryQueueSize), int64(len(prov.Sup.retryq)))
 		atomic.StoreInt64(&(srvStats.WorkersQueueSize), int64(wqs))
 		atomic.StoreInt64(&(srvStats.CommandQueueSize), int64(len(prov.Sup.cmdq)))
+		srvStats.InFlight = prov.Sup.inflight.snapshot()
+		srvStats.QueueMemory = prov.Sup.memory.load()
+		srvStats.MaxQueueMemory = prov.Sup.memory.max()
 		res.WriteHeader(http.StatusOK)
 		encoder := json.NewEncoder(res)
 		err := encoder.Encode(srvStats.GetStats())
@@ -400,49 +605,71 @@ func validatePostedData(ps []PostedData) error {
 	return nil
 }
 
-func validateStatsHandler(res http.ResponseWriter, req *http.Request) bool {
+func (prov *Provider) validateStatsHandler(res http.ResponseWriter, req *http.Request) bool {
 	// Method Not Alllowed
 	if req.Method != "GET" {
 		res.WriteHeader(http.StatusMethodNotAllowed)
 		fmt.Fprintf(res, `{"reason":"Method Not Allowed."}`)
-		logrus.Warnf("Method Not Allowed: %s", req.Method)
+		prov.Sup.logWithFields(logger.Fields{"type": "provider"}).Warnf("Method Not Allowed: %s", req.Method)
 		return false
 	}
 
 	return true
 }
 
-func mapToAlert(mapVal map[string]interface{}, alert *apns.Alert) {
+// mapToAlert sets values of mapVal to alert, and writes unsupported keys to log.
+func mapToAlert(mapVal map[string]interface{}, alert *apns.Alert, log logger.Entry) error {
 	a := reflect.ValueOf(alert).Elem()
 	for k, v := range mapVal {
 		newk, ok := AlertKeyToField[k]
 		if ok == true {
-			a.FieldByName(newk).Set(reflect.ValueOf(v))
+			f := a.FieldByName(newk)
+			switch f.Kind() {
+			case reflect.String:
+				s, ok := v.(string)
+				if !ok {
+					return fmt.Errorf("alert.%s must be a string: %v", k, v)
+				}
+				f.SetString(s)
+			case reflect.Slice:
+				args, ok := v.([]interface{})
+				if !ok {
+					return fmt.Errorf("alert.%s must be an array of strings: %v", k, v)
+				}
+				ss := make([]string, len(args))
+				for i, arg := range args {
+					if ss[i], ok = arg.(string); !ok {
+						return fmt.Errorf("alert.%s must be an array of strings: %v", k, v)
+					}
+				}
+				f.Set(reflect.ValueOf(ss))
+			}
 		} else {
-			logrus.Warnf("\"%s\" is not supported key for Alert struct.", k)
+			log.Warnf("\"%s\" is not supported key for Alert struct.", k)
 		}
 	}
+	return nil
 }
 
-func startSignalReciever(wg *sync.WaitGroup, srv *http.Server) {
+func startSignalReciever(wg *sync.WaitGroup, srv *http.Server, l logger.Logger) {
 	defer wg.Done()
 
-	sigChan := make(chan os.Signal)
+	sigChan := make(chan os.Signal, 1)
 	signal.Notify(sigChan, syscall.SIGTERM, syscall.SIGHUP, syscall.SIGINT)
 	s := <-sigChan
 	switch s {
 	case syscall.SIGHUP:
-		LogWithFields(logrus.Fields{
+		logger.New(l, logger.Fields{
 			"type": "provider",
 		}).Info("Gunfish recieved SIGHUP signal.")
 		srv.Shutdown(context.Background())
 	case syscall.SIGTERM:
-		LogWithFields(logrus.Fields{
+		logger.New(l, logger.Fields{
 			"type": "provider",
 		}).Info("Gunfish recieved SIGTERM signal.")
 		srv.Shutdown(context.Background())
 	case syscall.SIGINT:
-		LogWithFields(logrus.Fields{
+		logger.New(l, logger.Fields{
 			"type": "provider",
 		}).Info("Gunfish recieved SIGINT signal. Stopping server now...")
 		srv.Shutdown(context.Background())
@@ -0,0 +1,72 @@
+package gunfish
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+
+	"github.com/kayac/Gunfish/apns"
+	"github.com/kayac/Gunfish/logger"
+)
+
+func FuzzMapToAlert(f *testing.F) {
+	f.Add([]byte(`{"title":"t","body":"b","loc-args":["a","b"],"title-loc-args":[]}`))
+	f.Add([]byte(`{"title":1,"loc-args":"a"}`))
+	f.Add([]byte(`{"loc-args":[1],"unknown":true}`))
+	f.Fuzz(func(t *testing.T, data []byte) {
+		var m map[string]interface{}
+		if err := json.Unmarshal(data, &m); err != nil {
+			return
+		}
+		var alert apns.Alert
+		mapToAlert(m, &alert, logger.Entry{})
+	})
+}
+
+func FuzzNewFCMRequests(f *testing.F) {
+	f.Add([]byte(`{"registration_ids":["a","b"],"data":{"message":"x"}}`), false)
+	f.Add([]byte(`{"to":1}`), false)
+	f.Add([]byte(`{"message":{"token":"a","notification":{"title":"t"}}}{"message":{"topic":"b"}}`), true)
+	f.Add([]byte(`{"message":{"android":{"ttl":"xxx"}}}`), true)
+	f.Fuzz(func(t *testing.T, data []byte, v1 bool) {
+		reqs, err := newFCMRequests(bytes.NewReader(data), v1)
+		if err == nil && len(reqs) == 0 && !v1 {
+			t.Errorf("no requests without error: %s", data)
+		}
+	})
+}
+
+func FuzzPushAPNsHandler(f *testing.F) {
+	f.Add(`[{"token":"a","payload":{"aps":{"alert":"x"}}}]`, false)
+	f.Add(`[{"token":"a","payload":{"aps":{"alert":{"title":"t","loc-args":["a"]}}}}]`, true)
+	f.Add(`[{"token":"a","payload":{"aps":{"alert":{"title-loc-args":[1]}}}}]`, true)
+	f.Add(`[{"token":"a","payload":{}}]`, false)
+	f.Add(`[{"token":"a","payload":{"aps":"x"}}]`, true)
+
+	sup := Supervisor{queue: make(chan *[]Request, 1)}
+	prov := &Provider{Sup: sup}
+	handler := prov.PushAPNsHandler()
+	f.Fuzz(func(t *testing.T, body string, form bool) {
+		var req *http.Request
+		if form {
+			req = httptest.NewRequest(http.MethodPost, "/push/apns", strings.NewReader(url.Values{"json": {body}}.Encode()))
+			req.Header.Set("Content-Type", ApplicationXW3FormURLEncoded)
+		} else {
+			req = httptest.NewRequest(http.MethodPost, "/push/apns", strings.NewReader(body))
+			req.Header.Set("Content-Type", ApplicationJSON)
+		}
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, req)
+		switch w.Code {
+		case http.StatusOK:
+			<-sup.queue
+		case http.StatusBadRequest:
+		default:
+			t.Errorf("unexpected status %d: %s", w.Code, w.Body)
+		}
+	})
+}
@@ -2,21 +2,26 @@ package gunfish_test
 
 import (
 	"bytes"
+	"context"
 	"crypto/tls"
 	"encoding/json"
 	"fmt"
+	"io/ioutil"
 	"net/http"
 	"net/http/httptest"
 	"net/url"
 	"os"
 	"testing"
+	"time"
 
 	gunfish "github.com/kayac/Gunfish"
 	"github.com/kayac/Gunfish/apns"
 	"github.com/kayac/Gunfish/config"
+	"github.com/kayac/Gunfish/fcmv1"
 	"github.com/kayac/Gunfish/mock"
 	"github.com/sirupsen/logrus"
 	"golang.org/x/net/http2"
+	"golang.org/x/oauth2/google"
 )
 
 func TestMain(m *testing.M) {
@@ -331,6 +336,126 @@ func TestStats(t *testing.T) {
 	sup.Shutdown()
 }
 
+func TestPushFCMToMockServer(t *testing.T) {
+	scenario := mock.NewScenario(mock.Rule{
+		Name:   "not registered",
+		Match:  mock.Match{Token: "stale*"},
+		Reason: "NotRegistered",
+	})
+	ts := httptest.NewServer(mock.FCMMockServer(mock.Options{Scenario: scenario}))
+	defer ts.Close()
+
+	c := conf
+	c.FCM.Enabled = true
+	c.FCM.Endpoint = ts.URL + "/fcm/send"
+	sup, err := gunfish.StartSupervisor(&c)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer sup.Shutdown()
+	prov := &gunfish.Provider{Sup: sup}
+	handler := prov.PushFCMHandler(false)
+
+	data := []byte(`{"registration_ids":["aaa","stale-bbb"],"data":{"message":"test"}}`)
+	r, _ := newRequest(data, "POST", gunfish.ApplicationJSON)
+	w := httptest.NewRecorder()
+	handler.ServeHTTP(w, r)
+	if w.Code != http.StatusOK {
+		t.Fatalf("Expected status code is 200 but got %d", w.Code)
+	}
+
+	reqs := waitMockRequests(t, scenario, 1)
+	if g, w := reqs[0].Token, "aaa,stale-bbb"; g != w {
+		t.Errorf("unexpected registration ids: %s want %s", g, w)
+	}
+	if g, w := reqs[0].Rule, "not registered"; g != w {
+		t.Errorf("unexpected applied rule: %s want %s", g, w)
+	}
+	if g, w := reqs[0].Header.Get("Authorization"), "key="+c.FCM.APIKey; g != w {
+		t.Errorf("unexpected Authorization header: %s want %s", g, w)
+	}
+}
+
+func TestPushFCMv1ToMockServer(t *testing.T) {
+	scenario := mock.NewScenario(mock.Rule{
+		Name:   "quota exceeded",
+		Match:  mock.Match{Token: "limited"},
+		Status: http.StatusTooManyRequests,
+		Reason: "QUOTA_EXCEEDED",
+	})
+	ts := httptest.NewServer(mock.FCMv1MockServer(mock.Options{Scenario: scenario}))
+	defer ts.Close()
+
+	dir, err := ioutil.TempDir("", "gunfish-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	file, err := mock.WriteServiceAccount(dir, ts.URL+"/token", "gunfish-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, _ := ioutil.ReadFile(file)
+	jwtConf, err := google.JWTConfigFromJSON(b, fcmv1.Scope)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	c := conf
+	c.FCMv1 = config.SectionFCMv1{
+		Enabled:     true,
+		ProjectID:   "gunfish-test",
+		Endpoint:    ts.URL + "/v1/projects/gunfish-test/messages:send",
+		TokenSource: jwtConf.TokenSource(context.Background()),
+	}
+	sup, err := gunfish.StartSupervisor(&c)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer sup.Shutdown()
+	prov := &gunfish.Provider{Sup: sup}
+	handler := prov.PushFCMHandler(true)
+
+	data := []byte(`{"message":{"token":"aaa","data":{"message":"test"}}}
+{"message":{"token":"limited","data":{"message":"test"}}}`)
+	r, _ := newRequest(data, "POST", gunfish.ApplicationJSON)
+	w := httptest.NewRecorder()
+	handler.ServeHTTP(w, r)
+	if w.Code != http.StatusOK {
+		t.Fatalf("Expected status code is 200 but got %d", w.Code)
+	}
+
+	reqs := waitMockRequests(t, scenario, 2)
+	for _, req := range reqs {
+		if g, w := req.Header.Get("Authorization"), "Bearer "+mock.MockAccessToken; g != w {
+			t.Errorf("unexpected Authorization header: %s want %s", g, w)
+		}
+		switch req.Token {
+		case "aaa":
+			if req.Status != http.StatusOK {
+				t.Errorf("unexpected status: %d", req.Status)
+			}
+		case "limited":
+			if req.Rule != "quota exceeded" || req.Status != http.StatusTooManyRequests {
+				t.Errorf("unexpected request: %#v", req)
+			}
+		}
+	}
+}
+
+// waitMockRequests waits until the mock server receives n requests.
+func waitMockRequests(t *testing.T, scenario *mock.Scenario, n int) []mock.Request {
+	deadline := time.Now().Add(5 * time.Second)
+	for time.Now().Before(deadline) {
+		if reqs := scenario.Requests(); len(reqs) >= n {
+			return reqs
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	t.Fatalf("mock server received %d requests, want %d", len(scenario.Requests()), n)
+	return nil
+}
+
 func newRequest(data []byte, method string, c string) (*http.Request, error) {
 	req, err := http.NewRequest(
 		method,
@@ -21,7 +21,11 @@ type Stats struct {
 	RetryQueueSize         int64     `json:"retry_queue_size"`
 	WorkersQueueSize       int64     `json:"workers_queue_size"`
 	CommandQueueSize       int64     `json:"cmdq_queue_size"`
+	InFlight               InFlight  `json:"in_flight"`
+	QueueMemory            int64     `json:"queue_memory"`     // estimated bytes of notifications in flight
+	MaxQueueMemory         int64     `json:"max_queue_memory"` // 0 when unlimited
 	RetryCount             int64     `json:"retry_count"`
+	CoalescedCount         int64     `json:"coalesced_count"`
 	RequestCount           int64     `json:"req_count"`
 	SentCount              int64     `json:"sent_count"`
 	ErrCount               int64     `json:"err_count"`
@@ -33,7 +37,7 @@ type Stats struct {
 func NewStats(conf config.Config) Stats {
 	return Stats{
 		Pid:                 os.Getpid(),
-		StartAt:             time.Now().Unix(),
+		StartAt:             Clock.Now().Unix(),
 		RetryAfter:          int64(RetryAfterSecond / time.Second),
 		CertificateNotAfter: conf.Apns.CertificateNotAfter,
 	}
@@ -42,10 +46,10 @@ func NewStats(conf config.Config) Stats {
 // GetStats returns MemdStats of app
 func (st *Stats) GetStats() *Stats {
 	preUptime := st.Uptime
-	st.Uptime = time.Now().Unix() - st.StartAt
+	st.Uptime = Clock.Now().Unix() - st.StartAt
 	st.Period = st.Uptime - preUptime
 	if !st.CertificateNotAfter.IsZero() {
-		st.CertificateExpireUntil = int64(st.CertificateNotAfter.Sub(time.Now()).Seconds())
+		st.CertificateExpireUntil = int64(st.CertificateNotAfter.Sub(Clock.Now()).Seconds())
 	}
 	return st
 }
@@ -6,6 +6,7 @@ import (
 	"fmt"
 	"io"
 	"net/http"
+	"net/url"
 	"os"
 	"os/exec"
 	"sync"
@@ -14,11 +15,15 @@ import (
 	"time"
 
 	"github.com/kayac/Gunfish/apns"
+	"github.com/kayac/Gunfish/audit"
+	"github.com/kayac/Gunfish/chaos"
+	"github.com/kayac/Gunfish/clock"
 	"github.com/kayac/Gunfish/config"
 	"github.com/kayac/Gunfish/fcm"
 	"github.com/kayac/Gunfish/fcmv1"
+	"github.com/kayac/Gunfish/logger"
+	"github.com/kayac/Gunfish/sandbox"
 	uuid "github.com/satori/go.uuid"
-	"github.com/sirupsen/logrus"
 )
 
 // Supervisor monitor mutiple http2 clients.
@@ -27,9 +32,22 @@ type Supervisor struct {
 	retryq  chan Request    // enqueues this retry queue when to failed to send notification on the http layer.
 	cmdq    chan Command    // enqueues this command queue when to get error response from apns.
 	exit    chan struct{}   // exit channel is used to stop the supervisor.
-	ticker  *time.Ticker    // ticker checks retry queue that has notifications to resend periodically.
-	wgrp    *sync.WaitGroup
+	ticker  clock.Ticker    // ticker checks retry queue that has notifications to resend periodically.
+	wgrp    *sync.WaitGroup // waits for workers
+	cwgrp   *sync.WaitGroup // waits for command workers
 	workers []*Worker
+	chaos   *chaos.Injector // chaos injects faults into clients and hooks when [chaos] is enabled.
+	invoke  chaos.HookRunner
+	sandbox *sandbox.Store // sandbox stores notifications instead of sending them when [sandbox] is enabled.
+	audit   *audit.Log     // audit records the outcome of notifications when [audit] is enabled.
+	limits  logLimits
+	logger  logger.Logger
+
+	inflight        *inFlight
+	memory          *memoryBudget
+	coalescer       *coalescer
+	shutdownTimeout time.Duration
+	passthrough     bool
 }
 
 // Worker sends notification to apns.
@@ -44,6 +62,12 @@ type Worker struct {
 	id             int
 	errorHandler   func(Request, *http.Response, error)
 	successHandler func(Request, *http.Response)
+	audit          *audit.Log
+	limits         logLimits
+	logger         logger.Logger
+	inflight       *inFlight
+	memory         *memoryBudget
+	coalescer      *coalescer
 }
 
 // SenderResponse is responses to worker from sender.
@@ -55,6 +79,33 @@ type SenderResponse struct {
 	UID      string   `json:"resp_uid"`
 }
 
+// logLimits aggregates warnings of repeated conditions and samples logs of each notification by [log].
+type logLimits struct {
+	queueFull      *logger.Throttle
+	memoryFull     *logger.Throttle
+	retryQueueFull *logger.Throttle
+	cmdQueueFull   *logger.Throttle
+	success        *logger.Sampler
+}
+
+func newLogLimits(conf config.SectionLog) logLimits {
+	return logLimits{
+		queueFull:      logger.NewThrottle(conf.ThrottleInterval.Duration, Clock),
+		memoryFull:     logger.NewThrottle(conf.ThrottleInterval.Duration, Clock),
+		retryQueueFull: logger.NewThrottle(conf.ThrottleInterval.Duration, Clock),
+		cmdQueueFull:   logger.NewThrottle(conf.ThrottleInterval.Duration, Clock),
+		success:        logger.NewSampler(conf.SuccessSampling),
+	}
+}
+
+// flush writes the warnings which are suppressed after the last written one, when the conditions stop.
+func (l logLimits) flush() {
+	l.queueFull.Flush()
+	l.memoryFull.Flush()
+	l.retryQueueFull.Flush()
+	l.cmdQueueFull.Flush()
+}
+
 // Command has execute command and input stream.
 type Command struct {
 	command string
@@ -63,35 +114,56 @@ type Command struct {
 
 // EnqueueClientRequest enqueues request to supervisor's queue from external application service
 func (s *Supervisor) EnqueueClientRequest(reqs *[]Request) error {
-	logf := logrus.Fields{
+	logf := logger.Fields{
 		"type":             "supervisor",
 		"request_size":     len(*reqs),
 		"queue_size":       len(s.queue),
 		"retry_queue_size": len(s.retryq),
 	}
 
-	select {
-	case s.queue <- reqs:
-		LogWithFields(logf).Debugf("Enqueued request from provider.")
-	default:
-		LogWithFields(logf).Warnf("Supervisor's queue is full.")
+	size := sizeOf(*reqs)
+	if !s.memory.reserve(size) {
+		logf["request_bytes"] = size
+		logf["queue_memory"] = s.memory.load()
+		s.logWithFields(logf).Throttle(s.limits.memoryFull).Warnf("Supervisor's memory budget is exceeded.")
+		return fmt.Errorf("Supervisor's memory budget is exceeded")
+	}
+	replaced, ok := s.coalescer.coalesce(*reqs, func(rest []Request) bool {
+		n := int64(len(rest))
+		s.inflight.add(stageQueued, n)
+		select {
+		case s.queue <- &rest:
+			return true
+		default:
+			s.inflight.add(stageQueued, -n)
+			return false
+		}
+	})
+	if !ok {
+		s.memory.add(-size)
+		s.logWithFields(logf).Throttle(s.limits.queueFull).Warnf("Supervisor's queue is full.")
 		return fmt.Errorf("Supervisor's queue is full")
 	}
+	if len(replaced) > 0 {
+		s.memory.add(-sizeOf(replaced))
+		atomic.AddInt64(&(srvStats.CoalescedCount), int64(len(replaced)))
+		logf["coalesced"] = len(replaced)
+	}
+	log := s.logWithFields(logf)
+	for _, req := range replaced {
+		recordUnsent(s.audit, req, audit.ReasonCoalesced, log)
+	}
+	log.Debugf("Enqueued request from provider.")
 
 	return nil
 }
 
 // StartSupervisor starts supervisor
 func StartSupervisor(conf *config.Config) (Supervisor, error) {
-	// Calculates each worker queue size to accept requests with a given parameter of requests per sec as flow rate.
-	var wqSize int
-	tp := ((conf.Provider.RequestQueueSize * int(AverageResponseTime/time.Millisecond)) / 1000) / SenderNum
-	dif := (RequestPerSec - conf.Provider.RequestQueueSize/tp)
-	if dif > 0 {
-		wqSize = dif * int(FlowRateInterval/time.Second) / conf.Provider.WorkerNum
-	} else {
-		wqSize = -1 * dif * int(FlowRateInterval/time.Second) / conf.Provider.WorkerNum
+	if conf.Provider.WorkerNum < 1 {
+		return Supervisor{}, fmt.Errorf("worker_num must be a positive number: %d", conf.Provider.WorkerNum)
 	}
+	wqSize := workerQueueSize(conf.Provider.RequestQueueSize, conf.Provider.WorkerNum)
 
 	// Initialize Supervisor
 	swgrp := &sync.WaitGroup{}
@@ -100,57 +172,69 @@ func StartSupervisor(conf *config.Config) (Supervisor, error) {
 		retryq: make(chan Request, conf.Provider.RequestQueueSize*conf.Provider.WorkerNum),
 		cmdq:   make(chan Command, wqSize*conf.Provider.WorkerNum),
 		exit:   make(chan struct{}, 1),
-		ticker: time.NewTicker(RetryWaitTime),
+		ticker: Clock.NewTicker(RetryWaitTime),
 		wgrp:   swgrp,
+		cwgrp:  &sync.WaitGroup{},
+		limits: newLogLimits(conf.Log),
+		logger: conf.Logger,
+
+		inflight:        &inFlight{},
+		memory:          &memoryBudget{limit: conf.Provider.MaxQueueMemory * 1024 * 1024},
+		shutdownTimeout: conf.Provider.ShutdownTimeout.Duration,
+		passthrough:     conf.Provider.Passthrough,
+	}
+	if s.shutdownTimeout <= 0 {
+		s.shutdownTimeout = config.DefaultShutdownTimeout
+	}
+	if s.logger == nil {
+		s.logger = defaultLogger
+	}
+	l := s.logger
+	s.invoke = func(hook string, src io.Reader) ([]byte, error) {
+		return invokePipe(hook, src, l)
 	}
-	LogWithFields(logrus.Fields{}).Infof("Retry queue size: %d", cap(s.retryq))
-	LogWithFields(logrus.Fields{}).Infof("Queue size: %d", cap(s.queue))
+	if conf.Provider.Coalesce {
+		s.coalescer = newCoalescer()
+	}
+	if conf.Chaos.Enabled {
+		s.chaos = chaos.NewInjector(conf.Chaos)
+		s.invoke = s.chaos.Hook(s.invoke)
+		s.logWithFields(logger.Fields{"type": "supervisor"}).Warnf("Chaos mode is enabled. Faults are injected into clients and hooks: %+v", conf.Chaos)
+	}
+	if conf.Sandbox.Enabled {
+		s.sandbox = sandbox.NewStore(conf.Sandbox.MaxMessages)
+		s.logWithFields(logger.Fields{"type": "supervisor"}).Warnf("Sandbox mode is enabled. Notifications are stored in memory and not sent to providers.")
+	}
+	if conf.Audit.Enabled {
+		al, err := audit.Open(conf.Audit)
+		if err != nil {
+			return Supervisor{}, fmt.Errorf("failed to open audit log: %s", err)
+		}
+		s.audit = al
+	}
+	s.logWithFields(logger.Fields{}).Infof("Retry queue size: %d", cap(s.retryq))
+	s.logWithFields(logger.Fields{}).Infof("Queue size: %d", cap(s.queue))
 
 	// Time ticker to retry to send
-	go func() {
-		for {
-			select {
-			case <-s.ticker.C:
-				// Number of request retry send at once.
-				for cnt := 0; cnt < RetryOnceCount; cnt++ {
-					select {
-					case req := <-s.retryq:
-						reqs := &[]Request{req}
-						select {
-						case s.queue <- reqs:
-							LogWithFields(logrus.Fields{"type": "retry", "resend_cnt": req.Tries}).
-								Debugf("Enqueue to retry to send notification.")
-						default:
-							LogWithFields(logrus.Fields{"type": "retry"}).
-								Infof("Could not retry to enqueue because the supervisor queue is full.")
-						}
-					default:
-						break
-					}
-				}
-			case <-s.exit:
-				s.ticker.Stop()
-				return
-			}
-		}
-	}()
+	go s.resendRetryQueue()
 
 	// spawn command
 	for i := 0; i < conf.Provider.WorkerNum; i++ {
-		s.wgrp.Add(1)
+		s.cwgrp.Add(1)
 		go func() {
-			logf := logrus.Fields{"type": "cmd_worker"}
+			logf := logger.Fields{"type": "cmd_worker"}
 			for c := range s.cmdq {
-				LogWithFields(logf).Debugf("invoking command: %s %s", c.command, string(c.input))
+				s.logWithFields(logf).Debugf("invoking command: %s %s", c.command, c.input)
 				src := bytes.NewBuffer(c.input)
-				out, err := InvokePipe(c.command, src)
+				out, err := s.invoke(c.command, src)
+				s.inflight.add(stageHooks, -1)
 				if err != nil {
-					LogWithFields(logf).Errorf("(%s) %s", err.Error(), string(out))
+					s.logWithFields(logf).Errorf("(%s) %s", err.Error(), string(out))
 				} else {
-					LogWithFields(logf).Debugf("Success to execute command")
+					s.logWithFields(logf).Debugf("Success to execute command")
 				}
 			}
-			s.wgrp.Done()
+			s.cwgrp.Done()
 		}()
 	}
 
@@ -165,45 +249,80 @@ func StartSupervisor(conf *config.Config) (Supervisor, error) {
 		if conf.Apns.Enabled {
 			ac, err = apns.NewClient(conf.Apns)
 			if err != nil {
-				LogWithFields(logrus.Fields{
+				s.logWithFields(logger.Fields{
 					"type": "supervisor",
 				}).Errorf("faile to new client for apns: %s", err.Error())
 				break
 			}
 		}
 		if conf.FCM.Enabled {
-			fc, err = fcm.NewClient(conf.FCM.APIKey, nil, fcm.ClientTimeout)
+			var endpoint *url.URL
+			if conf.FCM.Endpoint != "" {
+				if endpoint, err = url.Parse(conf.FCM.Endpoint); err != nil {
+					s.logWithFields(logger.Fields{
+						"type": "supervisor",
+					}).Errorf("invalid endpoint for fcm: %s", err.Error())
+					break
+				}
+			}
+			fc, err = fcm.NewClient(conf.FCM.APIKey, endpoint, fcm.ClientTimeout)
 			if err != nil {
-				LogWithFields(logrus.Fields{
+				s.logWithFields(logger.Fields{
 					"type": "supervisor",
 				}).Errorf("failed to new client for fcm: %s", err.Error())
 				break
 			}
 		}
 		if conf.FCMv1.Enabled {
-			fcv1, err = fcmv1.NewClient(conf.FCMv1.TokenSource, conf.FCMv1.ProjectID, nil, fcmv1.ClientTimeout)
+			var endpoint *url.URL
+			if conf.FCMv1.Endpoint != "" {
+				if endpoint, err = url.Parse(conf.FCMv1.Endpoint); err != nil {
+					s.logWithFields(logger.Fields{
+						"type": "supervisor",
+					}).Errorf("invalid endpoint for fcmv1: %s", err.Error())
+					break
+				}
+			}
+			fcv1, err = fcmv1.NewClient(conf.FCMv1.TokenSource, conf.FCMv1.ProjectID, endpoint, fcmv1.ClientTimeout)
 			if err != nil {
-				LogWithFields(logrus.Fields{
+				s.logWithFields(logger.Fields{
 					"type": "supervisor",
 				}).Errorf("failed to new client for fcmv1: %s", err.Error())
 				break
 			}
 		}
+		if s.chaos != nil {
+			if ac != nil {
+				ac.HTTPClient().Transport = s.chaos.Transport(ac.HTTPClient().Transport)
+			}
+			if fc != nil {
+				fc.Client.Transport = s.chaos.Transport(fc.Client.Transport)
+			}
+			if fcv1 != nil {
+				fcv1.Client.Transport = s.chaos.Transport(fcv1.Client.Transport)
+			}
+		}
 		worker := Worker{
-			id:    i,
-			queue: make(chan Request, wqSize),
-			respq: make(chan SenderResponse, wqSize*100),
-			wgrp:  &sync.WaitGroup{},
-			sn:    SenderNum,
-			ac:    ac,
-			fc:    fc,
-			fcv1:  fcv1,
+			id:        i,
+			queue:     make(chan Request, wqSize),
+			respq:     make(chan SenderResponse, wqSize*100),
+			wgrp:      &sync.WaitGroup{},
+			sn:        SenderNum,
+			ac:        ac,
+			fc:        fc,
+			fcv1:      fcv1,
+			audit:     s.audit,
+			limits:    s.limits,
+			logger:    s.logger,
+			inflight:  s.inflight,
+			memory:    s.memory,
+			coalescer: s.coalescer,
 		}
 
 		s.workers = append(s.workers, &worker)
 		s.wgrp.Add(1)
 		go s.spawnWorker(worker, conf)
-		LogWithFields(logrus.Fields{
+		s.logWithFields(logger.Fields{
 			"type":      "worker",
 			"worker_id": i,
 		}).Debugf("Spawned worker-%d.", i)
@@ -215,81 +334,186 @@ func StartSupervisor(conf *config.Config) (Supervisor, error) {
 	return s, nil
 }
 
+// workerQueueSize calculates each worker queue size to accept requests with a given parameter of requests per sec as flow rate.
+func workerQueueSize(requestSize, workerNum int) int {
+	// tp is the time (msec) a sender takes to send a request of requestSize.
+	// It is truncated to 0 when requestSize is small, so keep it at least 1.
+	tp := ((requestSize * int(AverageResponseTime/time.Millisecond)) / 1000) / SenderNum
+	if tp < 1 {
+		tp = 1
+	}
+	dif := RequestPerSec - requestSize/tp
+	if dif < 0 {
+		dif = -dif
+	}
+	wqSize := dif * int(FlowRateInterval/time.Second) / workerNum
+	if wqSize < 1 {
+		wqSize = 1
+	}
+	return wqSize
+}
+
+// logWithFields returns a log entry with fields written by the logger of the supervisor.
+func (s Supervisor) logWithFields(fields map[string]interface{}) logger.Entry {
+	if s.logger == nil {
+		return LogWithFields(fields)
+	}
+	return logger.New(s.logger, fields)
+}
+
+// Chaos returns the fault injector, or nil when chaos mode is disabled.
+func (s Supervisor) Chaos() *chaos.Injector {
+	return s.chaos
+}
+
+// Sandbox returns the store of notifications, or nil when sandbox mode is disabled.
+func (s Supervisor) Sandbox() *sandbox.Store {
+	return s.sandbox
+}
+
+// Audit returns the delivery event log, or nil when it is disabled.
+func (s Supervisor) Audit() *audit.Log {
+	return s.audit
+}
+
+// resendRetryQueue moves requests in the retry queue to the supervisor's queue every RetryWaitTime.
+func (s *Supervisor) resendRetryQueue() {
+	for {
+		select {
+		case <-s.ticker.C():
+			s.limits.flush()
+			// Number of request retry send at once.
+			for cnt := 0; cnt < RetryOnceCount; cnt++ {
+				select {
+				case req := <-s.retryq:
+					reqs := &[]Request{req}
+					s.inflight.move(stageRetrying, stageQueued, 1)
+					select {
+					case s.queue <- reqs:
+						s.logWithFields(logger.Fields{"type": "retry", "resend_cnt": req.Tries}).
+							Debugf("Enqueue to retry to send notification.")
+					default:
+						s.inflight.add(stageQueued, -1)
+						s.memory.add(-req.size)
+						log := s.logWithFields(logger.Fields{"type": "retry"})
+						log.Infof("Could not retry to enqueue because the supervisor queue is full.")
+						recordUnsent(s.audit, req, audit.ReasonDropped, log)
+					}
+				default:
+					break
+				}
+			}
+		case <-s.exit:
+			s.ticker.Stop()
+			return
+		}
+	}
+}
+
 // Shutdown supervisor
 func (s *Supervisor) Shutdown() {
-	LogWithFields(logrus.Fields{
+	s.logWithFields(logger.Fields{
 		"type": "supervisor",
-	}).Infoln("Waiting for stopping supervisor...")
-
-	// Waiting for processing notification requests
-	zeroCnt := 0
-	tryCnt := 0
-	for zeroCnt < RestartWaitCount {
-		// if 's.counter' is not 0 potentially, here loop should not cancel to wait.
-		if len(s.queue)+len(s.cmdq)+len(s.retryq)+s.workersAllQueueLength() > 0 {
-			zeroCnt = 0
-			tryCnt++
-		} else {
-			zeroCnt++
-			tryCnt = 0
-		}
-
-		// force terminate application waiting for over 2 min.
-		// RestartWaitCount: 50
-		// ShutdownWaitTime: 10 (msec)
-		// 40 * 50 * 6 * 10 (msec) / 1,000 / 60 = 2 (min)
-		if tryCnt > RestartWaitCount*40*6 {
+	}).Info("Waiting for stopping supervisor...")
+
+	// Waiting for processing in-flight notifications and hooks
+	deadline := Clock.Now().Add(s.shutdownTimeout)
+	for s.inflight.load() > 0 {
+		if !Clock.Now().Before(deadline) {
+			s.logWithFields(logger.Fields{"type": "supervisor"}).
+				Warnf("Gave up waiting for in-flight notifications in %s: %+v", s.shutdownTimeout, s.inflight.snapshot())
 			break
 		}
-
-		time.Sleep(ShutdownWaitTime)
+		Clock.Sleep(ShutdownWaitTime)
 	}
 	close(s.exit)
-	close(s.cmdq)
+	// workers enqueue commands until they process all responses
 	s.wgrp.Wait()
+	close(s.cmdq)
+	s.cwgrp.Wait()
 	close(s.queue)
 	close(s.retryq)
+	if s.audit != nil {
+		if err := s.audit.Close(); err != nil {
+			s.logWithFields(logger.Fields{"type": "supervisor"}).Errorf("failed to close audit log: %s", err)
+		}
+	}
 
-	LogWithFields(logrus.Fields{
+	s.logWithFields(logger.Fields{
 		"type": "supervisor",
-	}).Infoln("Stoped supervisor.")
+	}).Info("Stoped supervisor.")
 }
 
 func (s *Supervisor) spawnWorker(w Worker, conf *config.Config) {
 	atomic.AddInt64(&(srvStats.Workers), 1)
 	defer func() {
 		atomic.AddInt64(&(srvStats.Workers), -1)
-		close(w.respq)
 		s.wgrp.Done()
 	}()
 
 	// Queue of SenderResopnse
 	for i := 0; i < w.sn; i++ {
 		w.wgrp.Add(1)
-		LogWithFields(logrus.Fields{
+		s.logWithFields(logger.Fields{
 			"type":      "worker",
 			"worker_id": w.id,
 		}).Debugf("Spawned a sender-%d-%d.", w.id, i)
 
 		// spawnSender
-		go spawnSender(w.queue, w.respq, w.wgrp, w.ac, w.fc, w.fcv1)
+		go w.spawnSender(s.sandbox)
 	}
 
-	func() {
-		for {
-			select {
-			case reqs := <-s.queue:
-				w.receiveRequests(reqs)
-			case resp := <-w.respq:
-				w.receiveResponse(resp, s.retryq, s.cmdq)
-			case <-s.exit:
-				return
-			}
+	// The worker never blocks on its queue, because senders block on respq until the worker receives their responses.
+	// Requests of the supervisor's queue are held in pending until the worker's queue accepts them,
+	// and the next requests are not received until then.
+	var pending []Request
+	for {
+		var (
+			reqq  = s.queue
+			queue chan<- Request
+			next  Request
+		)
+		if len(pending) > 0 {
+			reqq, queue, next = nil, w.queue, pending[0]
 		}
-	}()
+		select {
+		case reqs := <-reqq:
+			pending = *reqs
+			w.inflight.move(stageQueued, stageWorker, int64(len(pending)))
+		case queue <- next:
+			pending = pending[1:]
+			logger.New(w.logger, logger.Fields{
+				"type":              "worker",
+				"worker_id":         w.id,
+				"worker_queue_size": len(w.queue),
+				"pending_size":      len(pending),
+			}).Debugf("Enqueue request into worker's queue")
+		case resp := <-w.respq:
+			w.receiveResponse(resp, s.retryq, s.cmdq)
+			w.inflight.add(stageSending, -1)
+			w.memory.add(-resp.Req.size)
+		case <-s.exit:
+			w.stop(pending, s.retryq, s.cmdq)
+			return
+		}
+	}
+}
 
-	close(w.queue)
-	w.wgrp.Wait()
+// stop sends pending requests and closes the worker's queue, and receives responses until all senders exit.
+func (w *Worker) stop(pending []Request, retryq chan<- Request, cmdq chan Command) {
+	go func() {
+		for _, req := range pending {
+			w.queue <- req
+		}
+		close(w.queue)
+		w.wgrp.Wait()
+		close(w.respq)
+	}()
+	for resp := range w.respq {
+		w.receiveResponse(resp, retryq, cmdq)
+		w.inflight.add(stageSending, -1)
+		w.memory.add(-resp.Req.size)
+	}
 }
 
 func (w *Worker) receiveResponse(resp SenderResponse, retryq chan<- Request, cmdq chan Command) {
@@ -298,52 +522,56 @@ func (w *Worker) receiveResponse(resp SenderResponse, retryq chan<- Request, cmd
 	switch t := req.Notification.(type) {
 	case apns.Notification:
 		no := req.Notification.(apns.Notification)
-		logf := logrus.Fields{
-			"type":           "worker",
-			"status":         "-",
-			"apns_id":        "-",
-			"token":          no.Token,
-			"payload":        no.Payload,
-			"worker_id":      w.id,
-			"res_queue_size": len(w.respq),
-			"resend_cnt":     req.Tries,
-			"response_time":  resp.RespTime,
-			"resp_uid":       resp.UID,
-		}
-		handleAPNsResponse(resp, retryq, cmdq, logf)
+		log := logger.NewLazy(w.logger, func(f logger.Fields) {
+			f["type"] = "worker"
+			f["status"] = "-"
+			f["apns_id"] = "-"
+			f["token"] = no.Token
+			if req.Raw != nil {
+				f["payload"] = string(req.Raw)
+			} else {
+				f["payload"] = no.Payload
+			}
+			f["worker_id"] = w.id
+			f["res_queue_size"] = len(w.respq)
+			f["resend_cnt"] = req.Tries
+			f["response_time"] = resp.RespTime
+			f["resp_uid"] = resp.UID
+		})
+		w.handleAPNsResponse(resp, retryq, cmdq, log)
 	case fcm.Payload:
 		p := req.Notification.(fcm.Payload)
-		logf := logrus.Fields{
-			"type":           "worker",
-			"reg_ids_length": len(p.RegistrationIDs),
-			"notification":   p.Notification,
-			"data":           p.Data,
-			"worker_id":      w.id,
-			"res_queue_size": len(w.respq),
-			"resend_cnt":     req.Tries,
-			"response_time":  resp.RespTime,
-			"resp_uid":       resp.UID,
-		}
-		handleFCMResponse(resp, retryq, cmdq, logf)
+		log := logger.NewLazy(w.logger, func(f logger.Fields) {
+			f["type"] = "worker"
+			f["reg_ids_length"] = len(p.RegistrationIDs)
+			f["notification"] = p.Notification
+			f["data"] = p.Data
+			f["worker_id"] = w.id
+			f["res_queue_size"] = len(w.respq)
+			f["resend_cnt"] = req.Tries
+			f["response_time"] = resp.RespTime
+			f["resp_uid"] = resp.UID
+		})
+		w.handleFCMResponse(resp, retryq, cmdq, log)
 	case fcmv1.Payload:
 		p := req.Notification.(fcmv1.Payload)
-		logf := logrus.Fields{
-			"type":           "worker",
-			"token":          p.Message.Token,
-			"worker_id":      w.id,
-			"res_queue_size": len(w.respq),
-			"resend_cnt":     req.Tries,
-			"response_time":  resp.RespTime,
-			"resp_uid":       resp.UID,
-		}
-		handleFCMResponse(resp, retryq, cmdq, logf)
+		log := logger.NewLazy(w.logger, func(f logger.Fields) {
+			f["type"] = "worker"
+			f["token"] = p.Message.Token
+			f["worker_id"] = w.id
+			f["res_queue_size"] = len(w.respq)
+			f["resend_cnt"] = req.Tries
+			f["response_time"] = resp.RespTime
+			f["resp_uid"] = resp.UID
+		})
+		w.handleFCMResponse(resp, retryq, cmdq, log)
 	default:
-		LogWithFields(logrus.Fields{"type": "worker"}).Infof("Unknown response type:%s", t)
+		logger.New(w.logger, logger.Fields{"type": "worker"}).Infof("Unknown response type:%s", t)
 	}
 
 }
 
-func handleAPNsResponse(resp SenderResponse, retryq chan<- Request, cmdq chan Command, logf logrus.Fields) {
+func (w *Worker) handleAPNsResponse(resp SenderResponse, retryq chan<- Request, cmdq chan Command, log logger.Entry) {
 	req := resp.Req
 
 	// Response handling
@@ -352,120 +580,126 @@ func handleAPNsResponse(resp SenderResponse, retryq chan<- Request, cmdq chan Co
 		if len(resp.Results) > 0 {
 			result := resp.Results[0]
 			for _, key := range result.ExtraKeys() {
-				logf[key] = result.ExtraValue(key)
+				log = log.With(key, result.ExtraValue(key))
 			}
-			logf["status"] = result.Status()
-			LogWithFields(logf).Errorf("%s", resp.Err)
+			log = log.With("status", result.Status())
+			log.Errorf("%s", resp.Err)
+			recordDelivery(w.audit, resp, result, log)
 			// Error handling
-			onResponse(result, errorResponseHandler.HookCmd(), cmdq)
+			w.onResponse(result, errorResponseHandler.HookCmd(), cmdq)
 		} else {
 			// if 'result' is nil, HTTP connection error with APNS.
-			retry(retryq, req, errors.New("http connection error between APNs"), logf)
+			if !w.retry(retryq, req, errors.New("http connection error between APNs"), log) {
+				recordDelivery(w.audit, resp, nil, log)
+			}
 		}
 	} else {
 		atomic.AddInt64(&(srvStats.SentCount), 1)
 		if len(resp.Results) > 0 {
 			result := resp.Results[0]
 			for _, key := range result.ExtraKeys() {
-				logf[key] = result.ExtraValue(key)
+				log = log.With(key, result.ExtraValue(key))
 			}
 			if err := result.Err(); err != nil {
 				atomic.AddInt64(&(srvStats.ErrCount), 1)
 
 				// retry when provider auhentication token is expired
-				if err.Error() == apns.ExpiredProviderToken.String() {
-					retry(retryq, req, err, logf)
+				if err.Error() != apns.ExpiredProviderToken.String() || !w.retry(retryq, req, err, log) {
+					recordDelivery(w.audit, resp, result, log)
 				}
 
-				onResponse(result, errorResponseHandler.HookCmd(), cmdq)
-				LogWithFields(logf).Errorf("%s", err)
+				w.onResponse(result, errorResponseHandler.HookCmd(), cmdq)
+				log.Errorf("%s", err)
 			} else {
-				onResponse(result, "", cmdq)
-				LogWithFields(logf).Info("Succeeded to send a notification")
+				recordDelivery(w.audit, resp, result, log)
+				w.onResponse(result, "", cmdq)
+				log.Sample(w.limits.success).Info("Succeeded to send a notification")
 			}
 		}
 	}
 }
 
-func handleFCMResponse(resp SenderResponse, retryq chan<- Request, cmdq chan Command, logf logrus.Fields) {
+func (w *Worker) handleFCMResponse(resp SenderResponse, retryq chan<- Request, cmdq chan Command, log logger.Entry) {
 	if resp.Err != nil {
 		req := resp.Req
-		LogWithFields(logf).Warnf("response is nil. reason: %s", resp.Err.Error())
+		log.Warnf("response is nil. reason: %s", resp.Err.Error())
 		if req.Tries < SendRetryCount {
 			req.Tries++
 			atomic.AddInt64(&(srvStats.RetryCount), 1)
-			logf["resend_cnt"] = req.Tries
+			log = log.With("resend_cnt", req.Tries)
 
+			w.inflight.add(stageRetrying, 1)
+			w.memory.add(req.size)
 			select {
 			case retryq <- req:
-				LogWithFields(logf).
-					Debugf("Retry to enqueue into retryq because of http connection error with FCM.")
+				log.Debugf("Retry to enqueue into retryq because of http connection error with FCM.")
+				return
 			default:
-				LogWithFields(logf).
-					Warnf("Supervisor retry queue is full.")
+				w.inflight.add(stageRetrying, -1)
+				w.memory.add(-req.size)
+				log.Throttle(w.limits.retryQueueFull).Warnf("Supervisor retry queue is full.")
 			}
 		} else {
-			LogWithFields(logf).
-				Warnf("Retry count is over than %d. Could not deliver notification.", SendRetryCount)
+			log.Warnf("Retry count is over than %d. Could not deliver notification.", SendRetryCount)
 		}
+		recordDelivery(w.audit, resp, nil, log)
 		return
 	}
 
 	for _, result := range resp.Results {
+		recordDelivery(w.audit, resp, result, log)
 		// success when Error is nothing
 		err := result.Err()
 		if err == nil {
 			atomic.AddInt64(&(srvStats.SentCount), 1)
-			LogWithFields(logf).Info("Succeeded to send a notification")
+			log.Sample(w.limits.success).Info("Succeeded to send a notification")
 			continue
 		}
 		// handle error response each registration_id
 		atomic.AddInt64(&(srvStats.ErrCount), 1)
 		switch err.Error() {
 		case fcm.InvalidRegistration.String(), fcm.NotRegistered.String():
-			onResponse(result, errorResponseHandler.HookCmd(), cmdq)
-			LogWithFields(logf).Errorf("%s", err)
+			w.onResponse(result, errorResponseHandler.HookCmd(), cmdq)
+			log.Errorf("%s", err)
 		case fcmv1.Unregistered, fcmv1.InvalidArgument, fcmv1.NotFound:
-			onResponse(result, errorResponseHandler.HookCmd(), cmdq)
-			LogWithFields(logf).Errorf("%s", err)
+			w.onResponse(result, errorResponseHandler.HookCmd(), cmdq)
+			log.Errorf("%s", err)
 		default:
-			LogWithFields(logf).Errorf("Unknown error message: %s", err)
-		}
-	}
-}
-
-func (w *Worker) receiveRequests(reqs *[]Request) {
-	logf := logrus.Fields{
-		"type":              "worker",
-		"worker_id":         w.id,
-		"worker_queue_size": len(w.queue),
-		"request_size":      len(*reqs),
-	}
-
-	for _, req := range *reqs {
-		select {
-		case w.queue <- req:
-			LogWithFields(logf).
-				Debugf("Enqueue request into worker's queue")
+			log.Errorf("Unknown error message: %s", err)
 		}
 	}
 }
 
-func spawnSender(wq <-chan Request, respq chan<- SenderResponse, wgrp *sync.WaitGroup, ac *apns.Client, fc *fcm.Client, fcv1 *fcmv1.Client) {
-	defer wgrp.Done()
-	for req := range wq {
+// spawnSender sends requests of the worker's queue, and passes their responses to the worker.
+func (w *Worker) spawnSender(sb *sandbox.Store) {
+	defer w.wgrp.Done()
+	for req := range w.queue {
+		req = w.coalescer.take(req)
+		w.inflight.move(stageWorker, stageSending, 1)
 		var sres SenderResponse
 		switch t := req.Notification.(type) {
 		case apns.Notification:
-			if ac == nil {
-				LogWithFields(logrus.Fields{"type": "sender"}).
-					Errorf("apns client is not present")
+			if w.ac == nil {
+				w.drop(req, "apns client is not present")
 				continue
 			}
 			no := req.Notification.(apns.Notification)
-			start := time.Now()
-			results, err := ac.Send(no)
-			respTime := time.Now().Sub(start).Seconds()
+			start := Clock.Now()
+			var (
+				results []apns.Result
+				err     error
+			)
+			switch {
+			case sb != nil && req.Raw != nil:
+				results = sb.SendRawAPNs(no, req.Raw)
+			case sb != nil:
+				results = sb.SendAPNs(no)
+			case req.Raw != nil:
+				results, err = w.ac.SendRaw(no, req.Raw)
+			default:
+				results, err = w.ac.Send(no)
+			}
+			respTime := Clock.Now().Sub(start).Seconds()
 			rs := make([]Result, 0, len(results))
 			for _, v := range results {
 				rs = append(rs, v)
@@ -478,15 +712,22 @@ func spawnSender(wq <-chan Request, respq chan<- SenderResponse, wgrp *sync.Wait
 				UID:      uuid.NewV4().String(),
 			}
 		case fcm.Payload:
-			if fc == nil {
-				LogWithFields(logrus.Fields{"type": "sender"}).
-					Errorf("fcm client is not present")
+			if w.fc == nil {
+				w.drop(req, "fcm client is not present")
 				continue
 			}
 			p := req.Notification.(fcm.Payload)
-			start := time.Now()
-			results, err := fc.Send(p)
-			respTime := time.Now().Sub(start).Seconds()
+			start := Clock.Now()
+			var (
+				results []fcm.Result
+				err     error
+			)
+			if sb != nil {
+				results = sb.SendFCM(p)
+			} else {
+				results, err = w.fc.Send(p)
+			}
+			respTime := Clock.Now().Sub(start).Seconds()
 			rs := make([]Result, 0, len(results))
 			for _, v := range results {
 				rs = append(rs, v)
@@ -499,15 +740,27 @@ func spawnSender(wq <-chan Request, respq chan<- SenderResponse, wgrp *sync.Wait
 				UID:      uuid.NewV4().String(),
 			}
 		case fcmv1.Payload:
-			if fcv1 == nil {
-				LogWithFields(logrus.Fields{"type": "sender"}).
-					Errorf("fcmv1 client is not present")
+			if w.fcv1 == nil {
+				w.drop(req, "fcmv1 client is not present")
 				continue
 			}
 			p := req.Notification.(fcmv1.Payload)
-			start := time.Now()
-			results, err := fcv1.Send(p)
-			respTime := time.Now().Sub(start).Seconds()
+			start := Clock.Now()
+			var (
+				results []fcmv1.Result
+				err     error
+			)
+			switch {
+			case sb != nil && req.Raw != nil:
+				results = sb.SendRawFCMv1(p, req.Raw)
+			case sb != nil:
+				results = sb.SendFCMv1(p)
+			case req.Raw != nil:
+				results, err = w.fcv1.SendRaw(p, req.Raw)
+			default:
+				results, err = w.fcv1.Send(p)
+			}
+			respTime := Clock.Now().Sub(start).Seconds()
 			rs := make([]Result, 0, len(results))
 			for _, v := range results {
 				rs = append(rs, v)
@@ -520,39 +773,35 @@ func spawnSender(wq <-chan Request, respq chan<- SenderResponse, wgrp *sync.Wait
 				UID:      uuid.NewV4().String(),
 			}
 		default:
-			LogWithFields(logrus.Fields{"type": "sender"}).
-				Errorf("Unknown request data type: %s", t)
+			w.drop(req, fmt.Sprintf("Unknown request data type: %s", t))
 			continue
 		}
 
-		select {
-		case respq <- sres:
-			LogWithFields(logrus.Fields{"type": "sender", "resp_queue_size": len(respq)}).
-				Debugf("Enqueue response into respq.")
-		default:
-			LogWithFields(logrus.Fields{"type": "sender", "resp_queue_size": len(respq)}).
-				Warnf("Response queue is full.")
-		}
+		// blocks until the worker receives it, not to drop the outcome of the notification
+		w.respq <- sres
+		logger.New(w.logger, logger.Fields{"type": "sender", "resp_queue_size": len(w.respq)}).
+			Debugf("Enqueue response into respq.")
 	}
 }
 
-func (s Supervisor) workersAllQueueLength() int {
-	sum := 0
-	for _, w := range s.workers {
-		sum += len(w.queue) + len(w.respq)
-	}
-	return sum
+// drop gives up req before sending it, and writes the reason to the logs.
+func (w *Worker) drop(req Request, reason string) {
+	log := logger.New(w.logger, logger.Fields{"type": "sender"})
+	log.Error(reason)
+	recordUnsent(w.audit, req, audit.ReasonDropped, log)
+	w.inflight.add(stageSending, -1)
+	w.memory.add(-req.size)
 }
 
-func onResponse(result Result, cmd string, cmdq chan<- Command) {
-	logf := logrus.Fields{
-		"provider": result.Provider(),
-		"type":     "on_response",
-		"token":    result.RecipientIdentifier(),
-	}
-	for _, key := range result.ExtraKeys() {
-		logf[key] = result.ExtraValue(key)
-	}
+func (w *Worker) onResponse(result Result, cmd string, cmdq chan<- Command) {
+	log := logger.NewLazy(w.logger, func(f logger.Fields) {
+		f["provider"] = result.Provider()
+		f["type"] = "on_response"
+		f["token"] = result.RecipientIdentifier()
+		for _, key := range result.ExtraKeys() {
+			f[key] = result.ExtraValue(key)
+		}
+	})
 	// on error handler
 	if err := result.Err(); err != nil {
 		errorResponseHandler.OnResponse(result)
@@ -569,16 +818,23 @@ func onResponse(result Result, cmd string, cmdq chan<- Command) {
 		command: cmd,
 		input:   b,
 	}
+	w.inflight.add(stageHooks, 1)
 	select {
 	case cmdq <- command:
-		LogWithFields(logf).Debugf("Enqueue command: %s < %s", command.command, string(b))
+		log.Debugf("Enqueue command: %s < %s", command.command, b)
 	default:
-		LogWithFields(logf).Warnf("Command queue is full, so could not execute commnad: %v", command)
+		w.inflight.add(stageHooks, -1)
+		log.Throttle(w.limits.cmdQueueFull).Warnf("Command queue is full, so could not execute commnad: %v", command)
 	}
 }
 
+// InvokePipe runs hook with src as its STDIN, and returns its output.
 func InvokePipe(hook string, src io.Reader) ([]byte, error) {
-	logf := logrus.Fields{"type": "invoke_pipe"}
+	return invokePipe(hook, src, defaultLogger)
+}
+
+func invokePipe(hook string, src io.Reader, l logger.Logger) ([]byte, error) {
+	logf := logger.Fields{"type": "invoke_pipe"}
 	cmd := exec.Command("sh", "-c", hook)
 
 	stdin, err := cmd.StdinPipe()
@@ -602,9 +858,9 @@ func InvokePipe(hook string, src io.Reader) ([]byte, error) {
 	// src copy to cmd.stdin
 	_, err = io.Copy(stdin, src)
 	if e, ok := err.(*os.PathError); ok && e.Err == syscall.EPIPE {
-		LogWithFields(logf).Errorf(e.Error())
+		logger.New(l, logf).Errorf(e.Error())
 	} else if err != nil {
-		LogWithFields(logf).Errorf("failed to write STDIN: cmd( %s ), error( %s )", hook, err.Error())
+		logger.New(l, logf).Errorf("failed to write STDIN: cmd( %s ), error( %s )", hook, err.Error())
 	}
 	stdin.Close()
 
@@ -612,22 +868,108 @@ func InvokePipe(hook string, src io.Reader) ([]byte, error) {
 	return b.Bytes(), err
 }
 
-func retry(retryq chan<- Request, req Request, err error, logf logrus.Fields) {
+// retry enqueues req into retryq, and reports whether it is enqueued.
+func (w *Worker) retry(retryq chan<- Request, req Request, err error, log logger.Entry) bool {
 	if req.Tries < SendRetryCount {
 		req.Tries++
 		atomic.AddInt64(&(srvStats.RetryCount), 1)
-		logf["resend_cnt"] = req.Tries
+		log = log.With("resend_cnt", req.Tries)
 
+		w.inflight.add(stageRetrying, 1)
+		w.memory.add(req.size)
 		select {
 		case retryq <- req:
-			LogWithFields(logf).
-				Debugf("%s: Retry to enqueue into retryq.", err.Error())
+			log.Debugf("%s: Retry to enqueue into retryq.", err.Error())
+			return true
 		default:
-			LogWithFields(logf).
-				Warnf("Supervisor retry queue is full.")
+			w.inflight.add(stageRetrying, -1)
+			w.memory.add(-req.size)
+			log.Throttle(w.limits.retryQueueFull).Warnf("Supervisor retry queue is full.")
+		}
+	} else {
+		log.Warnf("Retry count is over than %d. Could not deliver notification.", SendRetryCount)
+	}
+	return false
+}
+
+// recordDelivery writes the outcome of resp to the delivery event log.
+// result is nil when the notification could not be sent, and then an event is written for each recipient.
+func recordDelivery(al *audit.Log, resp SenderResponse, result Result, log logger.Entry) {
+	if al == nil {
+		return
+	}
+	e := audit.Event{
+		Time:    Clock.Now(),
+		Tries:   resp.Req.Tries + 1,
+		Latency: time.Duration(resp.RespTime * float64(time.Second)),
+		Caller:  resp.Req.Caller,
+	}
+	var recipients []string
+	if result != nil {
+		e.Provider = result.Provider()
+		e.Status = result.Status()
+		recipients = []string{result.RecipientIdentifier()}
+		switch r := result.(type) {
+		case apns.Result:
+			e.ID, e.Reason = r.APNsID, r.Reason
+		case fcm.Result:
+			e.ID, e.Reason = r.MessageID, r.Error
+		case fcmv1.Result:
+			e.ID = r.Name
+			if r.Error != nil {
+				e.Reason = r.Error.Status
+			}
 		}
 	} else {
-		LogWithFields(logf).
-			Warnf("Retry count is over than %d. Could not deliver notification.", SendRetryCount)
+		if resp.Err != nil {
+			e.Reason = resp.Err.Error()
+		}
+		e.Provider, recipients = recipientsOf(resp.Req.Notification)
+	}
+	writeEvents(al, e, recipients, log)
+}
+
+// recordUnsent writes req which is given up before sending it, with reason, to the delivery event log.
+func recordUnsent(al *audit.Log, req Request, reason string, log logger.Entry) {
+	if al == nil {
+		return
+	}
+	e := audit.Event{
+		Time:   Clock.Now(),
+		Reason: reason,
+		Tries:  req.Tries,
+		Caller: req.Caller,
+	}
+	var recipients []string
+	e.Provider, recipients = recipientsOf(req.Notification)
+	writeEvents(al, e, recipients, log)
+}
+
+// recipientsOf returns the provider and the recipients of n.
+func recipientsOf(n Notification) (string, []string) {
+	switch n := n.(type) {
+	case apns.Notification:
+		return apns.Provider, []string{n.Token}
+	case fcm.Payload:
+		if len(n.RegistrationIDs) == 0 {
+			return fcm.Provider, []string{n.To}
+		}
+		return fcm.Provider, n.RegistrationIDs
+	case fcmv1.Payload:
+		return fcmv1.Provider, []string{n.Message.Token}
+	}
+	return "", nil
+}
+
+// writeEvents writes e for each recipient.
+func writeEvents(al *audit.Log, e audit.Event, recipients []string, log logger.Entry) {
+	for _, r := range recipients {
+		e.TokenHash = ""
+		if r != "" {
+			e.TokenHash = audit.HashToken(r)
+		}
+		if err := al.Record(e); err != nil {
+			log.Errorf("failed to write audit log: %s", err)
+		}
 	}
 }
@@ -271,3 +271,19 @@ func TestSuccessOrFailureInvoke(t *testing.T) {
 		t.Errorf("hooks stderr must not be captured: %s", out)
 	}
 }
+
+func TestStartSupervisorWithSmallRequestSize(t *testing.T) {
+	c := conf
+	c.Provider.RequestQueueSize = config.MinRequestSize
+
+	sup, err := gunfish.StartSupervisor(&c)
+	if err != nil {
+		t.Fatalf("cannot start supervisor: %s", err)
+	}
+	sup.Shutdown()
+
+	c.Provider.WorkerNum = 0
+	if _, err := gunfish.StartSupervisor(&c); err == nil {
+		t.Error("expected error for worker_num 0")
+	}
+}
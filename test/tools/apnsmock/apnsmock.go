@@ -1,8 +1,11 @@
 package main
 
 import (
+	"crypto/tls"
+	"crypto/x509"
 	"flag"
 	"fmt"
+	"io/ioutil"
 	"log"
 	"net/http"
 
@@ -13,18 +16,67 @@ func main() {
 	var (
 		port              int
 		keyFile, certFile string
+		rulesFile         string
+		maxRequests       int
+		jwtKeyFile        string
+		teamID, kid       string
+		clientCA          string
 		verbose           bool
 	)
 
 	flag.IntVar(&port, "port", 2195, "apns mock server port")
 	flag.StringVar(&keyFile, "cert-file", "", "apns mock server key file")
 	flag.StringVar(&certFile, "key-file", "", "apns mock server cert file")
+	flag.StringVar(&rulesFile, "rules", "", "JSON file of scenario rules")
+	flag.IntVar(&maxRequests, "max-requests", 1000, "max number of recorded requests which /mock/requests returns (0 disables recording, negative is unlimited)")
+	flag.StringVar(&jwtKeyFile, "jwt-key-file", "", "key file (.p8) to verify provider authentication tokens")
+	flag.StringVar(&teamID, "team-id", "", "team id of provider authentication tokens")
+	flag.StringVar(&kid, "kid", "", "kid of provider authentication tokens")
+	flag.StringVar(&clientCA, "client-ca", "", "CA certificate file to verify client certificates")
 	flag.BoolVar(&verbose, "verbose", false, "verbose flag")
 	flag.Parse()
 
-	mux := mock.APNsMockServer(verbose)
+	scenario := mock.NewScenario()
+	if rulesFile != "" {
+		var err error
+		if scenario, err = mock.LoadScenario(rulesFile); err != nil {
+			log.Fatal(err)
+		}
+	}
+	scenario.SetMaxRequests(maxRequests)
+
+	opts := mock.Options{
+		Verbose:  verbose,
+		Latency:  mock.DefaultLatency,
+		Scenario: scenario,
+	}
+	if jwtKeyFile != "" {
+		key, err := ioutil.ReadFile(jwtKeyFile)
+		if err != nil {
+			log.Fatal(err)
+		}
+		if opts.ProviderToken, err = mock.NewProviderTokenVerifier(key, teamID, kid); err != nil {
+			log.Fatal(err)
+		}
+	}
+	if clientCA != "" {
+		ca, err := ioutil.ReadFile(clientCA)
+		if err != nil {
+			log.Fatal(err)
+		}
+		opts.ClientCAs = x509.NewCertPool()
+		if !opts.ClientCAs.AppendCertsFromPEM(ca) {
+			log.Fatalf("no certificates in %s", clientCA)
+		}
+	}
+
+	srv := &http.Server{
+		Addr:      fmt.Sprintf(":%d", port),
+		Handler:   mock.NewAPNsMockServer(opts),
+		TLSConfig: &tls.Config{ClientAuth: tls.RequestClientCert},
+	}
 	log.Println("start apnsmock server")
-	if err := http.ListenAndServeTLS(fmt.Sprintf(":%d", port), keyFile, certFile, mux); err != nil {
+	if err := srv.ListenAndServeTLS(keyFile, certFile); err != nil {
 		log.Fatal(err)
 	}
 }
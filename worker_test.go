@@ -0,0 +1,198 @@
+package gunfish
+
+import (
+	"bytes"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/kayac/Gunfish/apns"
+	"github.com/kayac/Gunfish/audit"
+	"github.com/kayac/Gunfish/fcm"
+	"github.com/kayac/Gunfish/sandbox"
+)
+
+type lineCounter struct {
+	mu    sync.Mutex
+	lines int
+}
+
+func (c *lineCounter) Write(p []byte) (int, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.lines += bytes.Count(p, []byte("\n"))
+	return len(p), nil
+}
+
+// TestWorkerProcessesEveryResponse runs workers with tiny queues, which overflowed and dropped responses before.
+// Run it with -race.
+func TestWorkerProcessesEveryResponse(t *testing.T) {
+	const (
+		workers   = 4
+		batches   = 200
+		batchSize = 50
+	)
+	lc := &lineCounter{}
+	al, err := audit.New(lc, audit.FormatJSON, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	fc, err := fcm.NewClient("key", nil, fcm.ClientTimeout)
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := &Supervisor{
+		queue:   make(chan *[]Request, 8),
+		retryq:  make(chan Request, 8),
+		cmdq:    make(chan Command, 8),
+		exit:    make(chan struct{}),
+		wgrp:    &sync.WaitGroup{},
+		sandbox: sandbox.NewStore(1),
+		audit:   al,
+
+		inflight: &inFlight{},
+		memory:   &memoryBudget{},
+	}
+	for i := 0; i < workers; i++ {
+		w := Worker{
+			id:    i,
+			queue: make(chan Request, 1),
+			respq: make(chan SenderResponse, 1),
+			wgrp:  &sync.WaitGroup{},
+			sn:    8,
+			fc:    fc,
+			audit: al,
+
+			inflight: s.inflight,
+			memory:   s.memory,
+		}
+		s.wgrp.Add(1)
+		go s.spawnWorker(w, nil)
+	}
+
+	for i := 0; i < batches; i++ {
+		reqs := make([]Request, batchSize)
+		for j := range reqs {
+			reqs[j] = Request{Notification: fcm.Payload{To: fmt.Sprintf("token-%d-%d", i, j)}, size: 100}
+		}
+		s.inflight.add(stageQueued, batchSize)
+		s.memory.add(sizeOf(reqs))
+		s.queue <- &reqs
+	}
+	for deadline := time.Now().Add(time.Second * 10); len(s.queue) > 0 && time.Now().Before(deadline); {
+		time.Sleep(time.Millisecond)
+	}
+	// workers process requests which they have received already before exiting
+	close(s.exit)
+	s.wgrp.Wait()
+
+	if got, want := lc.lines, batches*batchSize; got != want {
+		t.Errorf("processed %d responses, want %d", got, want)
+	}
+	if f := s.inflight.snapshot(); f != (InFlight{}) {
+		t.Errorf("notifications are still in flight: %+v", f)
+	}
+	if n := s.memory.load(); n != 0 {
+		t.Errorf("%d bytes are still accounted", n)
+	}
+}
+
+func TestShutdownTimeout(t *testing.T) {
+	start := time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)
+	fake, restore := withFakeClock(start)
+	defer restore()
+
+	s := &Supervisor{
+		queue:  make(chan *[]Request, 1),
+		retryq: make(chan Request, 1),
+		cmdq:   make(chan Command, 1),
+		exit:   make(chan struct{}),
+		wgrp:   &sync.WaitGroup{},
+		cwgrp:  &sync.WaitGroup{},
+
+		inflight:        &inFlight{},
+		shutdownTimeout: time.Minute,
+	}
+	// a notification which is never finished
+	s.inflight.add(stageQueued, 1)
+	s.inflight.move(stageQueued, stageSending, 1)
+
+	s.Shutdown()
+	if elapsed := fake.Now().Sub(start); elapsed != time.Minute {
+		t.Errorf("unexpected elapsed time: %s", elapsed)
+	}
+	if f := s.inflight.snapshot(); f != (InFlight{Total: 1, Sending: 1}) {
+		t.Errorf("unexpected in flight: %+v", f)
+	}
+}
+
+func TestMemoryBudget(t *testing.T) {
+	body := `[{"token":"aaa","payload":{"aps":{"alert":"hi"}}},{"token":"bbb","payload":{"aps":{"alert":"hi"}}}]`
+	s := Supervisor{
+		queue:  make(chan *[]Request, 2),
+		memory: &memoryBudget{limit: int64(len(body)) + 10},
+	}
+	handler := (&Provider{Sup: s}).PushAPNsHandler()
+	post := func() *httptest.ResponseRecorder {
+		req := httptest.NewRequest(http.MethodPost, "/push/apns", strings.NewReader(body))
+		req.Header.Set("Content-Type", ApplicationJSON)
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, req)
+		return w
+	}
+
+	if w := post(); w.Code != http.StatusOK {
+		t.Fatalf("unexpected status %d: %s", w.Code, w.Body)
+	}
+	if n := s.memory.load(); n != int64(len(body)) {
+		t.Errorf("accounted %d bytes, want %d", n, len(body))
+	}
+	// the queue has room, but the memory does not
+	if w := post(); w.Code != http.StatusServiceUnavailable || w.Header().Get("Retry-After") == "" {
+		t.Errorf("unexpected response %d: %s", w.Code, w.Body)
+	}
+	if n := s.memory.load(); n != int64(len(body)) {
+		t.Errorf("rejected request is accounted: %d bytes", n)
+	}
+
+	// released after the responses are handled
+	s.memory.add(-sizeOf(*<-s.queue))
+	if w := post(); w.Code != http.StatusOK {
+		t.Errorf("unexpected status %d: %s", w.Code, w.Body)
+	}
+}
+
+func TestSenderDropIsRecorded(t *testing.T) {
+	var b bytes.Buffer
+	al, err := audit.New(&b, audit.FormatLTSV, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	w := &Worker{
+		queue:    make(chan Request, 1),
+		respq:    make(chan SenderResponse, 1),
+		wgrp:     &sync.WaitGroup{},
+		audit:    al,
+		inflight: &inFlight{},
+		memory:   &memoryBudget{},
+	}
+	// no APNs client
+	req := Request{Notification: apns.Notification{Token: "aaa"}, size: 10}
+	w.inflight.add(stageWorker, 1)
+	w.memory.add(req.size)
+	w.queue <- req
+	close(w.queue)
+	w.wgrp.Add(1)
+	w.spawnSender(nil)
+
+	if !strings.Contains(b.String(), "\treason:"+audit.ReasonDropped+"\t") {
+		t.Errorf("unexpected record: %s", b.String())
+	}
+	if w.inflight.load() != 0 || w.memory.load() != 0 || len(w.respq) != 0 {
+		t.Errorf("dropped request is still accounted")
+	}
+}